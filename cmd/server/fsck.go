@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/leca/dt-cloudflare-images/internal/config"
+	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/fsck"
+)
+
+// runFsck implements the fsck subcommand: it checks the configured database
+// and storage against each other, prints the problems found, and returns
+// the exit status: 0 if none remain, 1 if some do, 2 if the check failed.
+func runFsck(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "delete orphaned blobs and mark the records of missing and corrupt ones broken")
+	dryRun := flags.Bool("dry-run", false, "with -repair, report the repairs without making them")
+	verify := flags.Bool("verify", true, "read every blob to check it against its recorded digest")
+	orphanAge := flags.Duration("orphan-age", time.Duration(cfg.FsckOrphanAge)*time.Second,
+		"how old a blob without a record must be to count as orphaned")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	db, err := database.Open(cfg.DBPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: opening database: %v\n", err)
+		return 2
+	}
+	defer db.Close()
+	store, err := openStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: opening storage: %v\n", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := fsck.Check(ctx, db, store, fsck.Options{
+		Repair:    *repair,
+		DryRun:    *dryRun,
+		Verify:    *verify,
+		OrphanAge: *orphanAge,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+		return 2
+	}
+
+	for _, p := range report.Problems {
+		action := p.Action
+		if action == fsck.ActionNone {
+			action = "-"
+		} else if *dryRun {
+			action = "would be " + action
+		}
+		fmt.Printf("%s\t%s/%s\t%s\t%s\n", p.Kind, p.AccountID, p.ImageID, action, p.Detail)
+	}
+	cleared := "cleared"
+	if *dryRun {
+		cleared = "to clear"
+	}
+	fmt.Printf("checked %d images and %d blobs: %d problems, %d broken marks %s\n",
+		report.Images, report.Blobs, len(report.Problems), report.Cleared, cleared)
+	if !report.Clean() || (*dryRun && len(report.Problems) > 0) {
+		return 1
+	}
+	return 0
+}
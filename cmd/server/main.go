@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/leca/dt-cloudflare-images/internal/config"
 	"github.com/leca/dt-cloudflare-images/internal/database"
@@ -17,20 +21,80 @@ func main() {
 
 	cfg := config.Load()
 
-	db, err := database.NewSQLiteDB(cfg.DBPath)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(runFsck(cfg, os.Args[2:]))
+		case "migrate-layout":
+			os.Exit(runMigrateLayout(cfg, os.Args[2:]))
+		}
+	}
+
+	os.Exit(serve(cfg))
+}
+
+// shutdownTimeout bounds how long requests in progress may take to finish
+// once the server is asked to stop.
+const shutdownTimeout = 30 * time.Second
+
+// serve runs the server until it fails or receives SIGINT or SIGTERM, then
+// stops accepting requests, lets those in progress finish, and stops the
+// background jobs. It returns the exit status.
+func serve(cfg *config.Config) int {
+	db, err := database.Open(cfg.DBPath)
 	if err != nil {
 		slog.Error("failed to open database", "error", err)
-		os.Exit(1)
+		return 1
 	}
 	defer db.Close()
 
-	store := storage.NewFileSystem(cfg.StoragePath)
+	store, err := openStorage(cfg)
+	if err != nil {
+		slog.Error("failed to open storage", "error", err)
+		return 1
+	}
 
 	srv := router.New(db, store, cfg)
+	defer srv.Close()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	httpSrv := &http.Server{Addr: cfg.ListenAddr, Handler: srv.Router}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- httpSrv.ListenAndServe()
+	}()
 	slog.Info("starting server", "addr", cfg.ListenAddr)
-	if err := http.ListenAndServe(cfg.ListenAddr, srv.Router); err != nil {
+
+	select {
+	case err := <-errc:
 		slog.Error("server failed", "error", err)
-		os.Exit(1)
+		return 1
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpSrv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutdown failed", "error", err)
+		return 1
 	}
+	return 0
+}
+
+// openStorage opens the storage configured by cfg.
+func openStorage(cfg *config.Config) (storage.Storage, error) {
+	return storage.Open(cfg.StoragePath, storage.Options{
+		S3: storage.S3Config{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.S3Bucket,
+			PathStyle:       cfg.S3PathStyle,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+		},
+		ContentAddressed: cfg.StorageDedup,
+	})
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/leca/dt-cloudflare-images/internal/config"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+)
+
+// runMigrateLayout implements the migrate-layout subcommand: it moves the
+// image directories of a FileSystem store written before fan-out to their
+// fanned-out locations, and returns the exit status: 0 on success, 2 if
+// the migration failed or the storage is not a FileSystem.
+func runMigrateLayout(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("migrate-layout", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	store, err := openStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate-layout: opening storage: %v\n", err)
+		return 2
+	}
+	fs, ok := store.(*storage.FileSystem)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "migrate-layout: storage %q is not a directory\n", cfg.StoragePath)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	moved, skipped, err := fs.MigrateLayout(ctx)
+	fmt.Printf("moved %d images, left %d legacy directories shadowed by the new layout\n", moved, skipped)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate-layout: %v\n", err)
+		return 2
+	}
+	return 0
+}
@@ -30,13 +30,13 @@ func TestSuccessResponseNilResult(t *testing.T) {
 }
 
 func TestErrorResponse(t *testing.T) {
-	resp := ErrorResponse(9400, "bad request")
+	resp := ErrorResponse(5400, "Bad request")
 
 	assert.False(t, resp.Success)
 	assert.Nil(t, resp.Result)
 	assert.Len(t, resp.Errors, 1)
-	assert.Equal(t, 9400, resp.Errors[0].Code)
-	assert.Equal(t, "bad request", resp.Errors[0].Message)
+	assert.Equal(t, 5400, resp.Errors[0].Code)
+	assert.Equal(t, "Bad request", resp.Errors[0].Message)
 	assert.Empty(t, resp.Messages)
 }
 
@@ -79,7 +79,7 @@ func TestWriteJSON(t *testing.T) {
 
 func TestWriteJSONCustomStatus(t *testing.T) {
 	w := httptest.NewRecorder()
-	body := ErrorResponse(9404, "not found")
+	body := ErrorResponse(5404, "Image not found")
 
 	WriteJSON(w, http.StatusNotFound, body)
 
@@ -94,12 +94,12 @@ func TestWriteJSONCustomStatus(t *testing.T) {
 	require.NoError(t, err)
 	assert.False(t, decoded.Success)
 	assert.Len(t, decoded.Errors, 1)
-	assert.Equal(t, "not found", decoded.Errors[0].Message)
+	assert.Equal(t, "Image not found", decoded.Errors[0].Message)
 }
 
 func TestErrorResponseJSONStructure(t *testing.T) {
 	// Verify the JSON output matches the Cloudflare API shape exactly.
-	resp := ErrorResponse(9401, "Authentication required")
+	resp := ErrorResponse(10000, "Authentication error")
 	w := httptest.NewRecorder()
 	WriteJSON(w, http.StatusUnauthorized, resp)
 
@@ -116,6 +116,6 @@ func TestErrorResponseJSONStructure(t *testing.T) {
 
 	errObj, ok := errors[0].(map[string]interface{})
 	require.True(t, ok)
-	assert.Equal(t, float64(9401), errObj["code"])
-	assert.Equal(t, "Authentication required", errObj["message"])
+	assert.Equal(t, float64(10000), errObj["code"])
+	assert.Equal(t, "Authentication error", errObj["message"])
 }
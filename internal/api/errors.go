@@ -1,33 +1,176 @@
 package api
 
-import "net/http"
+import (
+	"errors"
+	"log"
+	"net/http"
 
-// BadRequest writes a 400 error response.
-func BadRequest(w http.ResponseWriter, msg string) {
-	WriteJSON(w, http.StatusBadRequest, ErrorResponse(9400, msg))
+	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+)
+
+// Error is an entry in the catalog of errors returned by the Cloudflare
+// Images API: the HTTP status, error code and message for one failure mode
+// and, for failures caused by a request field, a JSON pointer to it.
+type Error struct {
+	Status int
+	// Code is the code the real API reports for the failure.
+	Code    int
+	Message string
+	Pointer string
+
+	// causes are the sentinel errors that WriteError reports as this entry
+	// when it is passed as a known error.
+	causes []error
 }
 
-// Unauthorized writes a 401 error response.
-func Unauthorized(w http.ResponseWriter) {
-	WriteJSON(w, http.StatusUnauthorized, ErrorResponse(9401, "Authentication required"))
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.Message
 }
 
-// NotFound writes a 404 error response.
-func NotFound(w http.ResponseWriter, msg string) {
-	WriteJSON(w, http.StatusNotFound, ErrorResponse(9404, msg))
+// WithDetail returns a copy of e whose message is followed by detail.
+func (e *Error) WithDetail(detail string) *Error {
+	c := *e
+	c.Message = e.Message + ": " + detail
+	return &c
 }
 
-// Conflict writes a 409 error response.
-func Conflict(w http.ResponseWriter, msg string) {
-	WriteJSON(w, http.StatusConflict, ErrorResponse(9409, msg))
+// WithPointer returns a copy of e that points at the request field pointer.
+func (e *Error) WithPointer(pointer string) *Error {
+	c := *e
+	c.Pointer = pointer
+	return &c
 }
 
-// UnprocessableEntity writes a 422 error response.
-func UnprocessableEntity(w http.ResponseWriter, msg string) {
-	WriteJSON(w, http.StatusUnprocessableEntity, ErrorResponse(9422, msg))
+// Response builds the error envelope for e.
+func (e *Error) Response() Response {
+	resp := ErrorResponse(e.Code, e.Message)
+	if e.Pointer != "" {
+		resp.Errors[0].Source = &APIErrorSource{Pointer: e.Pointer}
+	}
+	return resp
+}
+
+// matches reports whether err is one of the causes of e.
+func (e *Error) matches(err error) bool {
+	for _, cause := range e.causes {
+		if errors.Is(err, cause) {
+			return true
+		}
+	}
+	return false
+}
+
+// badRequest builds a 5400 catalog entry for a malformed request.
+func badRequest(detail, pointer string) *Error {
+	return &Error{
+		Status:  http.StatusBadRequest,
+		Code:    5400,
+		Message: "Bad request: " + detail,
+		Pointer: pointer,
+	}
+}
+
+// General errors.
+var (
+	// ErrAuthentication is Cloudflare's account-wide authentication error.
+	ErrAuthentication = &Error{Status: http.StatusUnauthorized, Code: 10000, Message: "Authentication error"}
+
+	// ErrBadRequest is the generic 5400; use WithDetail to say what was wrong.
+	ErrBadRequest = &Error{Status: http.StatusBadRequest, Code: 5400, Message: "Bad request"}
+
+	ErrInvalidJSON = badRequest("invalid JSON body", "")
+	ErrNotFound    = &Error{Status: http.StatusNotFound, Code: 5404, Message: "Resource not found", causes: []error{database.ErrNotFound, storage.ErrNotFound}}
+	// ErrInternal answers every failure that is not the client's.
+	ErrInternal = &Error{Status: http.StatusInternalServerError, Code: 5500, Message: "Internal error"}
+)
+
+// Image errors.
+var (
+	ErrImageNotFound   = &Error{Status: http.StatusNotFound, Code: 5404, Message: "Image not found", causes: []error{database.ErrNotFound, storage.ErrNotFound}}
+	ErrImageBroken     = &Error{Status: http.StatusNotFound, Code: 5404, Message: "Image original is unavailable"}
+	ErrImageExists     = &Error{Status: http.StatusConflict, Code: 5409, Message: "Image already exists", causes: []error{database.ErrConflict}}
+	ErrImageRequired   = &Error{Status: http.StatusBadRequest, Code: 5415, Message: "Images must be uploaded as a file or url", Pointer: "/file"}
+	ErrFileRequired    = &Error{Status: http.StatusBadRequest, Code: 5415, Message: "Images must be uploaded as a file", Pointer: "/file"}
+	ErrImageTooLarge   = &Error{Status: http.StatusRequestEntityTooLarge, Code: 5413, Message: "Image exceeds the maximum size", Pointer: "/url"}
+	ErrStorageFull     = &Error{Status: http.StatusBadRequest, Code: 5400, Message: "Bad request: storage limit exceeded", causes: []error{storage.ErrLimitExceeded}}
+	ErrInvalidUpload   = badRequest("invalid multipart form", "")
+	ErrFieldTooLarge   = badRequest("form field is too large", "")
+	ErrInvalidMetadata = badRequest("metadata must be a JSON object", "/metadata")
+	ErrInvalidCreator  = badRequest("creator must be at most 1024 characters", "/creator")
+	ErrFetchFailed     = badRequest("failed to fetch url", "/url")
+	ErrInvalidImage    = badRequest("uploaded file is not a supported image", "/file")
+)
+
+// Listing errors.
+var (
+	ErrInvalidContinuationToken = badRequest("invalid continuation_token", "")
+	ErrTooManyMetadataFilters   = badRequest("too many metadata filters (max 5)", "")
+)
+
+// Variant errors.
+var (
+	ErrVariantNotFound   = &Error{Status: http.StatusNotFound, Code: 5404, Message: "Variant not found", causes: []error{database.ErrNotFound}}
+	ErrVariantExists     = &Error{Status: http.StatusConflict, Code: 5409, Message: "Variant already exists", Pointer: "/id", causes: []error{database.ErrConflict}}
+	ErrVariantIDRequired = badRequest("variant id is required", "/id")
+	ErrInvalidFit        = badRequest("invalid fit mode: must be one of scale-down, contain, cover, crop, pad", "/options/fit")
+	ErrTooManyVariants   = &Error{Status: http.StatusBadRequest, Code: 5400, Message: "Bad request: maximum number of variants reached", causes: []error{database.ErrLimitExceeded}}
+)
+
+// Signing key errors.
+var (
+	ErrSigningKeyNotFound     = &Error{Status: http.StatusNotFound, Code: 5404, Message: "Signing key not found", causes: []error{database.ErrNotFound}}
+	ErrSigningKeyNameRequired = badRequest("signing key name is required", "")
+)
+
+// Direct upload errors.
+var (
+	ErrUploadNotFound  = &Error{Status: http.StatusNotFound, Code: 5404, Message: "Upload not found", causes: []error{database.ErrNotFound}}
+	ErrUploadExpired   = badRequest("upload URL has expired", "")
+	ErrUploadCompleted = &Error{Status: http.StatusConflict, Code: 5409, Message: "Upload already completed"}
+	ErrInvalidExpiry   = badRequest("expiry must be an RFC3339 timestamp", "/expiry")
+)
+
+// Cache purge errors. Purging is a zone API, with codes of its own.
+var (
+	ErrPurgeInvalidJSON = &Error{Status: http.StatusBadRequest, Code: 6007, Message: "Malformed JSON in request body"}
+	ErrPurgeTarget      = &Error{Status: http.StatusBadRequest, Code: 1012, Message: `Request must contain one of "purge_everything", "files", "tags", "hosts" or "prefixes"`}
+	ErrTooManyPurges    = &Error{Status: http.StatusBadRequest, Code: 1012, Message: "Too many items to purge (max 30)"}
+	ErrInvalidPurgeURL  = &Error{Status: http.StatusBadRequest, Code: 1012, Message: "Files entries must be a URL or an object with a url", Pointer: "/files"}
+	ErrEmptyPrefix      = &Error{Status: http.StatusBadRequest, Code: 1012, Message: "Prefixes must not be empty", Pointer: "/prefixes"}
+)
+
+// fallbacks are the entries Classify tries after the known errors.
+var fallbacks = []*Error{ErrNotFound, ErrStorageFull}
+
+// Classify returns the catalog entry for err: the *Error it wraps, if any,
+// else the first of known, then of the generic entries, whose causes it
+// wraps. Anything else is ErrInternal.
+func Classify(err error, known ...*Error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	for _, e := range known {
+		if e.matches(err) {
+			return e
+		}
+	}
+	for _, e := range fallbacks {
+		if e.matches(err) {
+			return e
+		}
+	}
+	return ErrInternal
 }
 
-// TooLarge writes a 413 error response.
-func TooLarge(w http.ResponseWriter, msg string) {
-	WriteJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse(9413, msg))
+// WriteError writes the error response chosen by Classify. Internal errors
+// are logged rather than described to the client.
+func WriteError(w http.ResponseWriter, err error, known ...*Error) {
+	e := Classify(err, known...)
+	if e == ErrInternal {
+		log.Printf("WriteError: %v", err)
+	}
+	WriteJSON(w, e.Status, e.Response())
 }
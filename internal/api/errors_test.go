@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		known []*Error
+		want  *Error
+	}{
+		{"catalog entry", ErrInvalidFit, nil, ErrInvalidFit},
+		{"wrapped catalog entry", fmt.Errorf("%w: bad json", ErrInvalidMetadata), nil, ErrInvalidMetadata},
+		{"known not found", fmt.Errorf("image %w", database.ErrNotFound), []*Error{ErrImageNotFound}, ErrImageNotFound},
+		{"known blob not found", fmt.Errorf("blob %w", storage.ErrNotFound), []*Error{ErrImageNotFound}, ErrImageNotFound},
+		{"known conflict", fmt.Errorf("variant %w", database.ErrConflict), []*Error{ErrVariantNotFound, ErrVariantExists}, ErrVariantExists},
+		{"generic not found", fmt.Errorf("image %w", database.ErrNotFound), nil, ErrNotFound},
+		{"unexpected conflict", fmt.Errorf("image %w", database.ErrConflict), []*Error{ErrImageNotFound}, ErrInternal},
+		{"variant limit", fmt.Errorf("variants %w", database.ErrLimitExceeded), []*Error{ErrTooManyVariants}, ErrTooManyVariants},
+		{"storage full", fmt.Errorf("store: %w", storage.ErrLimitExceeded), nil, ErrStorageFull},
+		{"deadline", context.DeadlineExceeded, nil, ErrInternal},
+		{"anything else", errors.New("disk I/O error"), []*Error{ErrImageNotFound}, ErrInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Same(t, tt.want, Classify(tt.err, tt.known...))
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, fmt.Errorf("variant %w", database.ErrConflict), ErrVariantExists)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	var resp Response
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.Success)
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, 5409, resp.Errors[0].Code)
+	assert.Equal(t, "Variant already exists", resp.Errors[0].Message)
+	require.NotNil(t, resp.Errors[0].Source)
+	assert.Equal(t, "/id", resp.Errors[0].Source.Pointer)
+}
+
+func TestWriteError_HidesInternalErrors(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, errors.New("open /data/db/images.db: permission denied"))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var raw map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+	errs, ok := raw["errors"].([]interface{})
+	require.True(t, ok)
+	require.Len(t, errs, 1)
+	errObj, ok := errs[0].(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, float64(5500), errObj["code"])
+	assert.Equal(t, "Internal error", errObj["message"])
+	assert.NotContains(t, errObj, "source")
+}
+
+func TestErrorWithDetailAndPointer(t *testing.T) {
+	e := ErrBadRequest.WithDetail("upload_id is required").WithPointer("/upload_id")
+
+	assert.Equal(t, "Bad request: upload_id is required", e.Message)
+	assert.Equal(t, "/upload_id", e.Pointer)
+	assert.Equal(t, "Bad request", ErrBadRequest.Message, "catalog entries are not modified")
+	assert.Empty(t, ErrBadRequest.Pointer)
+}
@@ -28,7 +28,7 @@ func AuthMiddleware(token string) func(http.Handler) http.Handler {
 						return
 					}
 					// Token provided but doesn't match.
-					Unauthorized(w)
+					WriteError(w, ErrAuthentication)
 					return
 				}
 			}
@@ -42,12 +42,12 @@ func AuthMiddleware(token string) func(http.Handler) http.Handler {
 					return
 				}
 				// Token provided but doesn't match.
-				Unauthorized(w)
+				WriteError(w, ErrAuthentication)
 				return
 			}
 
 			// No valid auth headers found.
-			Unauthorized(w)
+			WriteError(w, ErrAuthentication)
 		})
 	}
 }
@@ -58,7 +58,7 @@ func AccountIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		accountID := chi.URLParam(r, "account_id")
 		if accountID == "" {
-			BadRequest(w, "account_id is required")
+			WriteError(w, ErrBadRequest.WithDetail("account_id is required"))
 			return
 		}
 		ctx := context.WithValue(r.Context(), accountIDKey, accountID)
@@ -38,7 +38,7 @@ func TestAuthMiddleware_RejectsMissingAuth(t *testing.T) {
 	require.NoError(t, err)
 	assert.False(t, resp.Success)
 	assert.Len(t, resp.Errors, 1)
-	assert.Equal(t, 9401, resp.Errors[0].Code)
+	assert.Equal(t, 10000, resp.Errors[0].Code)
 }
 
 func TestAuthMiddleware_AcceptsBearerToken(t *testing.T) {
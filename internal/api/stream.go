@@ -0,0 +1,86 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// ListWriter streams a successful list response, encoding one item at a time
+// instead of marshalling the whole envelope up front. The result is an object
+// holding the items under a single key, plus any fields passed to Close:
+//
+//	{"result":{"<key>":[...],...},"success":true,"errors":[],"messages":[],"result_info":{...}}
+//
+// The status line is sent by NewListWriter, so encoding errors can no longer be
+// reported to the client; they are returned by Close for logging.
+type ListWriter struct {
+	bw    *bufio.Writer
+	enc   *json.Encoder
+	count int
+	err   error
+}
+
+// NewListWriter writes the response headers and opens a list under key.
+func NewListWriter(w http.ResponseWriter, status int, key string) *ListWriter {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	bw := bufio.NewWriterSize(w, 32<<10)
+	lw := &ListWriter{bw: bw, enc: json.NewEncoder(bw)}
+	lw.writeString(`{"result":{`)
+	lw.writeValue(key)
+	lw.writeString(`:[`)
+	return lw
+}
+
+// Add appends an item to the list.
+func (lw *ListWriter) Add(item interface{}) {
+	if lw.count > 0 {
+		lw.writeString(",")
+	}
+	lw.count++
+	lw.writeValue(item)
+}
+
+// Close ends the list, adds the fields of extra to the result object and
+// completes the envelope. A nil info omits result_info.
+func (lw *ListWriter) Close(extra map[string]interface{}, info *ResultInfo) error {
+	lw.writeString("]")
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lw.writeString(",")
+		lw.writeValue(k)
+		lw.writeString(":")
+		lw.writeValue(extra[k])
+	}
+	lw.writeString(`},"success":true,"errors":[],"messages":[]`)
+	if info != nil {
+		lw.writeString(`,"result_info":`)
+		lw.writeValue(info)
+	}
+	lw.writeString("}\n")
+	if lw.err == nil {
+		lw.err = lw.bw.Flush()
+	}
+	return lw.err
+}
+
+func (lw *ListWriter) writeString(s string) {
+	if lw.err == nil {
+		_, lw.err = lw.bw.WriteString(s)
+	}
+}
+
+// writeValue encodes v. Encoder.Encode terminates each value with a newline,
+// which is valid whitespace between JSON tokens.
+func (lw *ListWriter) writeValue(v interface{}) {
+	if lw.err == nil {
+		lw.err = lw.enc.Encode(v)
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListWriter(t *testing.T) {
+	w := httptest.NewRecorder()
+	lw := NewListWriter(w, http.StatusOK, "items")
+	lw.Add(map[string]string{"id": "a"})
+	lw.Add(map[string]string{"id": "<b>"})
+	info := ResultInfo{Page: 1, PerPage: 2, Count: 2, TotalCount: 2, TotalPages: 1}
+	require.NoError(t, lw.Close(map[string]interface{}{"token": "t", "more": false}, &info))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var decoded struct {
+		Result struct {
+			Items []map[string]string `json:"items"`
+			Token string              `json:"token"`
+			More  *bool               `json:"more"`
+		} `json:"result"`
+		Success    bool         `json:"success"`
+		Errors     []APIError   `json:"errors"`
+		Messages   []APIMessage `json:"messages"`
+		ResultInfo *ResultInfo  `json:"result_info"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decoded))
+	assert.True(t, decoded.Success)
+	assert.NotNil(t, decoded.Errors)
+	assert.NotNil(t, decoded.Messages)
+	assert.Equal(t, []map[string]string{{"id": "a"}, {"id": "<b>"}}, decoded.Result.Items)
+	assert.Equal(t, "t", decoded.Result.Token)
+	require.NotNil(t, decoded.Result.More)
+	assert.False(t, *decoded.Result.More)
+	assert.Equal(t, &info, decoded.ResultInfo)
+}
+
+func TestListWriterEmpty(t *testing.T) {
+	w := httptest.NewRecorder()
+	require.NoError(t, NewListWriter(w, http.StatusOK, "items").Close(nil, nil))
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decoded))
+	assert.Equal(t, map[string]interface{}{"items": []interface{}{}}, decoded["result"])
+	assert.NotContains(t, decoded, "result_info")
+}
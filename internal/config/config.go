@@ -2,27 +2,86 @@ package config
 
 import (
 	"os"
+	"runtime"
 )
 
 type Config struct {
-	ListenAddr        string
-	DBPath            string
-	StoragePath       string
-	ImageAllowance    int
-	AuthToken         string
-	BaseURL           string
-	EnforceSignedURLs bool
+	ListenAddr         string
+	DBPath             string
+	StoragePath        string
+	StorageDedup       bool
+	ImageAllowance     int
+	AuthToken          string
+	BaseURL            string
+	EnforceSignedURLs  bool
+	BrowserTTL         int
+	CacheMaxBytes      int
+	WarmVariants       bool
+	WarmWorkers        int
+	WarmQueueSize      int
+	TransformWorkers   int
+	TransformQueue     int
+	TransformTimeout   int
+	MaxImageBytes      int
+	MaxImagePixels     int
+	MaxImageDimension  int
+	MaxOutputDimension int
+	FetchTimeout       int
+	FetchMaxBytes      int
+	FetchMaxRedirects  int
+	FetchAllowPrivate  bool
+	FetchFixtureDir    string
+	CursorSecret       string
+	S3Endpoint         string
+	S3Region           string
+	S3Bucket           string
+	S3PathStyle        bool
+	S3AccessKeyID      string
+	S3SecretAccessKey  string
+	FsckInterval       int
+	FsckRepair         bool
+	FsckVerify         bool
+	FsckOrphanAge      int
 }
 
 func Load() *Config {
 	return &Config{
-		ListenAddr:     getEnv("DT_LISTEN_ADDR", ":8080"),
-		DBPath:         getEnv("DT_DB_PATH", "/data/db/images.db"),
-		StoragePath:    getEnv("DT_STORAGE_PATH", "/data/images"),
-		ImageAllowance: getEnvInt("DT_IMAGE_ALLOWANCE", 100000),
-		AuthToken:      getEnv("DT_AUTH_TOKEN", ""),
-		BaseURL:           getEnv("DT_BASE_URL", "http://localhost:8080"),
-		EnforceSignedURLs: getEnv("DT_ENFORCE_SIGNED_URLS", "") == "true",
+		ListenAddr:         getEnv("DT_LISTEN_ADDR", ":8080"),
+		DBPath:             getEnv("DT_DB_PATH", "/data/db/images.db"),
+		StoragePath:        getEnv("DT_STORAGE_PATH", "/data/images"),
+		StorageDedup:       getEnv("DT_STORAGE_DEDUP", "") == "true",
+		ImageAllowance:     getEnvInt("DT_IMAGE_ALLOWANCE", 100000),
+		AuthToken:          getEnv("DT_AUTH_TOKEN", ""),
+		BaseURL:            getEnv("DT_BASE_URL", "http://localhost:8080"),
+		EnforceSignedURLs:  getEnv("DT_ENFORCE_SIGNED_URLS", "") == "true",
+		BrowserTTL:         getEnvInt("DT_BROWSER_TTL", 172800),
+		CacheMaxBytes:      getEnvInt("DT_CACHE_MAX_BYTES", 1<<30),
+		WarmVariants:       getEnv("DT_WARM_VARIANTS", "") == "true",
+		WarmWorkers:        getEnvInt("DT_WARM_WORKERS", 2),
+		WarmQueueSize:      getEnvInt("DT_WARM_QUEUE_SIZE", 1000),
+		TransformWorkers:   getEnvInt("DT_TRANSFORM_WORKERS", runtime.NumCPU()),
+		TransformQueue:     getEnvInt("DT_TRANSFORM_QUEUE_SIZE", 64),
+		TransformTimeout:   getEnvInt("DT_TRANSFORM_TIMEOUT", 30),
+		MaxImageBytes:      getEnvInt("DT_MAX_IMAGE_BYTES", 70<<20),
+		MaxImagePixels:     getEnvInt("DT_MAX_IMAGE_PIXELS", 100_000_000),
+		MaxImageDimension:  getEnvInt("DT_MAX_IMAGE_DIMENSION", 12000),
+		MaxOutputDimension: getEnvInt("DT_MAX_OUTPUT_DIMENSION", 12000),
+		FetchTimeout:       getEnvInt("DT_FETCH_TIMEOUT", 30),
+		FetchMaxBytes:      getEnvInt("DT_FETCH_MAX_BYTES", 10<<20),
+		FetchMaxRedirects:  getEnvInt("DT_FETCH_MAX_REDIRECTS", 5),
+		FetchAllowPrivate:  getEnv("DT_FETCH_ALLOW_PRIVATE", "") == "true",
+		FetchFixtureDir:    getEnv("DT_FETCH_FIXTURE_DIR", ""),
+		CursorSecret:       getEnv("DT_CURSOR_SECRET", ""),
+		S3Endpoint:         getEnv("DT_S3_ENDPOINT", ""),
+		S3Region:           getEnv("DT_S3_REGION", "us-east-1"),
+		S3Bucket:           getEnv("DT_S3_BUCKET", ""),
+		S3PathStyle:        getEnv("DT_S3_PATH_STYLE", "") == "true",
+		S3AccessKeyID:      getEnv("DT_S3_ACCESS_KEY_ID", ""),
+		S3SecretAccessKey:  getEnv("DT_S3_SECRET_ACCESS_KEY", ""),
+		FsckInterval:       getEnvInt("DT_FSCK_INTERVAL", 0),
+		FsckRepair:         getEnv("DT_FSCK_REPAIR", "") == "true",
+		FsckVerify:         getEnv("DT_FSCK_VERIFY", "") == "true",
+		FsckOrphanAge:      getEnvInt("DT_FSCK_ORPHAN_AGE", 3600),
 	}
 }
 
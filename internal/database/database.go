@@ -1,41 +1,71 @@
 package database
 
-import "github.com/leca/dt-cloudflare-images/internal/model"
+import (
+	"context"
 
-// Database defines the persistence interface for all domain objects.
+	"github.com/leca/dt-cloudflare-images/internal/model"
+)
+
+// MaxVariantsPerAccount is the Cloudflare Images limit on variants.
+const MaxVariantsPerAccount = 100
+
+// Database defines the persistence interface for all domain objects. Every
+// method but Close takes the context of the request it serves, whose
+// cancellation or deadline aborts the query.
 type Database interface {
 	// Images
-	CreateImage(img *model.Image) error
-	GetImage(accountID, imageID string) (*model.Image, error)
-	ListImages(accountID string, page, perPage int) ([]*model.Image, int, error)
-	UpdateImage(img *model.Image) error
-	DeleteImage(accountID, imageID string) error
-	CountImages(accountID string) (int, error)
-
-	// Variants
-	CreateVariant(v *model.Variant) error
-	GetVariant(accountID, variantID string) (*model.Variant, error)
-	ListVariants(accountID string) ([]*model.Variant, error)
-	UpdateVariant(v *model.Variant) error
-	DeleteVariant(accountID, variantID string) error
-	CountVariants(accountID string) (int, error)
+	CreateImage(ctx context.Context, img *model.Image) error
+	GetImage(ctx context.Context, accountID, imageID string) (*model.Image, error)
+	ListImages(ctx context.Context, accountID string, page, perPage int) ([]*model.Image, int, error)
+	UpdateImage(ctx context.Context, img *model.Image) error
+	DeleteImage(ctx context.Context, accountID, imageID string) error
+	CountImages(ctx context.Context, accountID string) (int, error)
+	// SetImageBroken records why the image's stored original is unusable;
+	// an empty reason clears the mark.
+	SetImageBroken(ctx context.Context, accountID, imageID, reason string) error
+	// ListAccounts returns the IDs of the accounts that have images, sorted.
+	ListAccounts(ctx context.Context) ([]string, error)
+
+	// Variants. CreateVariant fails with ErrLimitExceeded once the account
+	// has MaxVariantsPerAccount variants.
+	CreateVariant(ctx context.Context, v *model.Variant) error
+	GetVariant(ctx context.Context, accountID, variantID string) (*model.Variant, error)
+	ListVariants(ctx context.Context, accountID string) ([]*model.Variant, error)
+	UpdateVariant(ctx context.Context, v *model.Variant) error
+	DeleteVariant(ctx context.Context, accountID, variantID string) error
+	CountVariants(ctx context.Context, accountID string) (int, error)
 
 	// Signing Keys
-	CreateSigningKey(key *model.SigningKey) error
-	ListSigningKeys(accountID string) ([]*model.SigningKey, error)
-	DeleteSigningKey(accountID, name string) error
+	CreateSigningKey(ctx context.Context, key *model.SigningKey) error
+	ListSigningKeys(ctx context.Context, accountID string) ([]*model.SigningKey, error)
+	DeleteSigningKey(ctx context.Context, accountID, name string) error
 
 	// Direct Uploads
-	CreateDirectUpload(du *model.DirectUpload) error
-	GetDirectUpload(uploadID string) (*model.DirectUpload, error)
-	CompleteDirectUpload(uploadID string) error
+	CreateDirectUpload(ctx context.Context, du *model.DirectUpload) error
+	GetDirectUpload(ctx context.Context, uploadID string) (*model.DirectUpload, error)
+	CompleteDirectUpload(ctx context.Context, uploadID string) error
 
 	// V2 List
-	ListImagesV2(accountID string, cursor string, perPage int, sortOrder string) ([]*model.Image, string, error)
+	ListImagesV2(ctx context.Context, accountID string, q ListV2Query) ([]*model.Image, string, error)
 
-	// Image Metadata (for V2 filtering)
-	SetImageMetadata(accountID, imageID string, meta map[string]interface{}) error
-	ListImagesWithFilter(accountID string, cursor string, perPage int, sortOrder string, key, op string, value interface{}) ([]*model.Image, string, error)
+	// Image Metadata. The metadata filter index is maintained by every
+	// write of an image's metadata.
+	SetImageMetadata(ctx context.Context, accountID, imageID string, meta map[string]interface{}) error
 
 	Close() error
 }
+
+// ListV2Query selects a page of images for the V2 listing.
+type ListV2Query struct {
+	// Cursor is the continuation cursor returned with the previous page; ""
+	// starts from the beginning.
+	Cursor    string
+	PerPage   int
+	SortOrder string // "asc" or "desc"
+
+	// Creator, if non-empty, restricts results to that creator.
+	Creator string
+
+	// Filters must all match (AND).
+	Filters []MetadataFilter
+}
@@ -0,0 +1,768 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAccount = "test-account-001"
+
+// contract lists the tests every Database implementation must pass. Each
+// runs against a fresh, empty database.
+var contract = []struct {
+	name string
+	test func(t *testing.T, db Database)
+}{
+	{"CreateAndGetImage", testCreateAndGetImage},
+	{"ListImagesWithPagination", testListImagesWithPagination},
+	{"UpdateImage", testUpdateImage},
+	{"DeleteImage", testDeleteImage},
+	{"CountImages", testCountImages},
+	{"SetImageBroken", testSetImageBroken},
+	{"ListAccounts", testListAccounts},
+	{"ReturnsCopies", testReturnsCopies},
+	{"CreateAndGetVariant", testCreateAndGetVariant},
+	{"ListVariants", testListVariants},
+	{"DeleteVariant", testDeleteVariant},
+	{"CountVariants", testCountVariants},
+	{"VariantLimit", testVariantLimit},
+	{"CreateAndListSigningKeys", testCreateAndListSigningKeys},
+	{"DeleteSigningKey", testDeleteSigningKey},
+	{"CreateAndGetDirectUpload", testCreateAndGetDirectUpload},
+	{"CompleteDirectUpload", testCompleteDirectUpload},
+	{"ListImagesV2", testListImagesV2},
+	{"ListImagesV2_CreatorFilter", testListImagesV2_CreatorFilter},
+	{"UpdateImage_Creator", testUpdateImage_Creator},
+	{"DirectUpload_Creator", testDirectUpload_Creator},
+	{"ListImagesV2_MetadataFilters", testListImagesV2_MetadataFilters},
+	{"MetadataIndex_FollowsWrites", testMetadataIndex_FollowsWrites},
+	{"HonoursContext", testHonoursContext},
+	{"TypedErrors", testTypedErrors},
+}
+
+// runContract runs the contract tests against databases from open.
+func runContract(t *testing.T, open func(t *testing.T) Database) {
+	for _, c := range contract {
+		t.Run(c.name, func(t *testing.T) {
+			db := open(t)
+			t.Cleanup(func() { db.Close() })
+			c.test(t, db)
+		})
+	}
+}
+
+func TestSQLiteDB_Contract(t *testing.T) {
+	runContract(t, func(t *testing.T) Database { return newTestDB(t) })
+}
+
+func TestMemoryDB_Contract(t *testing.T) {
+	runContract(t, func(t *testing.T) Database { return NewMemoryDB() })
+}
+
+func TestOpen(t *testing.T) {
+	db, err := Open(MemoryDSN)
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryDB{}, db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(filepath.Join(t.TempDir(), "open.db"))
+	require.NoError(t, err)
+	assert.IsType(t, &SQLiteDB{}, db)
+	require.NoError(t, db.Close())
+}
+
+// metadataIDs lists the IDs of the images matching filters.
+func metadataIDs(t *testing.T, db Database, filters ...MetadataFilter) []string {
+	t.Helper()
+	images, _, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{PerPage: 100, SortOrder: "asc", Filters: filters})
+	require.NoError(t, err)
+	ids := make([]string, len(images))
+	for i, img := range images {
+		ids[i] = img.ID
+	}
+	return ids
+}
+
+func filter(key, op string, values ...interface{}) MetadataFilter {
+	return MetadataFilter{Key: key, Op: op, Values: values}
+}
+
+func testCreateAndGetImage(t *testing.T, db Database) {
+
+	now := time.Now().UTC().Truncate(time.Second)
+	img := &model.Image{
+		ID:                "img-001",
+		AccountID:         testAccount,
+		Filename:          "photo.png",
+		Meta:              map[string]interface{}{"key": "value"},
+		RequireSignedURLs: true,
+		Uploaded:          now,
+	}
+
+	err := db.CreateImage(t.Context(), img)
+	require.NoError(t, err)
+
+	got, err := db.GetImage(t.Context(), testAccount, "img-001")
+	require.NoError(t, err)
+	assert.Equal(t, img.ID, got.ID)
+	assert.Equal(t, img.AccountID, got.AccountID)
+	assert.Equal(t, img.Filename, got.Filename)
+	assert.Equal(t, "value", got.Meta["key"])
+	assert.True(t, got.RequireSignedURLs)
+	assert.Equal(t, now, got.Uploaded.UTC().Truncate(time.Second))
+
+	// not found
+	_, err = db.GetImage(t.Context(), testAccount, "nonexistent")
+	assert.Error(t, err)
+
+	// wrong account
+	_, err = db.GetImage(t.Context(), "other-account", "img-001")
+	assert.Error(t, err)
+}
+
+func testListImagesWithPagination(t *testing.T, db Database) {
+
+	base := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < 25; i++ {
+		img := &model.Image{
+			ID:        fmt.Sprintf("img-%03d", i),
+			AccountID: testAccount,
+			Filename:  fmt.Sprintf("photo-%d.png", i),
+			Uploaded:  base.Add(time.Duration(i) * time.Second),
+		}
+		require.NoError(t, db.CreateImage(t.Context(), img))
+	}
+
+	// page 1
+	images, total, err := db.ListImages(t.Context(), testAccount, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 25, total)
+	assert.Len(t, images, 10)
+
+	// page 2
+	images, total, err = db.ListImages(t.Context(), testAccount, 2, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 25, total)
+	assert.Len(t, images, 10)
+
+	// page 3 (partial)
+	images, total, err = db.ListImages(t.Context(), testAccount, 3, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 25, total)
+	assert.Len(t, images, 5)
+
+	// page 4 (empty)
+	images, total, err = db.ListImages(t.Context(), testAccount, 4, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 25, total)
+	assert.Len(t, images, 0)
+
+	// different account sees nothing
+	images, total, err = db.ListImages(t.Context(), "other-account", 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, total)
+	assert.Len(t, images, 0)
+}
+
+func testUpdateImage(t *testing.T, db Database) {
+
+	now := time.Now().UTC().Truncate(time.Second)
+	img := &model.Image{
+		ID:                "img-upd",
+		AccountID:         testAccount,
+		Filename:          "old.png",
+		RequireSignedURLs: false,
+		Uploaded:          now,
+	}
+	require.NoError(t, db.CreateImage(t.Context(), img))
+
+	img.Filename = "new.png"
+	img.RequireSignedURLs = true
+	img.Meta = map[string]interface{}{"updated": true}
+	require.NoError(t, db.UpdateImage(t.Context(), img))
+
+	got, err := db.GetImage(t.Context(), testAccount, "img-upd")
+	require.NoError(t, err)
+	assert.Equal(t, "new.png", got.Filename)
+	assert.True(t, got.RequireSignedURLs)
+	assert.Equal(t, true, got.Meta["updated"])
+}
+
+func testDeleteImage(t *testing.T, db Database) {
+
+	img := &model.Image{
+		ID:        "img-del",
+		AccountID: testAccount,
+		Filename:  "delete-me.png",
+		Uploaded:  time.Now().UTC(),
+	}
+	require.NoError(t, db.CreateImage(t.Context(), img))
+
+	err := db.DeleteImage(t.Context(), testAccount, "img-del")
+	require.NoError(t, err)
+
+	_, err = db.GetImage(t.Context(), testAccount, "img-del")
+	assert.Error(t, err)
+
+	// deleting non-existent should return error
+	err = db.DeleteImage(t.Context(), testAccount, "img-del")
+	assert.Error(t, err)
+}
+
+func testCountImages(t *testing.T, db Database) {
+
+	count, err := db.CountImages(t.Context(), testAccount)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.CreateImage(t.Context(), &model.Image{
+			ID:        fmt.Sprintf("img-cnt-%d", i),
+			AccountID: testAccount,
+			Filename:  "f.png",
+			Uploaded:  time.Now().UTC(),
+		}))
+	}
+
+	count, err = db.CountImages(t.Context(), testAccount)
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	// other account
+	count, err = db.CountImages(t.Context(), "other-account")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func testSetImageBroken(t *testing.T, db Database) {
+	img := &model.Image{ID: "img-broken", AccountID: testAccount, Uploaded: time.Now().UTC()}
+	require.NoError(t, db.CreateImage(t.Context(), img))
+
+	require.NoError(t, db.SetImageBroken(t.Context(), testAccount, "img-broken", "missing"))
+	got, err := db.GetImage(t.Context(), testAccount, "img-broken")
+	require.NoError(t, err)
+	assert.Equal(t, "missing", got.Broken)
+
+	// Updates keep the mark, and listings carry it.
+	got.Filename = "renamed.png"
+	require.NoError(t, db.UpdateImage(t.Context(), got))
+	images, _, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{PerPage: 10})
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, "missing", images[0].Broken)
+
+	require.NoError(t, db.SetImageBroken(t.Context(), testAccount, "img-broken", ""))
+	got, err = db.GetImage(t.Context(), testAccount, "img-broken")
+	require.NoError(t, err)
+	assert.Equal(t, "", got.Broken)
+
+	err = db.SetImageBroken(t.Context(), testAccount, "no-image", "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testListAccounts(t *testing.T, db Database) {
+	accounts, err := db.ListAccounts(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, accounts)
+
+	for _, acct := range []string{"acct-b", "acct-a", "acct-b"} {
+		require.NoError(t, db.CreateImage(t.Context(), &model.Image{
+			ID:        fmt.Sprintf("img-%d", len(accounts)),
+			AccountID: acct,
+			Uploaded:  time.Now().UTC(),
+		}))
+		accounts = append(accounts, acct)
+	}
+
+	accounts, err = db.ListAccounts(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acct-a", "acct-b"}, accounts)
+}
+
+func testReturnsCopies(t *testing.T, db Database) {
+	img := &model.Image{
+		ID:        "img-copy",
+		AccountID: testAccount,
+		Meta:      map[string]interface{}{"key": "value"},
+		Uploaded:  time.Now().UTC(),
+	}
+	require.NoError(t, db.CreateImage(t.Context(), img))
+
+	// Neither the caller's image nor one read back aliases the stored one.
+	img.Filename = "changed.png"
+	img.Meta["key"] = "changed"
+	got, err := db.GetImage(t.Context(), testAccount, "img-copy")
+	require.NoError(t, err)
+	got.Meta["key"] = "changed"
+
+	got, err = db.GetImage(t.Context(), testAccount, "img-copy")
+	require.NoError(t, err)
+	assert.Equal(t, "", got.Filename)
+	assert.Equal(t, "value", got.Meta["key"])
+}
+
+func testCreateAndGetVariant(t *testing.T, db Database) {
+
+	v := &model.Variant{
+		ID:        "hero",
+		AccountID: testAccount,
+		Options: model.VariantOptions{
+			Fit:      "scale-down",
+			Width:    1920,
+			Height:   1080,
+			Metadata: "none",
+		},
+		NeverRequireSignedURLs: true,
+	}
+
+	err := db.CreateVariant(t.Context(), v)
+	require.NoError(t, err)
+
+	got, err := db.GetVariant(t.Context(), testAccount, "hero")
+	require.NoError(t, err)
+	assert.Equal(t, "hero", got.ID)
+	assert.Equal(t, testAccount, got.AccountID)
+	assert.Equal(t, "scale-down", got.Options.Fit)
+	assert.Equal(t, 1920, got.Options.Width)
+	assert.Equal(t, 1080, got.Options.Height)
+	assert.Equal(t, "none", got.Options.Metadata)
+	assert.True(t, got.NeverRequireSignedURLs)
+
+	// not found
+	_, err = db.GetVariant(t.Context(), testAccount, "nonexistent")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testListVariants(t *testing.T, db Database) {
+
+	for _, name := range []string{"thumb", "medium", "large"} {
+		require.NoError(t, db.CreateVariant(t.Context(), &model.Variant{
+			ID:        name,
+			AccountID: testAccount,
+			Options: model.VariantOptions{
+				Fit:      "scale-down",
+				Width:    100,
+				Height:   100,
+				Metadata: "none",
+			},
+		}))
+	}
+
+	variants, err := db.ListVariants(t.Context(), testAccount)
+	require.NoError(t, err)
+	assert.Len(t, variants, 3)
+
+	// other account
+	variants, err = db.ListVariants(t.Context(), "other-account")
+	require.NoError(t, err)
+	assert.Len(t, variants, 0)
+}
+
+func testDeleteVariant(t *testing.T, db Database) {
+
+	require.NoError(t, db.CreateVariant(t.Context(), &model.Variant{
+		ID:        "to-delete",
+		AccountID: testAccount,
+		Options: model.VariantOptions{
+			Fit:      "contain",
+			Width:    200,
+			Height:   200,
+			Metadata: "none",
+		},
+	}))
+
+	err := db.DeleteVariant(t.Context(), testAccount, "to-delete")
+	require.NoError(t, err)
+
+	_, err = db.GetVariant(t.Context(), testAccount, "to-delete")
+	assert.Error(t, err)
+
+	// deleting non-existent should return error
+	err = db.DeleteVariant(t.Context(), testAccount, "to-delete")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testCountVariants(t *testing.T, db Database) {
+
+	count, err := db.CountVariants(t.Context(), testAccount)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, db.CreateVariant(t.Context(), &model.Variant{
+			ID:        name,
+			AccountID: testAccount,
+			Options:   model.VariantOptions{Fit: "cover", Width: 50, Height: 50, Metadata: "none"},
+		}))
+	}
+
+	count, err = db.CountVariants(t.Context(), testAccount)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func testVariantLimit(t *testing.T, db Database) {
+
+	newVariant := func(accountID, id string) *model.Variant {
+		return &model.Variant{
+			ID:        id,
+			AccountID: accountID,
+			Options:   model.VariantOptions{Fit: "cover", Width: 50, Height: 50, Metadata: "none"},
+		}
+	}
+	for i := 0; i < MaxVariantsPerAccount; i++ {
+		require.NoError(t, db.CreateVariant(t.Context(), newVariant(testAccount, fmt.Sprintf("v-%03d", i))))
+	}
+
+	err := db.CreateVariant(t.Context(), newVariant(testAccount, "overflow"))
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	_, err = db.GetVariant(t.Context(), testAccount, "overflow")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// An existing ID is still a conflict, and other accounts are unaffected.
+	err = db.CreateVariant(t.Context(), newVariant(testAccount, "v-000"))
+	assert.ErrorIs(t, err, ErrConflict)
+	require.NoError(t, db.CreateVariant(t.Context(), newVariant("other-account", "overflow")))
+}
+
+func testCreateAndListSigningKeys(t *testing.T, db Database) {
+
+	key := &model.SigningKey{
+		Name:      "default",
+		Value:     "secret-key-value",
+		AccountID: testAccount,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	require.NoError(t, db.CreateSigningKey(t.Context(), key))
+
+	keys, err := db.ListSigningKeys(t.Context(), testAccount)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "default", keys[0].Name)
+	assert.Equal(t, "secret-key-value", keys[0].Value)
+
+	// other account
+	keys, err = db.ListSigningKeys(t.Context(), "other-account")
+	require.NoError(t, err)
+	assert.Len(t, keys, 0)
+}
+
+func testDeleteSigningKey(t *testing.T, db Database) {
+
+	require.NoError(t, db.CreateSigningKey(t.Context(), &model.SigningKey{
+		Name:      "temp-key",
+		Value:     "some-value",
+		AccountID: testAccount,
+		CreatedAt: time.Now().UTC(),
+	}))
+
+	err := db.DeleteSigningKey(t.Context(), testAccount, "temp-key")
+	require.NoError(t, err)
+
+	keys, err := db.ListSigningKeys(t.Context(), testAccount)
+	require.NoError(t, err)
+	assert.Len(t, keys, 0)
+
+	// deleting non-existent should return error
+	err = db.DeleteSigningKey(t.Context(), testAccount, "temp-key")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testCreateAndGetDirectUpload(t *testing.T, db Database) {
+
+	du := &model.DirectUpload{
+		ID:        "du-001",
+		AccountID: testAccount,
+		Expiry:    time.Now().UTC().Add(30 * time.Minute).Truncate(time.Second),
+		Metadata:  map[string]interface{}{"source": "test"},
+		Completed: false,
+	}
+	require.NoError(t, db.CreateDirectUpload(t.Context(), du))
+
+	got, err := db.GetDirectUpload(t.Context(), "du-001")
+	require.NoError(t, err)
+	assert.Equal(t, "du-001", got.ID)
+	assert.Equal(t, testAccount, got.AccountID)
+	assert.False(t, got.Completed)
+	assert.Equal(t, "test", got.Metadata["source"])
+
+	// not found
+	_, err = db.GetDirectUpload(t.Context(), "nonexistent")
+	assert.Error(t, err)
+}
+
+func testCompleteDirectUpload(t *testing.T, db Database) {
+
+	du := &model.DirectUpload{
+		ID:        "du-complete",
+		AccountID: testAccount,
+		Expiry:    time.Now().UTC().Add(30 * time.Minute),
+		Completed: false,
+	}
+	require.NoError(t, db.CreateDirectUpload(t.Context(), du))
+
+	err := db.CompleteDirectUpload(t.Context(), "du-complete")
+	require.NoError(t, err)
+
+	got, err := db.GetDirectUpload(t.Context(), "du-complete")
+	require.NoError(t, err)
+	assert.True(t, got.Completed)
+
+	// completing non-existent should return error
+	err = db.CompleteDirectUpload(t.Context(), "nonexistent")
+	assert.Error(t, err)
+}
+
+func testListImagesV2(t *testing.T, db Database) {
+
+	base := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < 15; i++ {
+		img := &model.Image{
+			ID:        fmt.Sprintf("v2-img-%03d", i),
+			AccountID: testAccount,
+			Filename:  fmt.Sprintf("photo-%d.png", i),
+			Uploaded:  base.Add(time.Duration(i) * time.Second),
+		}
+		require.NoError(t, db.CreateImage(t.Context(), img))
+	}
+
+	// first page, ascending
+	images, cursor, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{PerPage: 5, SortOrder: "asc"})
+	require.NoError(t, err)
+	assert.Len(t, images, 5)
+	assert.NotEmpty(t, cursor)
+	assert.Equal(t, "v2-img-000", images[0].ID)
+	assert.Equal(t, "v2-img-004", images[4].ID)
+
+	// second page using cursor
+	images2, cursor2, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{Cursor: cursor, PerPage: 5, SortOrder: "asc"})
+	require.NoError(t, err)
+	assert.Len(t, images2, 5)
+	assert.NotEmpty(t, cursor2)
+	assert.Equal(t, "v2-img-005", images2[0].ID)
+	assert.Equal(t, "v2-img-009", images2[4].ID)
+
+	// third page
+	images3, cursor3, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{Cursor: cursor2, PerPage: 5, SortOrder: "asc"})
+	require.NoError(t, err)
+	assert.Len(t, images3, 5)
+	assert.Equal(t, "v2-img-010", images3[0].ID)
+	assert.Equal(t, "v2-img-014", images3[4].ID)
+
+	// fourth page (should be empty, no cursor)
+	images4, cursor4, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{Cursor: cursor3, PerPage: 5, SortOrder: "asc"})
+	require.NoError(t, err)
+	assert.Len(t, images4, 0)
+	assert.Empty(t, cursor4)
+
+	// descending order
+	imagesDesc, _, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{PerPage: 5, SortOrder: "desc"})
+	require.NoError(t, err)
+	assert.Len(t, imagesDesc, 5)
+	assert.Equal(t, "v2-img-014", imagesDesc[0].ID)
+	assert.Equal(t, "v2-img-010", imagesDesc[4].ID)
+}
+
+func testListImagesV2_CreatorFilter(t *testing.T, db Database) {
+
+	base := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < 6; i++ {
+		creator := "user-a"
+		if i%2 == 1 {
+			creator = "user-b"
+		}
+		require.NoError(t, db.CreateImage(t.Context(), &model.Image{
+			ID:        fmt.Sprintf("creator-img-%03d", i),
+			AccountID: testAccount,
+			Creator:   creator,
+			Uploaded:  base.Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	images, cursor, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{PerPage: 2, SortOrder: "asc", Creator: "user-b"})
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	assert.Equal(t, "creator-img-001", images[0].ID)
+	assert.Equal(t, "creator-img-003", images[1].ID)
+
+	images, _, err = db.ListImagesV2(t.Context(), testAccount, ListV2Query{Cursor: cursor, PerPage: 2, SortOrder: "asc", Creator: "user-b"})
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, "creator-img-005", images[0].ID)
+	assert.Equal(t, "user-b", images[0].Creator)
+
+	all, _, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{PerPage: 10, SortOrder: "asc"})
+	require.NoError(t, err)
+	assert.Len(t, all, 6)
+
+	require.NoError(t, db.SetImageMetadata(t.Context(), testAccount, "creator-img-002", map[string]interface{}{"k": "v"}))
+	require.NoError(t, db.SetImageMetadata(t.Context(), testAccount, "creator-img-003", map[string]interface{}{"k": "v"}))
+	filtered, _, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{
+		PerPage: 10, SortOrder: "asc", Creator: "user-a",
+		Filters: []MetadataFilter{{Key: "k", Op: "eq", Values: []interface{}{"v"}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, filtered, 1)
+	assert.Equal(t, "creator-img-002", filtered[0].ID)
+}
+
+func testUpdateImage_Creator(t *testing.T, db Database) {
+
+	img := &model.Image{ID: "img-creator", AccountID: testAccount, Creator: "user-a", Uploaded: time.Now().UTC()}
+	require.NoError(t, db.CreateImage(t.Context(), img))
+
+	img.Creator = "user-b"
+	require.NoError(t, db.UpdateImage(t.Context(), img))
+
+	got, err := db.GetImage(t.Context(), testAccount, "img-creator")
+	require.NoError(t, err)
+	assert.Equal(t, "user-b", got.Creator)
+}
+
+func testDirectUpload_Creator(t *testing.T, db Database) {
+
+	require.NoError(t, db.CreateDirectUpload(t.Context(), &model.DirectUpload{
+		ID:        "du-creator",
+		AccountID: testAccount,
+		Expiry:    time.Now().UTC().Add(time.Hour),
+		Creator:   "user-a",
+	}))
+
+	got, err := db.GetDirectUpload(t.Context(), "du-creator")
+	require.NoError(t, err)
+	assert.Equal(t, "user-a", got.Creator)
+}
+
+func testListImagesV2_MetadataFilters(t *testing.T, db Database) {
+
+	base := time.Now().UTC().Truncate(time.Second)
+	metas := []map[string]interface{}{
+		{"size": 9, "label": "10", "public": true, "dims": map[string]interface{}{"w": 100}},
+		{"size": 10, "label": "9", "public": false, "dims": map[string]interface{}{"w": 200}},
+		{"size": "10", "label": "abc", "public": "true"},
+		{"size": 100.5, "tags": []interface{}{"x"}, "dims": map[string]interface{}{"w": 200, "h": 50}},
+	}
+	for i, meta := range metas {
+		require.NoError(t, db.CreateImage(t.Context(), &model.Image{
+			ID:        fmt.Sprintf("meta-%d", i),
+			AccountID: testAccount,
+			Meta:      meta,
+			Uploaded:  base.Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	// Numbers compare numerically and never match strings.
+	assert.Equal(t, []string{"meta-1", "meta-3"}, metadataIDs(t, db, filter("size", "gte", 10.0)))
+	assert.Equal(t, []string{"meta-0"}, metadataIDs(t, db, filter("size", "lt", 10.0)))
+	assert.Equal(t, []string{"meta-1"}, metadataIDs(t, db, filter("size", "eq", 10.0)))
+	assert.Equal(t, []string{"meta-2"}, metadataIDs(t, db, filter("size", "eq", "10")))
+
+	// Strings compare lexically.
+	assert.Equal(t, []string{"meta-0"}, metadataIDs(t, db, filter("label", "lt", "9")))
+
+	// Booleans are distinct from strings.
+	assert.Equal(t, []string{"meta-0"}, metadataIDs(t, db, filter("public", "eq", true)))
+	assert.Equal(t, []string{"meta-2"}, metadataIDs(t, db, filter("public", "eq", "true")))
+	assert.Equal(t, []string{"meta-1", "meta-2"}, metadataIDs(t, db, filter("public", "ne", true)))
+
+	// Nested paths.
+	assert.Equal(t, []string{"meta-1", "meta-3"}, metadataIDs(t, db, filter("dims.w", "eq", 200.0)))
+	assert.Equal(t, []string{"meta-3"}, metadataIDs(t, db, filter("dims.h", "gt", 10.0)))
+	assert.Empty(t, metadataIDs(t, db, filter("dims", "eq", "")))
+
+	// in matches any of its values, with their types.
+	assert.Equal(t, []string{"meta-0", "meta-2"}, metadataIDs(t, db, filter("size", "in", 9.0, "10")))
+
+	// Arrays are not indexed.
+	assert.Empty(t, metadataIDs(t, db, filter("tags", "eq", "x")))
+
+	// Filters combine with AND.
+	assert.Equal(t, []string{"meta-1"}, metadataIDs(t, db,
+		filter("dims.w", "eq", 200.0), filter("size", "lt", 50.0)))
+	assert.Empty(t, metadataIDs(t, db,
+		filter("dims.w", "eq", 200.0), filter("size", "lt", 50.0), filter("public", "eq", true)))
+
+	// Invalid filters are rejected.
+	_, _, err := db.ListImagesV2(t.Context(), testAccount, ListV2Query{PerPage: 10, Filters: []MetadataFilter{filter("public", "gt", true)}})
+	assert.Error(t, err)
+}
+
+func testMetadataIndex_FollowsWrites(t *testing.T, db Database) {
+
+	img := &model.Image{
+		ID:        "meta-img",
+		AccountID: testAccount,
+		Meta:      map[string]interface{}{"env": "prod"},
+		Uploaded:  time.Now().UTC(),
+	}
+	require.NoError(t, db.CreateImage(t.Context(), img))
+	assert.Equal(t, []string{"meta-img"}, metadataIDs(t, db, filter("env", "eq", "prod")))
+
+	img.Meta = map[string]interface{}{"env": "dev"}
+	require.NoError(t, db.UpdateImage(t.Context(), img))
+	assert.Empty(t, metadataIDs(t, db, filter("env", "eq", "prod")))
+	assert.Equal(t, []string{"meta-img"}, metadataIDs(t, db, filter("env", "eq", "dev")))
+
+	require.NoError(t, db.SetImageMetadata(t.Context(), testAccount, "meta-img", map[string]interface{}{"n": 1}))
+	assert.Empty(t, metadataIDs(t, db, filter("env", "eq", "dev")))
+	got, err := db.GetImage(t.Context(), testAccount, "meta-img")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), got.Meta["n"])
+
+	assert.Error(t, db.SetImageMetadata(t.Context(), testAccount, "nonexistent", map[string]interface{}{"n": 1}))
+
+	// A deleted image leaves nothing behind for its successor to match.
+	require.NoError(t, db.DeleteImage(t.Context(), testAccount, "meta-img"))
+	img.Meta = nil
+	require.NoError(t, db.CreateImage(t.Context(), img))
+	assert.Empty(t, metadataIDs(t, db, filter("n", "eq", 1.0)))
+}
+
+func testTypedErrors(t *testing.T, db Database) {
+	ctx := t.Context()
+
+	_, err := db.GetImage(ctx, testAccount, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.EqualError(t, err, "image not found")
+	assert.ErrorIs(t, db.DeleteImage(ctx, testAccount, "missing"), ErrNotFound)
+	_, err = db.GetDirectUpload(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	img := &model.Image{ID: "dup", AccountID: testAccount, Filename: "a.jpg", Uploaded: time.Now().UTC()}
+	require.NoError(t, db.CreateImage(ctx, img))
+	assert.ErrorIs(t, db.CreateImage(ctx, img), ErrConflict)
+
+	v := &model.Variant{ID: "dup", AccountID: testAccount, Options: model.VariantOptions{Fit: "contain", Width: 1, Height: 1, Metadata: "none"}}
+	require.NoError(t, db.CreateVariant(ctx, v))
+	err = db.CreateVariant(ctx, v)
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.EqualError(t, err, "variant already exists")
+
+	// Failures that are not about the object itself are neither.
+	require.NoError(t, db.Close())
+	_, err = db.GetVariant(ctx, testAccount, "dup")
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrNotFound)
+}
+
+func testHonoursContext(t *testing.T, db Database) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	err := db.CreateImage(ctx, &model.Image{ID: "img-1", AccountID: testAccount, Uploaded: time.Now().UTC()})
+	assert.ErrorIs(t, err, context.Canceled)
+	_, _, err = db.ListImages(ctx, testAccount, 1, 10)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Nothing was written.
+	count, err := db.CountImages(t.Context(), testAccount)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
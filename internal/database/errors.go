@@ -0,0 +1,50 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Errors returned by Database implementations, wrapped with a description of
+// the object concerned. Test for them with errors.Is.
+var (
+	// ErrNotFound means the requested object does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict means an object with the same identity already exists.
+	ErrConflict = errors.New("already exists")
+
+	// ErrLimitExceeded means an account has reached a limit on the number
+	// of objects of some kind, such as MaxVariantsPerAccount.
+	ErrLimitExceeded = errors.New("limit exceeded")
+
+	// ErrSchemaTooNew means the database was migrated by a newer build.
+	ErrSchemaTooNew = errors.New("database schema is newer than this build")
+)
+
+// notFound reports that the object described by what does not exist, e.g.
+// "image not found".
+func notFound(what string) error {
+	return fmt.Errorf("%s %w", what, ErrNotFound)
+}
+
+// queryError classifies an error from reading or writing the object
+// described by what: missing rows become ErrNotFound and uniqueness
+// violations ErrConflict. Other errors are wrapped with op.
+func queryError(err error, op, what string) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound(what)
+	}
+	var serr *sqlite.Error
+	if errors.As(err, &serr) {
+		switch serr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+			return fmt.Errorf("%s %w", what, ErrConflict)
+		}
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
@@ -0,0 +1,707 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leca/dt-cloudflare-images/internal/model"
+)
+
+// MemoryDSN selects a MemoryDB in Open.
+const MemoryDSN = "memory://"
+
+// errClosed is returned by a MemoryDB after Close.
+var errClosed = errors.New("database is closed")
+
+// MemoryDB implements Database in process memory. It behaves like SQLiteDB
+// -- the same ordering, cursors, metadata filters, timestamp precision and
+// errors -- and keeps nothing once closed. Each MemoryDB is independent.
+type MemoryDB struct {
+	mu      sync.RWMutex
+	closed  bool
+	seq     int64 // insertion counter, which orders images uploaded together
+	images  map[accountKey]*memImage
+	vars    map[accountKey]model.Variant
+	keys    map[accountKey]model.SigningKey
+	uploads map[string]memUpload
+}
+
+// accountKey identifies an object within an account.
+type accountKey struct {
+	accountID, id string
+}
+
+// memImage is a stored image: its columns, with metadata kept as JSON so that
+// reads decode it as SQLiteDB does, and its metadata index.
+type memImage struct {
+	img   model.Image // Meta and Variants unset
+	meta  string
+	index map[string]metadataEntry
+	seq   int64
+}
+
+// memUpload is a stored direct upload, with metadata kept as JSON.
+type memUpload struct {
+	du   model.DirectUpload // Metadata unset
+	meta string
+}
+
+// NewMemoryDB returns an empty in-memory database.
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		images:  make(map[accountKey]*memImage),
+		vars:    make(map[accountKey]model.Variant),
+		keys:    make(map[accountKey]model.SigningKey),
+		uploads: make(map[string]memUpload),
+	}
+}
+
+// Open opens the database named by dsn: a MemoryDB for MemoryDSN, otherwise
+// an SQLite database at that path or DSN.
+func Open(dsn string) (Database, error) {
+	if dsn == MemoryDSN {
+		return NewMemoryDB(), nil
+	}
+	return NewSQLiteDB(dsn)
+}
+
+// Close discards the contents of the database. Later calls fail.
+func (m *MemoryDB) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.images, m.vars, m.keys, m.uploads = nil, nil, nil, nil
+	return nil
+}
+
+// lock takes the write lock, failing if ctx is done or m is closed. On
+// success the caller must unlock.
+func (m *MemoryDB) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return errClosed
+	}
+	return nil
+}
+
+// rlock is lock for readers.
+func (m *MemoryDB) rlock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	if m.closed {
+		m.mu.RUnlock()
+		return errClosed
+	}
+	return nil
+}
+
+// storedTime truncates t as SQLiteDB's RFC 3339 columns do.
+func storedTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// ---------------------------------------------------------------------------
+// Images
+// ---------------------------------------------------------------------------
+
+func (m *MemoryDB) CreateImage(ctx context.Context, img *model.Image) error {
+	stored, err := newMemImage(img)
+	if err != nil {
+		return err
+	}
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	k := accountKey{img.AccountID, img.ID}
+	if _, ok := m.images[k]; ok {
+		return fmt.Errorf("image %w", ErrConflict)
+	}
+	m.seq++
+	stored.seq = m.seq
+	m.images[k] = stored
+	return nil
+}
+
+// newMemImage captures the stored columns of img.
+func newMemImage(img *model.Image) (*memImage, error) {
+	metaJSON, err := json.Marshal(img.Meta)
+	if err != nil {
+		return nil, fmt.Errorf("marshal meta: %w", err)
+	}
+	index, err := metadataIndex(img.Meta)
+	if err != nil {
+		return nil, err
+	}
+	return &memImage{
+		img: model.Image{
+			ID:                img.ID,
+			AccountID:         img.AccountID,
+			Filename:          img.Filename,
+			Creator:           img.Creator,
+			RequireSignedURLs: img.RequireSignedURLs,
+			Uploaded:          storedTime(img.Uploaded),
+		},
+		meta:  string(metaJSON),
+		index: index,
+	}, nil
+}
+
+// metadataIndex returns the indexable leaves of meta by key.
+func metadataIndex(meta map[string]interface{}) (map[string]metadataEntry, error) {
+	entries, err := flattenMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]metadataEntry, len(entries))
+	for _, e := range entries {
+		index[e.key] = e
+	}
+	return index, nil
+}
+
+// image returns a copy of the stored image, with its metadata decoded.
+func (s *memImage) image() (*model.Image, error) {
+	img := s.img
+	if s.meta != "" && s.meta != "{}" {
+		if err := json.Unmarshal([]byte(s.meta), &img.Meta); err != nil {
+			return nil, fmt.Errorf("unmarshal image metadata: %w", err)
+		}
+	}
+	return &img, nil
+}
+
+func (m *MemoryDB) GetImage(ctx context.Context, accountID, imageID string) (*model.Image, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+
+	stored, ok := m.images[accountKey{accountID, imageID}]
+	if !ok {
+		return nil, notFound("image")
+	}
+	return stored.image()
+}
+
+func (m *MemoryDB) ListImages(ctx context.Context, accountID string, page, perPage int) ([]*model.Image, int, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, 0, err
+	}
+	defer m.mu.RUnlock()
+
+	matches := m.accountImages(accountID, nil)
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if !a.img.Uploaded.Equal(b.img.Uploaded) {
+			return a.img.Uploaded.Before(b.img.Uploaded)
+		}
+		return a.seq < b.seq
+	})
+
+	images, err := decodeImages(window(matches, (page-1)*perPage, perPage))
+	if err != nil {
+		return nil, 0, err
+	}
+	return images, len(matches), nil
+}
+
+// accountImages returns the stored images of an account for which keep, if
+// non-nil, returns true.
+func (m *MemoryDB) accountImages(accountID string, keep func(*memImage) bool) []*memImage {
+	var matches []*memImage
+	for k, stored := range m.images {
+		if k.accountID == accountID && (keep == nil || keep(stored)) {
+			matches = append(matches, stored)
+		}
+	}
+	return matches
+}
+
+// window applies SQL's LIMIT and OFFSET to items: a negative limit means no
+// limit and a negative offset none.
+func window[T any](items []T, offset, limit int) []T {
+	offset = max(offset, 0)
+	if offset >= len(items) {
+		return nil
+	}
+	items = items[offset:]
+	if limit >= 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+// decodeImages returns copies of stored images, or nil if there are none.
+func decodeImages(stored []*memImage) ([]*model.Image, error) {
+	var images []*model.Image
+	for _, s := range stored {
+		img, err := s.image()
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+func (m *MemoryDB) UpdateImage(ctx context.Context, img *model.Image) error {
+	updated, err := newMemImage(img)
+	if err != nil {
+		return err
+	}
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	stored, ok := m.images[accountKey{img.AccountID, img.ID}]
+	if !ok {
+		return notFound("image")
+	}
+	stored.img.Filename = updated.img.Filename
+	stored.img.Creator = updated.img.Creator
+	stored.img.RequireSignedURLs = updated.img.RequireSignedURLs
+	stored.meta, stored.index = updated.meta, updated.index
+	return nil
+}
+
+func (m *MemoryDB) DeleteImage(ctx context.Context, accountID, imageID string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	k := accountKey{accountID, imageID}
+	if _, ok := m.images[k]; !ok {
+		return notFound("image")
+	}
+	delete(m.images, k)
+	return nil
+}
+
+func (m *MemoryDB) CountImages(ctx context.Context, accountID string) (int, error) {
+	if err := m.rlock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.RUnlock()
+
+	return len(m.accountImages(accountID, nil)), nil
+}
+
+func (m *MemoryDB) SetImageBroken(ctx context.Context, accountID, imageID, reason string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	stored, ok := m.images[accountKey{accountID, imageID}]
+	if !ok {
+		return notFound("image")
+	}
+	stored.img.Broken = reason
+	return nil
+}
+
+func (m *MemoryDB) ListAccounts(ctx context.Context) ([]string, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var accounts []string
+	for k := range m.images {
+		if !seen[k.accountID] {
+			seen[k.accountID] = true
+			accounts = append(accounts, k.accountID)
+		}
+	}
+	sort.Strings(accounts)
+	return accounts, nil
+}
+
+// ---------------------------------------------------------------------------
+// Variants
+// ---------------------------------------------------------------------------
+
+func (m *MemoryDB) CreateVariant(ctx context.Context, v *model.Variant) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	k := accountKey{v.AccountID, v.ID}
+	if _, ok := m.vars[k]; ok {
+		return fmt.Errorf("variant %w", ErrConflict)
+	}
+	count := 0
+	for vk := range m.vars {
+		if vk.accountID == v.AccountID {
+			count++
+		}
+	}
+	if count >= MaxVariantsPerAccount {
+		return fmt.Errorf("variants %w", ErrLimitExceeded)
+	}
+	m.vars[k] = *v
+	return nil
+}
+
+func (m *MemoryDB) GetVariant(ctx context.Context, accountID, variantID string) (*model.Variant, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+
+	v, ok := m.vars[accountKey{accountID, variantID}]
+	if !ok {
+		return nil, notFound("variant")
+	}
+	return &v, nil
+}
+
+func (m *MemoryDB) ListVariants(ctx context.Context, accountID string) ([]*model.Variant, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+
+	var variants []*model.Variant
+	for k, v := range m.vars {
+		if k.accountID == accountID {
+			v := v
+			variants = append(variants, &v)
+		}
+	}
+	sort.Slice(variants, func(i, j int) bool { return variants[i].ID < variants[j].ID })
+	return variants, nil
+}
+
+func (m *MemoryDB) UpdateVariant(ctx context.Context, v *model.Variant) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	k := accountKey{v.AccountID, v.ID}
+	if _, ok := m.vars[k]; !ok {
+		return notFound("variant")
+	}
+	m.vars[k] = *v
+	return nil
+}
+
+func (m *MemoryDB) DeleteVariant(ctx context.Context, accountID, variantID string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	k := accountKey{accountID, variantID}
+	if _, ok := m.vars[k]; !ok {
+		return notFound("variant")
+	}
+	delete(m.vars, k)
+	return nil
+}
+
+func (m *MemoryDB) CountVariants(ctx context.Context, accountID string) (int, error) {
+	if err := m.rlock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.RUnlock()
+
+	count := 0
+	for k := range m.vars {
+		if k.accountID == accountID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ---------------------------------------------------------------------------
+// Signing Keys
+// ---------------------------------------------------------------------------
+
+func (m *MemoryDB) CreateSigningKey(ctx context.Context, key *model.SigningKey) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	k := accountKey{key.AccountID, key.Name}
+	if _, ok := m.keys[k]; ok {
+		return fmt.Errorf("signing key %w", ErrConflict)
+	}
+	stored := *key
+	stored.CreatedAt = storedTime(key.CreatedAt)
+	m.keys[k] = stored
+	return nil
+}
+
+func (m *MemoryDB) ListSigningKeys(ctx context.Context, accountID string) ([]*model.SigningKey, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+
+	var keys []*model.SigningKey
+	for k, key := range m.keys {
+		if k.accountID == accountID {
+			key := key
+			keys = append(keys, &key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
+func (m *MemoryDB) DeleteSigningKey(ctx context.Context, accountID, name string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	k := accountKey{accountID, name}
+	if _, ok := m.keys[k]; !ok {
+		return notFound("signing key")
+	}
+	delete(m.keys, k)
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Direct Uploads
+// ---------------------------------------------------------------------------
+
+func (m *MemoryDB) CreateDirectUpload(ctx context.Context, du *model.DirectUpload) error {
+	metaJSON, err := json.Marshal(du.Metadata)
+	if err != nil {
+		return fmt.Errorf("marshal metadata: %w", err)
+	}
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if _, ok := m.uploads[du.ID]; ok {
+		return fmt.Errorf("direct upload %w", ErrConflict)
+	}
+	m.uploads[du.ID] = memUpload{
+		du: model.DirectUpload{
+			ID:        du.ID,
+			AccountID: du.AccountID,
+			Expiry:    storedTime(du.Expiry),
+			Completed: du.Completed,
+			Creator:   du.Creator,
+		},
+		meta: string(metaJSON),
+	}
+	return nil
+}
+
+func (m *MemoryDB) GetDirectUpload(ctx context.Context, uploadID string) (*model.DirectUpload, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+
+	stored, ok := m.uploads[uploadID]
+	if !ok {
+		return nil, notFound("direct upload")
+	}
+	du := stored.du
+	if stored.meta != "" {
+		if err := json.Unmarshal([]byte(stored.meta), &du.Metadata); err != nil {
+			return nil, fmt.Errorf("unmarshal direct upload metadata: %w", err)
+		}
+	}
+	return &du, nil
+}
+
+func (m *MemoryDB) CompleteDirectUpload(ctx context.Context, uploadID string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	stored, ok := m.uploads[uploadID]
+	if !ok {
+		return notFound("direct upload")
+	}
+	stored.du.Completed = true
+	m.uploads[uploadID] = stored
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// V2 List (cursor-based pagination)
+// ---------------------------------------------------------------------------
+
+func (m *MemoryDB) ListImagesV2(ctx context.Context, accountID string, q ListV2Query) ([]*model.Image, string, error) {
+	for _, f := range q.Filters {
+		if err := f.Validate(); err != nil {
+			return nil, "", err
+		}
+	}
+	desc := strings.EqualFold(q.SortOrder, "desc")
+
+	// Images are compared by the uploaded and id columns as SQLiteDB
+	// stores them, as strings.
+	var after func(uploaded, id string) bool
+	if q.Cursor != "" {
+		parts := strings.SplitN(q.Cursor, "|", 2)
+		if len(parts) != 2 {
+			return nil, "", fmt.Errorf("invalid cursor")
+		}
+		after = func(uploaded, id string) bool {
+			if desc {
+				return uploaded < parts[0] || (uploaded == parts[0] && id < parts[1])
+			}
+			return uploaded > parts[0] || (uploaded == parts[0] && id > parts[1])
+		}
+	}
+
+	if err := m.rlock(ctx); err != nil {
+		return nil, "", err
+	}
+	defer m.mu.RUnlock()
+
+	matches := m.accountImages(accountID, func(s *memImage) bool {
+		if q.Creator != "" && s.img.Creator != q.Creator {
+			return false
+		}
+		for _, f := range q.Filters {
+			if !matchesFilter(s.index, f) {
+				return false
+			}
+		}
+		return after == nil || after(s.img.Uploaded.Format(time.RFC3339), s.img.ID)
+	})
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		ua, ub := a.img.Uploaded.Format(time.RFC3339), b.img.Uploaded.Format(time.RFC3339)
+		if ua != ub {
+			return (ua < ub) != desc
+		}
+		return (a.img.ID < b.img.ID) != desc
+	})
+
+	images, err := decodeImages(window(matches, 0, q.PerPage))
+	if err != nil {
+		return nil, "", err
+	}
+	return images, nextCursor(images, q.PerPage), nil
+}
+
+// matchesFilter reports whether an image with the metadata index satisfies
+// f, with the semantics of metadataFilterSQL: the key must be present, and
+// values only compare with values of the same type.
+func matchesFilter(index map[string]metadataEntry, f MetadataFilter) bool {
+	e, ok := index[f.Key]
+	if !ok {
+		return false
+	}
+	switch f.Op {
+	case "eq", "in":
+		return equalsAny(e, f.Values)
+	case "ne":
+		return !equalsAny(e, f.Values)
+	}
+
+	switch v := f.Values[0].(type) {
+	case float64:
+		return e.valueType == metaTypeNumber && compareOp(f.Op, cmpFloat(e.num.(float64), v))
+	case string:
+		return e.valueType == metaTypeString && compareOp(f.Op, strings.Compare(e.value, v))
+	}
+	return false
+}
+
+// equalsAny reports whether e equals any of values, as metadataEqualSQL.
+func equalsAny(e metadataEntry, values []interface{}) bool {
+	for _, v := range values {
+		switch val := v.(type) {
+		case float64:
+			if e.valueType == metaTypeNumber && e.num.(float64) == val {
+				return true
+			}
+		case bool:
+			if e.valueType == metaTypeBool && e.num.(float64) == boolToFloat(val) {
+				return true
+			}
+		case string:
+			if e.valueType == metaTypeString && e.value == val {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareOp reports whether a comparison result c satisfies op.
+func compareOp(op string, c int) bool {
+	switch op {
+	case "lt":
+		return c < 0
+	case "gt":
+		return c > 0
+	case "lte":
+		return c <= 0
+	case "gte":
+		return c >= 0
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------
+// Image Metadata (for V2 filtering)
+// ---------------------------------------------------------------------------
+
+// SetImageMetadata replaces an image's metadata and its filter index.
+func (m *MemoryDB) SetImageMetadata(ctx context.Context, accountID, imageID string, meta map[string]interface{}) error {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("marshal meta: %w", err)
+	}
+	index, err := metadataIndex(meta)
+	if err != nil {
+		return err
+	}
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	stored, ok := m.images[accountKey{accountID, imageID}]
+	if !ok {
+		return notFound("image")
+	}
+	stored.meta, stored.index = string(metaJSON), index
+	return nil
+}
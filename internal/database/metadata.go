@@ -0,0 +1,165 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metadata value types recorded in image_metadata.value_type.
+const (
+	metaTypeString = "string"
+	metaTypeNumber = "number"
+	metaTypeBool   = "bool"
+)
+
+// MetadataFilter restricts a V2 listing to images whose metadata value at
+// Key satisfies Op. Key is a dot-separated path into nested metadata
+// objects. Values holds the operand -- a string, float64 or bool -- and has
+// exactly one element except for the "in" operator.
+//
+// Comparisons are typed: a number only matches numbers, a string only
+// strings. The ordering operators are not defined for booleans.
+type MetadataFilter struct {
+	Key    string
+	Op     string
+	Values []interface{}
+}
+
+// Validate reports whether the filter can be evaluated.
+func (f MetadataFilter) Validate() error {
+	if f.Key == "" {
+		return fmt.Errorf("metadata filter key must not be empty")
+	}
+	switch f.Op {
+	case "eq", "ne", "lt", "gt", "lte", "gte":
+		if len(f.Values) != 1 {
+			return fmt.Errorf("metadata filter %s[%s] takes a single value", f.Key, f.Op)
+		}
+	case "in":
+		if len(f.Values) == 0 {
+			return fmt.Errorf("metadata filter %s[in] needs at least one value", f.Key)
+		}
+	default:
+		return fmt.Errorf("unsupported metadata filter operator: %s", f.Op)
+	}
+	for _, v := range f.Values {
+		switch v.(type) {
+		case string, float64:
+		case bool:
+			if f.Op != "eq" && f.Op != "ne" && f.Op != "in" {
+				return fmt.Errorf("metadata filter %s[%s] cannot compare booleans", f.Key, f.Op)
+			}
+		default:
+			return fmt.Errorf("metadata filter %s has an unsupported value %v", f.Key, v)
+		}
+	}
+	return nil
+}
+
+// metadataEntry is one indexed leaf of an image's metadata.
+type metadataEntry struct {
+	key       string
+	valueType string
+	value     string
+	num       interface{} // float64 for numbers and booleans, nil for strings
+}
+
+// flattenMetadata returns the indexable leaves of meta: strings, numbers and
+// booleans, keyed by their dot-separated path. Nulls and arrays are not
+// indexed. Entries are sorted by key.
+func flattenMetadata(meta map[string]interface{}) ([]metadataEntry, error) {
+	if len(meta) == 0 {
+		return nil, nil
+	}
+
+	// Round-trip through JSON so that values have the types the API decodes
+	// them to, whatever Go types the caller used.
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("marshal metadata: %w", err)
+	}
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(raw, &normalized); err != nil {
+		return nil, fmt.Errorf("unmarshal metadata: %w", err)
+	}
+
+	var entries []metadataEntry
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			key := prefix + k
+			switch val := v.(type) {
+			case string:
+				entries = append(entries, metadataEntry{key: key, valueType: metaTypeString, value: val})
+			case float64:
+				entries = append(entries, metadataEntry{key: key, valueType: metaTypeNumber, value: strconv.FormatFloat(val, 'f', -1, 64), num: val})
+			case bool:
+				entries = append(entries, metadataEntry{key: key, valueType: metaTypeBool, value: strconv.FormatBool(val), num: boolToFloat(val)})
+			case map[string]interface{}:
+				walk(key+".", val)
+			}
+		}
+	}
+	walk("", normalized)
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// metadataFilterSQL returns a condition, over the images table aliased as
+// i, that holds for images matching f.
+func metadataFilterSQL(f MetadataFilter) (string, []interface{}) {
+	var cond string
+	var args []interface{}
+
+	switch f.Op {
+	case "eq", "ne", "in":
+		var parts []string
+		for _, v := range f.Values {
+			c, a := metadataEqualSQL(v)
+			parts = append(parts, c)
+			args = append(args, a...)
+		}
+		cond = "(" + strings.Join(parts, " OR ") + ")"
+		if f.Op == "ne" {
+			cond = "NOT " + cond
+		}
+	default:
+		cmp := map[string]string{"lt": "<", "gt": ">", "lte": "<=", "gte": ">="}[f.Op]
+		switch v := f.Values[0].(type) {
+		case float64:
+			cond = fmt.Sprintf("(m.value_type = '%s' AND m.num_value %s ?)", metaTypeNumber, cmp)
+			args = append(args, v)
+		default:
+			cond = fmt.Sprintf("(m.value_type = '%s' AND m.value %s ?)", metaTypeString, cmp)
+			args = append(args, v)
+		}
+	}
+
+	return `EXISTS (SELECT 1 FROM image_metadata m
+		WHERE m.account_id = i.account_id AND m.image_id = i.id AND m.key = ? AND ` + cond + `)`,
+		append([]interface{}{f.Key}, args...)
+}
+
+// metadataEqualSQL returns a condition over image_metadata m that holds when
+// the indexed value equals v.
+func metadataEqualSQL(v interface{}) (string, []interface{}) {
+	switch val := v.(type) {
+	case float64:
+		return fmt.Sprintf("(m.value_type = '%s' AND m.num_value = ?)", metaTypeNumber), []interface{}{val}
+	case bool:
+		return fmt.Sprintf("(m.value_type = '%s' AND m.num_value = ?)", metaTypeBool), []interface{}{boolToFloat(val)}
+	default:
+		return fmt.Sprintf("(m.value_type = '%s' AND m.value = ?)", metaTypeString), []interface{}{val}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
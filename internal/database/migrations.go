@@ -1,6 +1,40 @@
 package database
 
-const schema = `
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one numbered step of the schema. Steps run in order, each in
+// a transaction together with the schema_migrations row recording it, so a
+// failed step leaves the database at the previous version. Released steps
+// are never edited; change the schema by appending a step.
+//
+// Databases created before schema_migrations existed are migrated from
+// version 1, so steps tolerate the unversioned schemas of those releases:
+// tables and indexes are created IF NOT EXISTS and columns added only when
+// missing.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations is the schema, oldest step first. Versions are consecutive
+// from 1.
+var migrations = []migration{
+	{1, "baseline", execSQL(baselineSchema)},
+	{2, "creator", migrateCreator},
+	{3, "typed metadata", migrateTypedMetadata},
+	{4, "broken images", migrateBroken},
+}
+
+// baselineSchema is the schema of the first release.
+const baselineSchema = `
 CREATE TABLE IF NOT EXISTS images (
     account_id TEXT NOT NULL,
     id TEXT NOT NULL,
@@ -54,3 +88,157 @@ CREATE TABLE IF NOT EXISTS image_metadata (
 CREATE INDEX IF NOT EXISTS idx_image_metadata_filter ON image_metadata (account_id, key, value);
 CREATE INDEX IF NOT EXISTS idx_images_uploaded ON images (account_id, uploaded);
 `
+
+// migrateCreator records the creator of direct uploads and indexes images
+// by creator for v2 listings.
+func migrateCreator(ctx context.Context, tx *sql.Tx) error {
+	if err := addColumn(ctx, tx, "direct_uploads", "creator", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_images_creator ON images (account_id, creator, uploaded)`)
+	return err
+}
+
+// migrateTypedMetadata types the metadata index so that filters compare
+// numbers numerically, and rebuilds it from images.meta: older versions
+// stored untyped values and did not index uploads.
+func migrateTypedMetadata(ctx context.Context, tx *sql.Tx) error {
+	if err := addColumn(ctx, tx, "image_metadata", "value_type", "TEXT NOT NULL DEFAULT 'string'"); err != nil {
+		return err
+	}
+	if err := addColumn(ctx, tx, "image_metadata", "num_value", "REAL"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_image_metadata_num ON image_metadata (account_id, key, num_value)`); err != nil {
+		return err
+	}
+	return reindexMetadata(ctx, tx)
+}
+
+// migrateBroken lets fsck mark images whose stored blob is unusable.
+func migrateBroken(ctx context.Context, tx *sql.Tx) error {
+	return addColumn(ctx, tx, "images", "broken", "TEXT NOT NULL DEFAULT ''")
+}
+
+// execSQL returns a step that executes stmts.
+func execSQL(stmts string) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, stmts)
+		return err
+	}
+}
+
+// addColumn adds a column to table unless it already has it.
+func addColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	var exists int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&exists); err != nil {
+		return fmt.Errorf("check column %s.%s: %w", table, column, err)
+	}
+	if exists != 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// reindexMetadata rebuilds image_metadata from the meta column of every
+// image.
+func reindexMetadata(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT account_id, id, meta FROM images`)
+	if err != nil {
+		return fmt.Errorf("list images: %w", err)
+	}
+	type image struct {
+		accountID, id string
+		meta          map[string]interface{}
+	}
+	var images []image
+	for rows.Next() {
+		var img image
+		var metaStr sql.NullString
+		if err := rows.Scan(&img.accountID, &img.id, &metaStr); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan image: %w", err)
+		}
+		if metaStr.Valid && metaStr.String != "" {
+			if err := json.Unmarshal([]byte(metaStr.String), &img.meta); err != nil {
+				log.Printf("reindexMetadata: skipping %s/%s: %v", img.accountID, img.id, err)
+				continue
+			}
+		}
+		images = append(images, img)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM image_metadata`); err != nil {
+		return fmt.Errorf("clear metadata index: %w", err)
+	}
+	for _, img := range images {
+		if err := writeMetadataIndex(ctx, tx, img.accountID, img.id, img.meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate brings the schema up to the last of steps. It refuses to touch a
+// database whose schema is newer than steps, which this build would
+// misread.
+func migrate(ctx context.Context, db *sql.DB, steps []migration) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at DATETIME NOT NULL
+)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	for {
+		done, err := migrateStep(ctx, db, steps)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateStep applies the step after the current schema version, if any,
+// and reports whether the schema was already up to date. The version is
+// read inside the step's transaction, so concurrent openers of the same
+// database apply each step once.
+func migrateStep(ctx context.Context, db *sql.DB, steps []migration) (done bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("begin tx: %w", err)
+	}
+	defer rollback(tx, "migrate")
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return false, fmt.Errorf("read schema version: %w", err)
+	}
+	if version > len(steps) {
+		return false, fmt.Errorf("schema version %d, this build supports up to %d: %w", version, len(steps), ErrSchemaTooNew)
+	}
+	if version == len(steps) {
+		return true, nil
+	}
+
+	step := steps[version]
+	if err := step.up(ctx, tx); err != nil {
+		return false, fmt.Errorf("migration %d (%s): %w", step.version, step.name, err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		step.version, step.name, time.Now().UTC()); err != nil {
+		return false, fmt.Errorf("record migration %d: %w", step.version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit migration %d: %w", step.version, err)
+	}
+	log.Printf("Applied schema migration %d (%s)", step.version, step.name)
+	return false, nil
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openFixture creates a database at a fresh path from the SQL in
+// testdata/name and returns the path.
+func openFixture(t *testing.T, name string) string {
+	t.Helper()
+	fixture, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "fixture.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(string(fixture))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	return path
+}
+
+// schemaVersions lists the versions recorded in schema_migrations.
+func schemaVersions(t *testing.T, db *SQLiteDB) []int {
+	t.Helper()
+	rows, err := db.db.Query(`SELECT version FROM schema_migrations ORDER BY version`)
+	require.NoError(t, err)
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var v int
+		require.NoError(t, rows.Scan(&v))
+		versions = append(versions, v)
+	}
+	require.NoError(t, rows.Err())
+	return versions
+}
+
+func TestMigrations_AreNumberedConsecutively(t *testing.T) {
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, m.name)
+	}
+}
+
+func TestMigrate_UpgradesBaselineDatabase(t *testing.T) {
+	path := openFixture(t, "baseline.sql")
+
+	db, err := NewSQLiteDB(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	assert.Equal(t, []int{1, 2, 3, 4}, schemaVersions(t, db))
+
+	// Existing rows survive and read through the current code.
+	img, err := db.GetImage(t.Context(), testAccount, "img-b")
+	require.NoError(t, err)
+	assert.Equal(t, "b.png", img.Filename)
+	assert.True(t, img.RequireSignedURLs)
+
+	v, err := db.GetVariant(t.Context(), testAccount, "thumb")
+	require.NoError(t, err)
+	assert.Equal(t, "cover", v.Options.Fit)
+	assert.True(t, v.NeverRequireSignedURLs)
+
+	keys, err := db.ListSigningKeys(t.Context(), testAccount)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "secret", keys[0].Value)
+
+	du, err := db.GetDirectUpload(t.Context(), "du-1")
+	require.NoError(t, err)
+	assert.Equal(t, "", du.Creator)
+
+	// The metadata index is rebuilt with types, including images that
+	// were never PATCHed.
+	assert.Equal(t, []string{"img-a"}, metadataIDs(t, db, filter("n", "eq", 3.0)))
+	assert.Equal(t, []string{"img-b"}, metadataIDs(t, db, filter("n", "eq", "3")))
+	assert.Equal(t, []string{"img-a"}, metadataIDs(t, db, filter("dims.w", "gte", 100.0)))
+
+	// Added columns accept writes.
+	require.NoError(t, db.CreateDirectUpload(t.Context(), &model.DirectUpload{
+		ID: "du-2", AccountID: testAccount, Expiry: time.Now().UTC().Add(time.Hour), Creator: "user-a",
+	}))
+	du, err = db.GetDirectUpload(t.Context(), "du-2")
+	require.NoError(t, err)
+	assert.Equal(t, "user-a", du.Creator)
+}
+
+func TestMigrate_IsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.db")
+	for i := 0; i < 2; i++ {
+		db, err := NewSQLiteDB(path)
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 2, 3, 4}, schemaVersions(t, db))
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestMigrate_RefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.db")
+	db, err := NewSQLiteDB(path)
+	require.NoError(t, err)
+	_, err = db.db.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from the future', CURRENT_TIMESTAMP)`, len(migrations)+1)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = NewSQLiteDB(path)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+}
+
+func TestMigrate_FailedStepRollsBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.db")
+	raw, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { raw.Close() })
+
+	steps := append(migrations[:len(migrations):len(migrations)], migration{
+		version: len(migrations) + 1,
+		name:    "broken",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `CREATE TABLE half_done (id TEXT)`); err != nil {
+				return err
+			}
+			return errors.New("boom")
+		},
+	})
+	err = migrate(t.Context(), raw, steps)
+	require.ErrorContains(t, err, "boom")
+
+	var version, tables int
+	require.NoError(t, raw.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	assert.Equal(t, len(migrations), version)
+	require.NoError(t, raw.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'`).Scan(&tables))
+	assert.Zero(t, tables)
+}
@@ -1,11 +1,13 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"runtime"
 	"strings"
 	"time"
 
@@ -14,39 +16,80 @@ import (
 )
 
 // SQLiteDB implements Database backed by SQLite.
+//
+// SQLite allows a single writer at a time, so writes go through one
+// connection, while reads run concurrently on a pool of read-only
+// connections. In WAL mode readers see the last committed state and never
+// wait for the writer.
 type SQLiteDB struct {
-	db *sql.DB
+	db   *sql.DB // the writer; at most one open connection
+	read *sql.DB // read-only pool; the writer itself for in-memory databases
 }
 
+// readPoolSize bounds the number of concurrent read connections.
+var readPoolSize = max(4, runtime.NumCPU())
+
 // NewSQLiteDB opens (or creates) an SQLite database at dsn and runs migrations.
 // For in-memory use pass "file::memory:?cache=shared".
 func NewSQLiteDB(dsn string) (*SQLiteDB, error) {
-	if !strings.Contains(dsn, "?") {
-		dsn += "?_journal_mode=WAL&_busy_timeout=5000"
-	} else if !strings.Contains(dsn, "_journal_mode") {
-		dsn += "&_journal_mode=WAL&_busy_timeout=5000"
-	}
-
-	db, err := sql.Open("sqlite", dsn)
+	db, err := sql.Open("sqlite", withParams(dsn,
+		"_pragma=busy_timeout(5000)",
+		"_pragma=journal_mode(WAL)",
+		"_pragma=synchronous(NORMAL)",
+		"_txlock=immediate",
+	))
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite: %w", err)
 	}
-
-	// SQLite only allows one writer at a time. Limiting to a single open
-	// connection serialises all access through one handle and avoids
-	// "database is locked" errors under concurrent load.
 	db.SetMaxOpenConns(1)
 
-	if _, err := db.Exec(schema); err != nil {
+	if err := migrate(context.Background(), db, migrations); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("run migrations: %w", err)
 	}
 
-	return &SQLiteDB{db: db}, nil
+	// In-memory databases have no WAL and shared-cache connections lock
+	// each other out, so they are served by the writer alone.
+	if isMemoryDSN(dsn) {
+		return &SQLiteDB{db: db, read: db}, nil
+	}
+
+	read, err := sql.Open("sqlite", withParams(dsn,
+		"_pragma=busy_timeout(5000)",
+		"_pragma=query_only(1)",
+	))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open sqlite readers: %w", err)
+	}
+	read.SetMaxOpenConns(readPoolSize)
+	read.SetMaxIdleConns(readPoolSize)
+
+	return &SQLiteDB{db: db, read: read}, nil
+}
+
+// withParams appends driver parameters to dsn's query string.
+func withParams(dsn string, params ...string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + strings.Join(params, "&")
+}
+
+// isMemoryDSN reports whether dsn names an in-memory database.
+func isMemoryDSN(dsn string) bool {
+	return strings.Contains(dsn, ":memory:") || strings.Contains(dsn, "mode=memory")
 }
 
-// Close closes the underlying database connection.
+// Close closes the underlying database connections.
 func (s *SQLiteDB) Close() error {
+	if s.read != s.db {
+		if err := s.read.Close(); err != nil {
+			s.db.Close()
+			return err
+		}
+	}
 	return s.db.Close()
 }
 
@@ -54,44 +97,57 @@ func (s *SQLiteDB) Close() error {
 // Images
 // ---------------------------------------------------------------------------
 
-func (s *SQLiteDB) CreateImage(img *model.Image) error {
+func (s *SQLiteDB) CreateImage(ctx context.Context, img *model.Image) error {
 	metaJSON, err := json.Marshal(img.Meta)
 	if err != nil {
 		return fmt.Errorf("marshal meta: %w", err)
 	}
 
-	_, err = s.db.Exec(`
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer rollback(tx, "CreateImage")
+
+	_, err = tx.ExecContext(ctx, `
 		INSERT INTO images (account_id, id, filename, creator, meta, require_signed_urls, uploaded)
 		VALUES (?, ?, ?, ?, ?, ?, ?)`,
 		img.AccountID, img.ID, img.Filename, img.Creator, string(metaJSON),
 		boolToInt(img.RequireSignedURLs), img.Uploaded.UTC().Format(time.RFC3339),
 	)
 	if err != nil {
-		return fmt.Errorf("insert image: %w", err)
+		return queryError(err, "insert image", "image")
 	}
-	return nil
+	if err := writeMetadataIndex(ctx, tx, img.AccountID, img.ID, img.Meta); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *SQLiteDB) GetImage(accountID, imageID string) (*model.Image, error) {
-	row := s.db.QueryRow(`
-		SELECT account_id, id, filename, creator, meta, require_signed_urls, uploaded
+func (s *SQLiteDB) GetImage(ctx context.Context, accountID, imageID string) (*model.Image, error) {
+	row := s.read.QueryRowContext(ctx, `
+		SELECT account_id, id, filename, creator, meta, require_signed_urls, uploaded, broken
 		FROM images WHERE account_id = ? AND id = ?`,
 		accountID, imageID,
 	)
-	return scanImage(row)
+	img, err := scanImage(row)
+	if err != nil {
+		return nil, queryError(err, "get image", "image")
+	}
+	return img, nil
 }
 
-func (s *SQLiteDB) ListImages(accountID string, page, perPage int) ([]*model.Image, int, error) {
+func (s *SQLiteDB) ListImages(ctx context.Context, accountID string, page, perPage int) ([]*model.Image, int, error) {
 	// total count
 	var total int
-	err := s.db.QueryRow(`SELECT COUNT(*) FROM images WHERE account_id = ?`, accountID).Scan(&total)
+	err := s.read.QueryRowContext(ctx, `SELECT COUNT(*) FROM images WHERE account_id = ?`, accountID).Scan(&total)
 	if err != nil {
 		return nil, 0, fmt.Errorf("count images: %w", err)
 	}
 
 	offset := (page - 1) * perPage
-	rows, err := s.db.Query(`
-		SELECT account_id, id, filename, creator, meta, require_signed_urls, uploaded
+	rows, err := s.read.QueryContext(ctx, `
+		SELECT account_id, id, filename, creator, meta, require_signed_urls, uploaded, broken
 		FROM images WHERE account_id = ?
 		ORDER BY uploaded ASC
 		LIMIT ? OFFSET ?`,
@@ -109,35 +165,85 @@ func (s *SQLiteDB) ListImages(accountID string, page, perPage int) ([]*model.Ima
 	return images, total, nil
 }
 
-func (s *SQLiteDB) UpdateImage(img *model.Image) error {
+func (s *SQLiteDB) UpdateImage(ctx context.Context, img *model.Image) error {
 	metaJSON, err := json.Marshal(img.Meta)
 	if err != nil {
 		return fmt.Errorf("marshal meta: %w", err)
 	}
 
-	res, err := s.db.Exec(`
-		UPDATE images SET filename = ?, meta = ?, require_signed_urls = ?
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer rollback(tx, "UpdateImage")
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE images SET filename = ?, creator = ?, meta = ?, require_signed_urls = ?
 		WHERE account_id = ? AND id = ?`,
-		img.Filename, string(metaJSON), boolToInt(img.RequireSignedURLs),
+		img.Filename, img.Creator, string(metaJSON), boolToInt(img.RequireSignedURLs),
 		img.AccountID, img.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("update image: %w", err)
 	}
-	return checkRowsAffected(res, "image not found")
+	if err := checkRowsAffected(res, "image"); err != nil {
+		return err
+	}
+	if err := writeMetadataIndex(ctx, tx, img.AccountID, img.ID, img.Meta); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *SQLiteDB) DeleteImage(accountID, imageID string) error {
-	res, err := s.db.Exec(`DELETE FROM images WHERE account_id = ? AND id = ?`, accountID, imageID)
+func (s *SQLiteDB) DeleteImage(ctx context.Context, accountID, imageID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer rollback(tx, "DeleteImage")
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM images WHERE account_id = ? AND id = ?`, accountID, imageID)
 	if err != nil {
 		return fmt.Errorf("delete image: %w", err)
 	}
-	return checkRowsAffected(res, "image not found")
+	if err := checkRowsAffected(res, "image"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM image_metadata WHERE account_id = ? AND image_id = ?`, accountID, imageID); err != nil {
+		return fmt.Errorf("delete metadata: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) SetImageBroken(ctx context.Context, accountID, imageID, reason string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE images SET broken = ? WHERE account_id = ? AND id = ?`, reason, accountID, imageID)
+	if err != nil {
+		return fmt.Errorf("mark image: %w", err)
+	}
+	return checkRowsAffected(res, "image")
+}
+
+func (s *SQLiteDB) ListAccounts(ctx context.Context) ([]string, error) {
+	rows, err := s.read.QueryContext(ctx, `SELECT DISTINCT account_id FROM images ORDER BY account_id`)
+	if err != nil {
+		return nil, fmt.Errorf("list accounts: %w", err)
+	}
+	defer rows.Close()
+
+	var accounts []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan account: %w", err)
+		}
+		accounts = append(accounts, id)
+	}
+	return accounts, rows.Err()
 }
 
-func (s *SQLiteDB) CountImages(accountID string) (int, error) {
+func (s *SQLiteDB) CountImages(ctx context.Context, accountID string) (int, error) {
 	var count int
-	err := s.db.QueryRow(`SELECT COUNT(*) FROM images WHERE account_id = ?`, accountID).Scan(&count)
+	err := s.read.QueryRowContext(ctx, `SELECT COUNT(*) FROM images WHERE account_id = ?`, accountID).Scan(&count)
 	return count, err
 }
 
@@ -145,21 +251,36 @@ func (s *SQLiteDB) CountImages(accountID string) (int, error) {
 // Variants
 // ---------------------------------------------------------------------------
 
-func (s *SQLiteDB) CreateVariant(v *model.Variant) error {
-	_, err := s.db.Exec(`
+func (s *SQLiteDB) CreateVariant(ctx context.Context, v *model.Variant) error {
+	// The count and the insert are one statement, so that concurrent
+	// creates cannot overshoot the limit.
+	res, err := s.db.ExecContext(ctx, `
 		INSERT INTO variants (account_id, id, fit, width, height, metadata, never_require_signed_urls)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		SELECT ?, ?, ?, ?, ?, ?, ?
+		WHERE (SELECT COUNT(*) FROM variants WHERE account_id = ?) < ?`,
 		v.AccountID, v.ID, v.Options.Fit, v.Options.Width, v.Options.Height,
 		v.Options.Metadata, boolToInt(v.NeverRequireSignedURLs),
+		v.AccountID, MaxVariantsPerAccount,
 	)
+	if err != nil {
+		return queryError(err, "insert variant", "variant")
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("insert variant: %w", err)
 	}
+	if n == 0 {
+		// A duplicate ID is a conflict whether or not the account is full.
+		if _, err := s.GetVariant(ctx, v.AccountID, v.ID); err == nil {
+			return fmt.Errorf("variant %w", ErrConflict)
+		}
+		return fmt.Errorf("variants %w", ErrLimitExceeded)
+	}
 	return nil
 }
 
-func (s *SQLiteDB) GetVariant(accountID, variantID string) (*model.Variant, error) {
-	row := s.db.QueryRow(`
+func (s *SQLiteDB) GetVariant(ctx context.Context, accountID, variantID string) (*model.Variant, error) {
+	row := s.read.QueryRowContext(ctx, `
 		SELECT account_id, id, fit, width, height, metadata, never_require_signed_urls
 		FROM variants WHERE account_id = ? AND id = ?`,
 		accountID, variantID,
@@ -169,14 +290,14 @@ func (s *SQLiteDB) GetVariant(accountID, variantID string) (*model.Variant, erro
 	err := row.Scan(&v.AccountID, &v.ID, &v.Options.Fit, &v.Options.Width,
 		&v.Options.Height, &v.Options.Metadata, &neverSigned)
 	if err != nil {
-		return nil, fmt.Errorf("get variant: %w", err)
+		return nil, queryError(err, "get variant", "variant")
 	}
 	v.NeverRequireSignedURLs = neverSigned != 0
 	return v, nil
 }
 
-func (s *SQLiteDB) ListVariants(accountID string) ([]*model.Variant, error) {
-	rows, err := s.db.Query(`
+func (s *SQLiteDB) ListVariants(ctx context.Context, accountID string) ([]*model.Variant, error) {
+	rows, err := s.read.QueryContext(ctx, `
 		SELECT account_id, id, fit, width, height, metadata, never_require_signed_urls
 		FROM variants WHERE account_id = ?
 		ORDER BY id ASC`,
@@ -201,8 +322,8 @@ func (s *SQLiteDB) ListVariants(accountID string) ([]*model.Variant, error) {
 	return variants, rows.Err()
 }
 
-func (s *SQLiteDB) UpdateVariant(v *model.Variant) error {
-	res, err := s.db.Exec(`
+func (s *SQLiteDB) UpdateVariant(ctx context.Context, v *model.Variant) error {
+	res, err := s.db.ExecContext(ctx, `
 		UPDATE variants SET fit = ?, width = ?, height = ?, metadata = ?, never_require_signed_urls = ?
 		WHERE account_id = ? AND id = ?`,
 		v.Options.Fit, v.Options.Width, v.Options.Height, v.Options.Metadata,
@@ -211,20 +332,20 @@ func (s *SQLiteDB) UpdateVariant(v *model.Variant) error {
 	if err != nil {
 		return fmt.Errorf("update variant: %w", err)
 	}
-	return checkRowsAffected(res, "variant not found")
+	return checkRowsAffected(res, "variant")
 }
 
-func (s *SQLiteDB) DeleteVariant(accountID, variantID string) error {
-	res, err := s.db.Exec(`DELETE FROM variants WHERE account_id = ? AND id = ?`, accountID, variantID)
+func (s *SQLiteDB) DeleteVariant(ctx context.Context, accountID, variantID string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM variants WHERE account_id = ? AND id = ?`, accountID, variantID)
 	if err != nil {
 		return fmt.Errorf("delete variant: %w", err)
 	}
-	return checkRowsAffected(res, "variant not found")
+	return checkRowsAffected(res, "variant")
 }
 
-func (s *SQLiteDB) CountVariants(accountID string) (int, error) {
+func (s *SQLiteDB) CountVariants(ctx context.Context, accountID string) (int, error) {
 	var count int
-	err := s.db.QueryRow(`SELECT COUNT(*) FROM variants WHERE account_id = ?`, accountID).Scan(&count)
+	err := s.read.QueryRowContext(ctx, `SELECT COUNT(*) FROM variants WHERE account_id = ?`, accountID).Scan(&count)
 	return count, err
 }
 
@@ -232,20 +353,20 @@ func (s *SQLiteDB) CountVariants(accountID string) (int, error) {
 // Signing Keys
 // ---------------------------------------------------------------------------
 
-func (s *SQLiteDB) CreateSigningKey(key *model.SigningKey) error {
-	_, err := s.db.Exec(`
+func (s *SQLiteDB) CreateSigningKey(ctx context.Context, key *model.SigningKey) error {
+	_, err := s.db.ExecContext(ctx, `
 		INSERT INTO signing_keys (account_id, name, value, created_at)
 		VALUES (?, ?, ?, ?)`,
 		key.AccountID, key.Name, key.Value, key.CreatedAt.UTC().Format(time.RFC3339),
 	)
 	if err != nil {
-		return fmt.Errorf("insert signing key: %w", err)
+		return queryError(err, "insert signing key", "signing key")
 	}
 	return nil
 }
 
-func (s *SQLiteDB) ListSigningKeys(accountID string) ([]*model.SigningKey, error) {
-	rows, err := s.db.Query(`
+func (s *SQLiteDB) ListSigningKeys(ctx context.Context, accountID string) ([]*model.SigningKey, error) {
+	rows, err := s.read.QueryContext(ctx, `
 		SELECT account_id, name, value, created_at
 		FROM signing_keys WHERE account_id = ?
 		ORDER BY name ASC`,
@@ -269,39 +390,39 @@ func (s *SQLiteDB) ListSigningKeys(accountID string) ([]*model.SigningKey, error
 	return keys, rows.Err()
 }
 
-func (s *SQLiteDB) DeleteSigningKey(accountID, name string) error {
-	res, err := s.db.Exec(`DELETE FROM signing_keys WHERE account_id = ? AND name = ?`, accountID, name)
+func (s *SQLiteDB) DeleteSigningKey(ctx context.Context, accountID, name string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM signing_keys WHERE account_id = ? AND name = ?`, accountID, name)
 	if err != nil {
 		return fmt.Errorf("delete signing key: %w", err)
 	}
-	return checkRowsAffected(res, "signing key not found")
+	return checkRowsAffected(res, "signing key")
 }
 
 // ---------------------------------------------------------------------------
 // Direct Uploads
 // ---------------------------------------------------------------------------
 
-func (s *SQLiteDB) CreateDirectUpload(du *model.DirectUpload) error {
+func (s *SQLiteDB) CreateDirectUpload(ctx context.Context, du *model.DirectUpload) error {
 	metaJSON, err := json.Marshal(du.Metadata)
 	if err != nil {
 		return fmt.Errorf("marshal metadata: %w", err)
 	}
 
-	_, err = s.db.Exec(`
-		INSERT INTO direct_uploads (id, account_id, expiry, meta, completed)
-		VALUES (?, ?, ?, ?, ?)`,
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO direct_uploads (id, account_id, expiry, meta, completed, creator)
+		VALUES (?, ?, ?, ?, ?, ?)`,
 		du.ID, du.AccountID, du.Expiry.UTC().Format(time.RFC3339),
-		string(metaJSON), boolToInt(du.Completed),
+		string(metaJSON), boolToInt(du.Completed), du.Creator,
 	)
 	if err != nil {
-		return fmt.Errorf("insert direct upload: %w", err)
+		return queryError(err, "insert direct upload", "direct upload")
 	}
 	return nil
 }
 
-func (s *SQLiteDB) GetDirectUpload(uploadID string) (*model.DirectUpload, error) {
-	row := s.db.QueryRow(`
-		SELECT id, account_id, expiry, meta, completed
+func (s *SQLiteDB) GetDirectUpload(ctx context.Context, uploadID string) (*model.DirectUpload, error) {
+	row := s.read.QueryRowContext(ctx, `
+		SELECT id, account_id, expiry, meta, completed, creator
 		FROM direct_uploads WHERE id = ?`,
 		uploadID,
 	)
@@ -309,9 +430,9 @@ func (s *SQLiteDB) GetDirectUpload(uploadID string) (*model.DirectUpload, error)
 	du := &model.DirectUpload{}
 	var expiryStr, metaStr string
 	var completed int
-	err := row.Scan(&du.ID, &du.AccountID, &expiryStr, &metaStr, &completed)
+	err := row.Scan(&du.ID, &du.AccountID, &expiryStr, &metaStr, &completed, &du.Creator)
 	if err != nil {
-		return nil, fmt.Errorf("get direct upload: %w", err)
+		return nil, queryError(err, "get direct upload", "direct upload")
 	}
 	du.Expiry, _ = time.Parse(time.RFC3339, expiryStr)
 	du.Completed = completed != 0
@@ -323,66 +444,54 @@ func (s *SQLiteDB) GetDirectUpload(uploadID string) (*model.DirectUpload, error)
 	return du, nil
 }
 
-func (s *SQLiteDB) CompleteDirectUpload(uploadID string) error {
-	res, err := s.db.Exec(`UPDATE direct_uploads SET completed = 1 WHERE id = ?`, uploadID)
+func (s *SQLiteDB) CompleteDirectUpload(ctx context.Context, uploadID string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE direct_uploads SET completed = 1 WHERE id = ?`, uploadID)
 	if err != nil {
 		return fmt.Errorf("complete direct upload: %w", err)
 	}
-	return checkRowsAffected(res, "direct upload not found")
+	return checkRowsAffected(res, "direct upload")
 }
 
 // ---------------------------------------------------------------------------
 // V2 List (cursor-based pagination)
 // ---------------------------------------------------------------------------
 
-func (s *SQLiteDB) ListImagesV2(accountID string, cursor string, perPage int, sortOrder string) ([]*model.Image, string, error) {
+func (s *SQLiteDB) ListImagesV2(ctx context.Context, accountID string, q ListV2Query) ([]*model.Image, string, error) {
 	order := "ASC"
-	if strings.EqualFold(sortOrder, "desc") {
+	if strings.EqualFold(q.SortOrder, "desc") {
 		order = "DESC"
 	}
 
-	var rows *sql.Rows
-	var err error
-
-	if cursor == "" {
-		rows, err = s.db.Query(fmt.Sprintf(`
-			SELECT account_id, id, filename, creator, meta, require_signed_urls, uploaded
-			FROM images WHERE account_id = ?
-			ORDER BY uploaded %s, id %s
-			LIMIT ?`, order, order),
-			accountID, perPage,
-		)
-	} else {
-		// Decode cursor: it is the uploaded timestamp and id of the last item
-		var cursorUploaded, cursorID string
-		parts := strings.SplitN(cursor, "|", 2)
-		if len(parts) == 2 {
-			cursorUploaded = parts[0]
-			cursorID = parts[1]
-		} else {
-			return nil, "", fmt.Errorf("invalid cursor")
+	where := "i.account_id = ?"
+	args := []interface{}{accountID}
+	if q.Creator != "" {
+		where += " AND i.creator = ?"
+		args = append(args, q.Creator)
+	}
+	for _, f := range q.Filters {
+		if err := f.Validate(); err != nil {
+			return nil, "", err
 		}
-
-		if order == "ASC" {
-			rows, err = s.db.Query(`
-				SELECT account_id, id, filename, creator, meta, require_signed_urls, uploaded
-				FROM images
-				WHERE account_id = ? AND (uploaded > ? OR (uploaded = ? AND id > ?))
-				ORDER BY uploaded ASC, id ASC
-				LIMIT ?`,
-				accountID, cursorUploaded, cursorUploaded, cursorID, perPage,
-			)
-		} else {
-			rows, err = s.db.Query(`
-				SELECT account_id, id, filename, creator, meta, require_signed_urls, uploaded
-				FROM images
-				WHERE account_id = ? AND (uploaded < ? OR (uploaded = ? AND id < ?))
-				ORDER BY uploaded DESC, id DESC
-				LIMIT ?`,
-				accountID, cursorUploaded, cursorUploaded, cursorID, perPage,
-			)
+		cond, condArgs := metadataFilterSQL(f)
+		where += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	if q.Cursor != "" {
+		clause, cursorArgs, err := cursorCondition(q.Cursor, order, "i.")
+		if err != nil {
+			return nil, "", err
 		}
+		where += " AND " + clause
+		args = append(args, cursorArgs...)
 	}
+
+	rows, err := s.read.QueryContext(ctx, fmt.Sprintf(`
+		SELECT i.account_id, i.id, i.filename, i.creator, i.meta, i.require_signed_urls, i.uploaded, i.broken
+		FROM images i WHERE %s
+		ORDER BY i.uploaded %s, i.id %s
+		LIMIT ?`, where, order, order),
+		append(args, q.PerPage)...,
+	)
 	if err != nil {
 		return nil, "", fmt.Errorf("list images v2: %w", err)
 	}
@@ -393,125 +502,95 @@ func (s *SQLiteDB) ListImagesV2(accountID string, cursor string, perPage int, so
 		return nil, "", err
 	}
 
-	var nextCursor string
-	if len(images) == perPage {
-		last := images[len(images)-1]
-		nextCursor = last.Uploaded.UTC().Format(time.RFC3339Nano) + "|" + last.ID
+	return images, nextCursor(images, q.PerPage), nil
+}
+
+// cursorCondition decodes a V2 cursor -- the uploaded timestamp and id of the
+// last item returned, joined by "|" -- into a condition selecting the rows
+// after it in the given order. prefix qualifies the column names.
+func cursorCondition(cursor, order, prefix string) (string, []interface{}, error) {
+	parts := strings.SplitN(cursor, "|", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("invalid cursor")
+	}
+	cmp := ">"
+	if order == "DESC" {
+		cmp = "<"
 	}
+	clause := fmt.Sprintf("(%[1]suploaded %[2]s ? OR (%[1]suploaded = ? AND %[1]sid %[2]s ?))", prefix, cmp)
+	return clause, []interface{}{parts[0], parts[0], parts[1]}, nil
+}
 
-	return images, nextCursor, nil
+// nextCursor returns the cursor following a full page of images, or "" if
+// the page is not full.
+func nextCursor(images []*model.Image, perPage int) string {
+	if len(images) != perPage || perPage == 0 {
+		return ""
+	}
+	last := images[len(images)-1]
+	return last.Uploaded.UTC().Format(time.RFC3339Nano) + "|" + last.ID
 }
 
 // ---------------------------------------------------------------------------
 // Image Metadata (for V2 filtering)
 // ---------------------------------------------------------------------------
 
-func (s *SQLiteDB) SetImageMetadata(accountID, imageID string, meta map[string]interface{}) error {
-	tx, err := s.db.Begin()
+// SetImageMetadata replaces an image's metadata, keeping the filter index in
+// step.
+func (s *SQLiteDB) SetImageMetadata(ctx context.Context, accountID, imageID string, meta map[string]interface{}) error {
+	metaJSON, err := json.Marshal(meta)
 	if err != nil {
-		return fmt.Errorf("begin tx: %w", err)
+		return fmt.Errorf("marshal meta: %w", err)
 	}
-	defer func() {
-		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
-			log.Printf("SetImageMetadata: rollback failed: %v", err)
-		}
-	}()
 
-	// Delete existing metadata for this image
-	_, err = tx.Exec(`DELETE FROM image_metadata WHERE account_id = ? AND image_id = ?`, accountID, imageID)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("delete old metadata: %w", err)
+		return fmt.Errorf("begin tx: %w", err)
 	}
+	defer rollback(tx, "SetImageMetadata")
 
-	// Insert new metadata
-	for k, v := range meta {
-		valStr := fmt.Sprintf("%v", v)
-		_, err = tx.Exec(`
-			INSERT INTO image_metadata (account_id, image_id, key, value)
-			VALUES (?, ?, ?, ?)`,
-			accountID, imageID, k, valStr,
-		)
-		if err != nil {
-			return fmt.Errorf("insert metadata: %w", err)
-		}
+	res, err := tx.ExecContext(ctx, `UPDATE images SET meta = ? WHERE account_id = ? AND id = ?`, string(metaJSON), accountID, imageID)
+	if err != nil {
+		return fmt.Errorf("update image meta: %w", err)
+	}
+	if err := checkRowsAffected(res, "image"); err != nil {
+		return err
+	}
+	if err := writeMetadataIndex(ctx, tx, accountID, imageID, meta); err != nil {
+		return err
 	}
-
 	return tx.Commit()
 }
 
-func (s *SQLiteDB) ListImagesWithFilter(accountID string, cursor string, perPage int, sortOrder string, key, op string, value interface{}) ([]*model.Image, string, error) {
-	order := "ASC"
-	if strings.EqualFold(sortOrder, "desc") {
-		order = "DESC"
+// writeMetadataIndex replaces the image_metadata rows of an image with the
+// indexable leaves of meta.
+func writeMetadataIndex(ctx context.Context, tx *sql.Tx, accountID, imageID string, meta map[string]interface{}) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM image_metadata WHERE account_id = ? AND image_id = ?`, accountID, imageID); err != nil {
+		return fmt.Errorf("delete old metadata: %w", err)
 	}
 
-	valStr := fmt.Sprintf("%v", value)
-
-	var opSQL string
-	switch op {
-	case "eq":
-		opSQL = "="
-	case "ne":
-		opSQL = "!="
-	case "lt":
-		opSQL = "<"
-	case "gt":
-		opSQL = ">"
-	case "le", "lte":
-		opSQL = "<="
-	case "ge", "gte":
-		opSQL = ">="
-	default:
-		opSQL = "="
-	}
-
-	var rows *sql.Rows
-	var err error
-
-	baseQuery := fmt.Sprintf(`
-		SELECT i.account_id, i.id, i.filename, i.creator, i.meta, i.require_signed_urls, i.uploaded
-		FROM images i
-		INNER JOIN image_metadata m ON i.account_id = m.account_id AND i.id = m.image_id
-		WHERE i.account_id = ? AND m.key = ? AND m.value %s ?`, opSQL)
-
-	if cursor == "" {
-		query := fmt.Sprintf(`%s ORDER BY i.uploaded %s, i.id %s LIMIT ?`, baseQuery, order, order)
-		rows, err = s.db.Query(query, accountID, key, valStr, perPage)
-	} else {
-		parts := strings.SplitN(cursor, "|", 2)
-		if len(parts) != 2 {
-			return nil, "", fmt.Errorf("invalid cursor")
-		}
-		cursorUploaded := parts[0]
-		cursorID := parts[1]
-
-		if order == "ASC" {
-			query := fmt.Sprintf(`%s AND (i.uploaded > ? OR (i.uploaded = ? AND i.id > ?))
-				ORDER BY i.uploaded ASC, i.id ASC LIMIT ?`, baseQuery)
-			rows, err = s.db.Query(query, accountID, key, valStr, cursorUploaded, cursorUploaded, cursorID, perPage)
-		} else {
-			query := fmt.Sprintf(`%s AND (i.uploaded < ? OR (i.uploaded = ? AND i.id < ?))
-				ORDER BY i.uploaded DESC, i.id DESC LIMIT ?`, baseQuery)
-			rows, err = s.db.Query(query, accountID, key, valStr, cursorUploaded, cursorUploaded, cursorID, perPage)
-		}
-	}
+	entries, err := flattenMetadata(meta)
 	if err != nil {
-		return nil, "", fmt.Errorf("list images with filter: %w", err)
+		return err
 	}
-	defer rows.Close()
-
-	images, err := scanImages(rows)
-	if err != nil {
-		return nil, "", err
+	for _, e := range entries {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO image_metadata (account_id, image_id, key, value, value_type, num_value)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			accountID, imageID, e.key, e.value, e.valueType, e.num,
+		)
+		if err != nil {
+			return fmt.Errorf("insert metadata: %w", err)
+		}
 	}
+	return nil
+}
 
-	var nextCursor string
-	if len(images) == perPage {
-		last := images[len(images)-1]
-		nextCursor = last.Uploaded.UTC().Format(time.RFC3339Nano) + "|" + last.ID
+// rollback rolls back tx unless it was committed.
+func rollback(tx *sql.Tx, caller string) {
+	if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		log.Printf("%s: rollback failed: %v", caller, err)
 	}
-
-	return images, nextCursor, nil
 }
 
 // ---------------------------------------------------------------------------
@@ -527,7 +606,7 @@ func scanImage(row scannable) (*model.Image, error) {
 	var metaStr, uploadedStr string
 	var requireSigned int
 
-	err := row.Scan(&img.AccountID, &img.ID, &img.Filename, &img.Creator, &metaStr, &requireSigned, &uploadedStr)
+	err := row.Scan(&img.AccountID, &img.ID, &img.Filename, &img.Creator, &metaStr, &requireSigned, &uploadedStr, &img.Broken)
 	if err != nil {
 		return nil, fmt.Errorf("scan image: %w", err)
 	}
@@ -561,13 +640,15 @@ func boolToInt(b bool) int {
 	return 0
 }
 
-func checkRowsAffected(res sql.Result, notFoundMsg string) error {
+// checkRowsAffected returns an ErrNotFound error for the object described by
+// what if res affected no rows.
+func checkRowsAffected(res sql.Result, what string) error {
 	n, err := res.RowsAffected()
 	if err != nil {
 		return err
 	}
 	if n == 0 {
-		return fmt.Errorf("%s", notFoundMsg)
+		return notFound(what)
 	}
 	return nil
 }
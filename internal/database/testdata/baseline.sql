@@ -0,0 +1,73 @@
+-- A database as written by the first release: the baseline schema, with no
+-- schema_migrations table, and a row of every kind. image_metadata holds
+-- the untyped index of that release, which only covered PATCHed metadata.
+
+CREATE TABLE images (
+    account_id TEXT NOT NULL,
+    id TEXT NOT NULL,
+    filename TEXT NOT NULL DEFAULT '',
+    creator TEXT NOT NULL DEFAULT '',
+    meta TEXT DEFAULT '{}',
+    require_signed_urls INTEGER NOT NULL DEFAULT 0,
+    uploaded DATETIME NOT NULL,
+    file_ext TEXT NOT NULL DEFAULT '',
+    file_size INTEGER NOT NULL DEFAULT 0,
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (account_id, id)
+);
+
+CREATE TABLE variants (
+    account_id TEXT NOT NULL,
+    id TEXT NOT NULL,
+    fit TEXT NOT NULL DEFAULT 'scale-down',
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    metadata TEXT NOT NULL DEFAULT 'none',
+    never_require_signed_urls INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (account_id, id)
+);
+
+CREATE TABLE signing_keys (
+    account_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (account_id, name)
+);
+
+CREATE TABLE direct_uploads (
+    id TEXT PRIMARY KEY,
+    account_id TEXT NOT NULL,
+    expiry DATETIME NOT NULL,
+    meta TEXT DEFAULT '{}',
+    completed INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE image_metadata (
+    account_id TEXT NOT NULL,
+    image_id TEXT NOT NULL,
+    key TEXT NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (account_id, image_id, key)
+);
+
+CREATE INDEX idx_image_metadata_filter ON image_metadata (account_id, key, value);
+CREATE INDEX idx_images_uploaded ON images (account_id, uploaded);
+
+INSERT INTO images (account_id, id, filename, meta, require_signed_urls, uploaded)
+VALUES
+    ('test-account-001', 'img-a', 'a.jpg', '{"n": 3, "dims": {"w": 100}}', 0, '2024-01-02T03:04:05Z'),
+    ('test-account-001', 'img-b', 'b.png', '{"n": "3"}', 1, '2024-01-02T03:04:06Z');
+
+INSERT INTO image_metadata (account_id, image_id, key, value)
+VALUES ('test-account-001', 'img-b', 'n', '3');
+
+INSERT INTO variants (account_id, id, fit, width, height, metadata, never_require_signed_urls)
+VALUES ('test-account-001', 'thumb', 'cover', 100, 100, 'none', 1);
+
+INSERT INTO signing_keys (account_id, name, value, created_at)
+VALUES ('test-account-001', 'default', 'secret', '2024-01-02T03:04:05Z');
+
+INSERT INTO direct_uploads (id, account_id, expiry, completed)
+VALUES ('du-1', 'test-account-001', '2030-01-01T00:00:00Z', 0);
@@ -0,0 +1,81 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Compile-time check that FixtureFetcher implements Fetcher.
+var _ Fetcher = (*FixtureFetcher)(nil)
+
+// FixtureFetcher serves URL uploads from a local directory instead of the
+// network, for tests. The URL https://example.com/a/b.png maps to
+// <dir>/example.com/a/b.png. The query string is ignored.
+type FixtureFetcher struct {
+	dir      string
+	maxBytes int64
+}
+
+// NewFixtureFetcher creates a FixtureFetcher rooted at dir. A maxBytes of
+// zero or less takes DefaultMaxBytes.
+func NewFixtureFetcher(dir string, maxBytes int64) *FixtureFetcher {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	return &FixtureFetcher{dir: dir, maxBytes: maxBytes}
+}
+
+// Fetch opens the fixture file that rawURL maps to.
+func (f *FixtureFetcher) Fetch(_ context.Context, rawURL string) (*Result, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cleaning a rooted path removes any ".." that would escape the host
+	// directory; the host itself must be a single path element.
+	host := u.Host
+	if strings.ContainsAny(host, `/\`) || host == "." || host == ".." {
+		return nil, fmt.Errorf("invalid url: bad host %q", host)
+	}
+	rel := path.Join(host, path.Clean("/"+u.Path))
+	p := filepath.Join(f.dir, filepath.FromSlash(rel))
+
+	file, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("opening fixture: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("stat fixture: %w", err)
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, ErrNotFound
+	}
+	if info.Size() > f.maxBytes {
+		file.Close()
+		return nil, ErrTooLarge
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(p)))
+	if err := checkContentType(mediaType); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Result{
+		Body:        file,
+		Filename:    filenameFor(u, ""),
+		ContentType: mediaType,
+	}, nil
+}
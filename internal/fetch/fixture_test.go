@@ -0,0 +1,59 @@
+package fetch
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fixtureDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "example.com", "img"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com", "img", "cat.png"), pngHeader, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com", "notes.txt"), []byte("hi"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret.png"), pngHeader, 0644))
+	return dir
+}
+
+func TestFixtureFetcher_Fetch(t *testing.T) {
+	f := NewFixtureFetcher(fixtureDir(t), 0)
+
+	res, err := f.Fetch(context.Background(), "https://example.com/img/cat.png?v=2")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, pngHeader, data)
+	assert.Equal(t, "cat.png", res.Filename)
+	assert.Equal(t, "image/png", res.ContentType)
+}
+
+func TestFixtureFetcher_Errors(t *testing.T) {
+	f := NewFixtureFetcher(fixtureDir(t), 4)
+
+	tests := []struct {
+		name string
+		url  string
+		want error
+	}{
+		{"missing", "https://example.com/img/dog.png", ErrNotFound},
+		{"directory", "https://example.com/img", ErrNotFound},
+		{"traversal", "https://example.com/../secret.png", ErrNotFound},
+		{"not an image", "https://example.com/notes.txt", ErrNotImage},
+		{"too large", "https://example.com/img/cat.png", ErrTooLarge},
+		{"unsupported scheme", "ftp://example.com/img/cat.png", ErrUnsupportedScheme},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := f.Fetch(context.Background(), tt.url)
+			assert.ErrorIs(t, err, tt.want)
+		})
+	}
+}
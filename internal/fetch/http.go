@@ -0,0 +1,166 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Compile-time check that HTTPFetcher implements Fetcher.
+var _ Fetcher = (*HTTPFetcher)(nil)
+
+// Default HTTPFetcher settings.
+const (
+	DefaultTimeout      = 30 * time.Second
+	DefaultMaxBytes     = 10 << 20
+	DefaultMaxRedirects = 5
+)
+
+// Options configures an HTTPFetcher. Zero values take the defaults, but for
+// MaxRedirects.
+type Options struct {
+	// Timeout bounds the whole fetch, including reading the body.
+	Timeout time.Duration
+	// MaxBytes is the largest body accepted.
+	MaxBytes int64
+	// MaxRedirects is the number of redirects followed; 0 follows none and a
+	// negative value takes DefaultMaxRedirects.
+	MaxRedirects int
+	// AllowPrivate permits URLs that resolve to private, loopback and
+	// link-local addresses.
+	AllowPrivate bool
+}
+
+// HTTPFetcher fetches images over HTTP(S). Unless AllowPrivate is set, the
+// address of every connection is checked after DNS resolution, so redirects
+// and rebinding cannot reach internal hosts.
+type HTTPFetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+// NewHTTPFetcher creates an HTTPFetcher.
+func NewHTTPFetcher(opts Options) *HTTPFetcher {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.MaxRedirects < 0 {
+		opts.MaxRedirects = DefaultMaxRedirects
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !opts.AllowPrivate {
+		dialer.Control = blockPrivate
+	}
+
+	maxRedirects := opts.MaxRedirects
+	return &HTTPFetcher{
+		client: &http.Client{
+			Timeout: opts.Timeout,
+			Transport: &http.Transport{
+				// No proxy: connections must go to the checked address.
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: opts.Timeout,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       30 * time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > maxRedirects {
+					return ErrTooManyRedirects
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return ErrUnsupportedScheme
+				}
+				return nil
+			},
+		},
+		maxBytes: opts.MaxBytes,
+	}
+}
+
+// Fetch retrieves rawURL.
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) (*Result, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		// Surface our own sentinels through the url.Error wrapping.
+		for _, sentinel := range []error{ErrBlockedAddress, ErrTooManyRedirects, ErrUnsupportedScheme} {
+			if errors.Is(err, sentinel) {
+				return nil, sentinel
+			}
+		}
+		return nil, err
+	}
+
+	if err := f.checkResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return &Result{
+		Body:        newLimitedBody(resp.Body, f.maxBytes),
+		Filename:    filenameFor(u, resp.Header.Get("Content-Disposition")),
+		ContentType: mediaType,
+	}, nil
+}
+
+// checkResponse rejects unsuccessful, oversized and non-image responses
+// before their body is read.
+func (f *HTTPFetcher) checkResponse(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("remote server returned %s", resp.Status)
+	case resp.ContentLength > f.maxBytes:
+		return ErrTooLarge
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return checkContentType(mediaType)
+}
+
+// blockPrivate is a net.Dialer Control function that refuses connections to
+// non-public addresses.
+func blockPrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublic(ip) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598).
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublic reports whether ip is a globally routable unicast address.
+func isPublic(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip))
+}
@@ -0,0 +1,185 @@
+package fetch
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pngHeader is enough of a PNG for content checks.
+var pngHeader = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+
+func imageServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/photos/cat.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(pngHeader)
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Disposition", `attachment; filename="../../evil/dog.png"`)
+		_, _ = w.Write(pngHeader)
+	})
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(make([]byte, 2048))
+	})
+	mux.HandleFunc("/chunked-big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		for range 4 {
+			_, _ = w.Write(make([]byte, 512))
+			if fl, ok := w.(http.Flusher); ok {
+				fl.Flush()
+			}
+		}
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/photos/cat.png", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write(pngHeader)
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestHTTPFetcher_Fetch(t *testing.T) {
+	ts := imageServer(t)
+	f := NewHTTPFetcher(Options{AllowPrivate: true})
+
+	res, err := f.Fetch(context.Background(), ts.URL+"/photos/cat.png?size=large")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, pngHeader, data)
+	assert.Equal(t, "cat.png", res.Filename)
+	assert.Equal(t, "image/png", res.ContentType)
+}
+
+func TestHTTPFetcher_ContentDispositionFilename(t *testing.T) {
+	ts := imageServer(t)
+	f := NewHTTPFetcher(Options{AllowPrivate: true})
+
+	res, err := f.Fetch(context.Background(), ts.URL+"/download")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "dog.png", res.Filename)
+}
+
+func TestHTTPFetcher_Errors(t *testing.T) {
+	ts := imageServer(t)
+	f := NewHTTPFetcher(Options{AllowPrivate: true, MaxBytes: 1024, MaxRedirects: 3})
+
+	tests := []struct {
+		name string
+		url  string
+		want error
+	}{
+		{"not an image", ts.URL + "/page.html", ErrNotImage},
+		{"content length over limit", ts.URL + "/big", ErrTooLarge},
+		{"not found", ts.URL + "/missing.png", ErrNotFound},
+		{"redirect loop", ts.URL + "/loop", ErrTooManyRedirects},
+		{"unsupported scheme", "file:///etc/passwd", ErrUnsupportedScheme},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := f.Fetch(context.Background(), tt.url)
+			assert.ErrorIs(t, err, tt.want)
+		})
+	}
+}
+
+func TestHTTPFetcher_FollowsRedirects(t *testing.T) {
+	ts := imageServer(t)
+	f := NewHTTPFetcher(Options{AllowPrivate: true, MaxRedirects: -1})
+
+	res, err := f.Fetch(context.Background(), ts.URL+"/redirect")
+	require.NoError(t, err)
+	res.Body.Close()
+	// The filename comes from the requested URL.
+	assert.Equal(t, "redirect", res.Filename)
+}
+
+func TestHTTPFetcher_RedirectsDisabled(t *testing.T) {
+	ts := imageServer(t)
+	f := NewHTTPFetcher(Options{AllowPrivate: true})
+
+	_, err := f.Fetch(context.Background(), ts.URL+"/redirect")
+	assert.ErrorIs(t, err, ErrTooManyRedirects)
+}
+
+func TestHTTPFetcher_StreamedBodyOverLimit(t *testing.T) {
+	ts := imageServer(t)
+	f := NewHTTPFetcher(Options{AllowPrivate: true, MaxBytes: 1024})
+
+	res, err := f.Fetch(context.Background(), ts.URL+"/chunked-big")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestHTTPFetcher_Timeout(t *testing.T) {
+	ts := imageServer(t)
+	f := NewHTTPFetcher(Options{AllowPrivate: true, Timeout: 50 * time.Millisecond})
+
+	_, err := f.Fetch(context.Background(), ts.URL+"/slow")
+	require.Error(t, err)
+}
+
+func TestHTTPFetcher_BlocksPrivateAddresses(t *testing.T) {
+	ts := imageServer(t)
+	f := NewHTTPFetcher(Options{})
+
+	_, err := f.Fetch(context.Background(), ts.URL+"/photos/cat.png")
+	assert.ErrorIs(t, err, ErrBlockedAddress)
+
+	// Host names are checked after resolution.
+	_, err = f.Fetch(context.Background(), strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)+"/photos/cat.png")
+	assert.ErrorIs(t, err, ErrBlockedAddress)
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, isPublic(net.ParseIP(tt.ip)), tt.ip)
+	}
+}
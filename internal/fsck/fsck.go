@@ -0,0 +1,340 @@
+// Package fsck cross-checks image records against stored originals. Records
+// and blobs drift apart when a blob outlives its record -- uploads store the
+// blob first and deleting an image ignores storage errors -- or when a blob
+// is lost or damaged underneath the store.
+package fsck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+)
+
+// pageSize is the number of image records read per query.
+const pageSize = 1000
+
+// DefaultOrphanAge is the OrphanAge used when none is set.
+const DefaultOrphanAge = time.Hour
+
+// Kind classifies a problem.
+type Kind string
+
+const (
+	// Missing means an image record has no stored original.
+	Missing Kind = "missing"
+	// Corrupt means a stored original no longer matches the digest
+	// recorded when it was stored, or cannot be read.
+	Corrupt Kind = "corrupt"
+	// Orphaned means a stored original has no image record.
+	Orphaned Kind = "orphaned"
+)
+
+// Actions taken, or in a dry run planned, for a problem.
+const (
+	ActionNone    = ""
+	ActionDeleted = "deleted"
+	ActionMarked  = "marked"
+)
+
+// Options configures a Check.
+type Options struct {
+	// Repair deletes orphaned blobs and marks the records of missing and
+	// corrupt ones broken. Records marked by an earlier run are cleared
+	// once their blob checks out; a corrupt mark only with Verify. Without
+	// Repair, marked records are reported until they are cleared.
+	Repair bool
+	// DryRun, with Repair, reports the repairs that would be made without
+	// making them.
+	DryRun bool
+	// Verify reads every blob to compare it with its recorded digest.
+	// Without it, corrupt blobs go unnoticed.
+	Verify bool
+	// OrphanAge is how old a blob without a record must be to count as
+	// orphaned, so that uploads in progress are left alone;
+	// DefaultOrphanAge if zero.
+	OrphanAge time.Duration
+}
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	Kind      Kind
+	AccountID string
+	ImageID   string
+	// Detail describes the problem, e.g. the digests that differ.
+	Detail string
+	// Action is what was done about the problem, or what would have been
+	// in a dry run.
+	Action string
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s %s/%s", p.Kind, p.AccountID, p.ImageID)
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	return s
+}
+
+// Report summarises a Check.
+type Report struct {
+	Images   int // image records checked
+	Blobs    int // stored originals seen
+	Problems []Problem
+	// Cleared counts the records whose broken mark was removed, or would
+	// have been in a dry run.
+	Cleared int
+}
+
+// Clean reports whether every problem found was repaired.
+func (r *Report) Clean() bool {
+	for _, p := range r.Problems {
+		if p.Action == ActionNone {
+			return false
+		}
+	}
+	return true
+}
+
+// checker holds the state of one Check.
+type checker struct {
+	db     database.Database
+	store  storage.Storage
+	opts   Options
+	now    time.Time
+	report Report
+}
+
+// Check cross-checks every image record in db against the originals in
+// store, account by account, and repairs what it finds if opts say so.
+// Problems that vanish while they are being repaired, as when an image is
+// deleted concurrently, are dropped.
+func Check(ctx context.Context, db database.Database, store storage.Storage, opts Options) (*Report, error) {
+	if opts.OrphanAge <= 0 {
+		opts.OrphanAge = DefaultOrphanAge
+	}
+	c := &checker{db: db, store: store, opts: opts, now: time.Now()}
+
+	accounts, err := c.accounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, accountID := range accounts {
+		if err := c.checkAccount(ctx, accountID); err != nil {
+			return nil, err
+		}
+	}
+	return &c.report, nil
+}
+
+// accounts returns the accounts with records or blobs, sorted.
+func (c *checker) accounts(ctx context.Context) ([]string, error) {
+	accounts, err := c.db.ListAccounts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %w", err)
+	}
+	seen := make(map[string]bool, len(accounts))
+	for _, a := range accounts {
+		seen[a] = true
+	}
+	for a, err := range c.store.Accounts(ctx) {
+		if err != nil {
+			return nil, fmt.Errorf("listing stored accounts: %w", err)
+		}
+		if !seen[a] {
+			seen[a] = true
+			accounts = append(accounts, a)
+		}
+	}
+	sort.Strings(accounts)
+	return accounts, nil
+}
+
+// checkAccount checks the records of an account against its blobs, then
+// looks for blobs without records.
+func (c *checker) checkAccount(ctx context.Context, accountID string) error {
+	records := make(map[string]bool)
+	q := database.ListV2Query{PerPage: pageSize, SortOrder: "asc"}
+	for {
+		images, cursor, err := c.db.ListImagesV2(ctx, accountID, q)
+		if err != nil {
+			return fmt.Errorf("listing images of %s: %w", accountID, err)
+		}
+		for _, img := range images {
+			records[img.ID] = true
+			c.report.Images++
+			if err := c.checkImage(ctx, accountID, img.ID, img.Broken); err != nil {
+				return err
+			}
+		}
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+
+	for imageID, err := range c.store.List(ctx, accountID) {
+		if err != nil {
+			return fmt.Errorf("listing blobs of %s: %w", accountID, err)
+		}
+		c.report.Blobs++
+		if !records[imageID] {
+			if err := c.checkOrphan(ctx, accountID, imageID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkImage checks the blob of one image record, which carries the given
+// broken mark.
+func (c *checker) checkImage(ctx context.Context, accountID, imageID, broken string) error {
+	kind, detail, err := c.checkBlob(ctx, accountID, imageID)
+	if err != nil {
+		return err
+	}
+	if kind == "" {
+		if broken == "" {
+			return nil
+		}
+		if broken == string(Corrupt) && !c.opts.Verify {
+			// Without reading the blob there is no telling whether it was
+			// restored, so the mark stays.
+			p := Problem{Kind: Corrupt, AccountID: accountID, ImageID: imageID, Detail: "marked by an earlier run, not verified"}
+			if c.opts.Repair {
+				p.Action = ActionMarked
+			}
+			c.report.Problems = append(c.report.Problems, p)
+			return nil
+		}
+		if !c.opts.Repair {
+			c.report.Problems = append(c.report.Problems, Problem{
+				Kind:      Kind(broken),
+				AccountID: accountID,
+				ImageID:   imageID,
+				Detail:    "marked by an earlier run, but the original checks out",
+			})
+			return nil
+		}
+		err := c.mark(ctx, accountID, imageID, "")
+		if errors.Is(err, database.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.report.Cleared++
+		return nil
+	}
+
+	p := Problem{Kind: kind, AccountID: accountID, ImageID: imageID, Detail: detail}
+	if c.opts.Repair {
+		if broken != string(kind) {
+			if err := c.mark(ctx, accountID, imageID, string(kind)); err != nil {
+				if errors.Is(err, database.ErrNotFound) {
+					return nil
+				}
+				return err
+			}
+		}
+		p.Action = ActionMarked
+	}
+	c.report.Problems = append(c.report.Problems, p)
+	return nil
+}
+
+// checkBlob returns the kind of problem with an image's blob, if any.
+func (c *checker) checkBlob(ctx context.Context, accountID, imageID string) (Kind, string, error) {
+	info, err := c.store.Stat(ctx, accountID, imageID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Missing, "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("checking %s/%s: %w", accountID, imageID, err)
+	}
+	if !c.opts.Verify {
+		return "", "", nil
+	}
+
+	rc, err := c.store.Retrieve(ctx, accountID, imageID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Missing, "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("reading %s/%s: %w", accountID, imageID, err)
+	}
+	defer rc.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, rc)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", "", ctx.Err()
+		}
+		return Corrupt, "unreadable: " + err.Error(), nil
+	}
+	// A blob whose digest is not recorded yet has nothing to match.
+	if sum := hex.EncodeToString(h.Sum(nil)); info.SHA256 != "" && sum != info.SHA256 {
+		return Corrupt, fmt.Sprintf("sha256 %s, recorded %s", sum, info.SHA256), nil
+	}
+	if n != info.Size {
+		return Corrupt, fmt.Sprintf("read %d bytes of %d", n, info.Size), nil
+	}
+	return "", "", nil
+}
+
+// checkOrphan handles a blob found without a record when the account's
+// records were listed.
+func (c *checker) checkOrphan(ctx context.Context, accountID, imageID string) error {
+	info, err := c.store.Stat(ctx, accountID, imageID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking %s/%s: %w", accountID, imageID, err)
+	}
+	if age := c.now.Sub(info.ModTime); age < c.opts.OrphanAge {
+		return nil
+	}
+	// The record may have been created since the listing.
+	if _, err := c.db.GetImage(ctx, accountID, imageID); err == nil {
+		return nil
+	} else if !errors.Is(err, database.ErrNotFound) {
+		return fmt.Errorf("checking record %s/%s: %w", accountID, imageID, err)
+	}
+
+	p := Problem{
+		Kind:      Orphaned,
+		AccountID: accountID,
+		ImageID:   imageID,
+		Detail:    fmt.Sprintf("%d bytes, stored %s", info.Size, info.ModTime.UTC().Format(time.RFC3339)),
+	}
+	if c.opts.Repair {
+		if !c.opts.DryRun {
+			if err := c.store.Delete(ctx, accountID, imageID); err != nil {
+				return fmt.Errorf("deleting %s/%s: %w", accountID, imageID, err)
+			}
+		}
+		p.Action = ActionDeleted
+	}
+	c.report.Problems = append(c.report.Problems, p)
+	return nil
+}
+
+// mark sets the broken mark of a record, unless this is a dry run.
+func (c *checker) mark(ctx context.Context, accountID, imageID, reason string) error {
+	if c.opts.DryRun {
+		return nil
+	}
+	if err := c.db.SetImageBroken(ctx, accountID, imageID, reason); err != nil {
+		return fmt.Errorf("marking %s/%s: %w", accountID, imageID, err)
+	}
+	return nil
+}
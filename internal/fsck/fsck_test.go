@@ -0,0 +1,210 @@
+package fsck
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addImage creates a record and, unless data is nil, stores its blob.
+func addImage(t *testing.T, db database.Database, store storage.Storage, accountID, imageID string, data []byte) {
+	t.Helper()
+	require.NoError(t, db.CreateImage(t.Context(), &model.Image{ID: imageID, AccountID: accountID, Uploaded: time.Now()}))
+	if data != nil {
+		_, err := store.Store(t.Context(), accountID, imageID, strings.NewReader(string(data)))
+		require.NoError(t, err)
+	}
+}
+
+// addBlob stores a blob without a record.
+func addBlob(t *testing.T, store storage.Storage, accountID, imageID string) {
+	t.Helper()
+	_, err := store.Store(t.Context(), accountID, imageID, strings.NewReader("orphan"))
+	require.NoError(t, err)
+}
+
+// problems returns the problems of r as strings, with their actions.
+func problems(r *Report) []string {
+	var out []string
+	for _, p := range r.Problems {
+		out = append(out, string(p.Kind)+" "+p.AccountID+"/"+p.ImageID+" "+p.Action)
+	}
+	return out
+}
+
+func TestCheck_Consistent(t *testing.T) {
+	db, store := database.NewMemoryDB(), storage.NewMemory(0)
+	addImage(t, db, store, "acct-1", "img-1", []byte("one"))
+	addImage(t, db, store, "acct-2", "img-2", []byte("two"))
+
+	report, err := Check(t.Context(), db, store, Options{Verify: true})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Images)
+	assert.Equal(t, 2, report.Blobs)
+	assert.Empty(t, report.Problems)
+	assert.True(t, report.Clean())
+}
+
+func TestCheck_ReportsWithoutRepairing(t *testing.T) {
+	db, store := database.NewMemoryDB(), storage.NewMemory(0)
+	addImage(t, db, store, "acct-1", "img-1", []byte("one"))
+	addImage(t, db, store, "acct-1", "img-2", nil)
+	addBlob(t, store, "acct-1", "img-3")
+	// An account whose only image is an orphan has no records at all.
+	addBlob(t, store, "acct-2", "img-4")
+
+	report, err := Check(t.Context(), db, store, Options{OrphanAge: time.Nanosecond})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"missing acct-1/img-2 ",
+		"orphaned acct-1/img-3 ",
+		"orphaned acct-2/img-4 ",
+	}, problems(report))
+	assert.False(t, report.Clean())
+
+	// Nothing changed.
+	exists, err := store.Exists(t.Context(), "acct-1", "img-3")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	img, err := db.GetImage(t.Context(), "acct-1", "img-2")
+	require.NoError(t, err)
+	assert.Empty(t, img.Broken)
+}
+
+func TestCheck_Repairs(t *testing.T) {
+	db, store := database.NewMemoryDB(), storage.NewMemory(0)
+	addImage(t, db, store, "acct-1", "img-1", nil)
+	addBlob(t, store, "acct-1", "img-2")
+
+	report, err := Check(t.Context(), db, store, Options{Repair: true, OrphanAge: time.Nanosecond})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"missing acct-1/img-1 marked", "orphaned acct-1/img-2 deleted"}, problems(report))
+	assert.True(t, report.Clean())
+
+	img, err := db.GetImage(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	assert.Equal(t, "missing", img.Broken)
+	exists, err := store.Exists(t.Context(), "acct-1", "img-2")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Once the blob is back, the mark is cleared.
+	_, err = store.Store(t.Context(), "acct-1", "img-1", strings.NewReader("restored"))
+	require.NoError(t, err)
+	report, err = Check(t.Context(), db, store, Options{Repair: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+	assert.Equal(t, 1, report.Cleared)
+	img, err = db.GetImage(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	assert.Empty(t, img.Broken)
+}
+
+func TestCheck_ReportsMarks(t *testing.T) {
+	db, store := database.NewMemoryDB(), storage.NewMemory(0)
+	addImage(t, db, store, "acct-1", "img-1", []byte("restored"))
+	addImage(t, db, store, "acct-1", "img-2", []byte("unverified"))
+	require.NoError(t, db.SetImageBroken(t.Context(), "acct-1", "img-1", "missing"))
+	require.NoError(t, db.SetImageBroken(t.Context(), "acct-1", "img-2", "corrupt"))
+
+	// Marked records are reported until a repair clears them.
+	report, err := Check(t.Context(), db, store, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"missing acct-1/img-1 ", "corrupt acct-1/img-2 "}, problems(report))
+	assert.False(t, report.Clean())
+
+	// A corrupt mark is only cleared once the blob has been read.
+	report, err = Check(t.Context(), db, store, Options{Repair: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"corrupt acct-1/img-2 marked"}, problems(report))
+	assert.Equal(t, 1, report.Cleared)
+	img, err := db.GetImage(t.Context(), "acct-1", "img-2")
+	require.NoError(t, err)
+	assert.Equal(t, "corrupt", img.Broken)
+
+	report, err = Check(t.Context(), db, store, Options{Repair: true, Verify: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+	assert.Equal(t, 1, report.Cleared)
+}
+
+func TestCheck_DryRun(t *testing.T) {
+	db, store := database.NewMemoryDB(), storage.NewMemory(0)
+	addImage(t, db, store, "acct-1", "img-1", nil)
+	addBlob(t, store, "acct-1", "img-2")
+
+	report, err := Check(t.Context(), db, store, Options{Repair: true, DryRun: true, OrphanAge: time.Nanosecond})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"missing acct-1/img-1 marked", "orphaned acct-1/img-2 deleted"}, problems(report))
+
+	img, err := db.GetImage(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	assert.Empty(t, img.Broken)
+	exists, err := store.Exists(t.Context(), "acct-1", "img-2")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestCheck_LeavesRecentBlobs(t *testing.T) {
+	db, store := database.NewMemoryDB(), storage.NewMemory(0)
+	// An upload in progress has stored its blob but not its record.
+	addBlob(t, store, "acct-1", "img-1")
+
+	report, err := Check(t.Context(), db, store, Options{Repair: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+	exists, err := store.Exists(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestCheck_Corrupt(t *testing.T) {
+	base := t.TempDir()
+	db, store := database.NewMemoryDB(), storage.NewFileSystem(base)
+	addImage(t, db, store, "acct-1", "img-1", []byte("intact"))
+	addImage(t, db, store, "acct-1", "img-2", []byte("intact"))
+
+	// Damage one original behind the store's back; derivatives and
+	// temporary files beside it are not blobs.
+	dirs, err := filepath.Glob(filepath.Join(base, "acct-1", "*", "*", "img-2"))
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+	dir := dirs[0]
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "original"), []byte("damaged"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "variant-abc.png"), []byte("derived"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "upload-123"), []byte("partial"), 0644))
+
+	// Only reading the blob finds the damage.
+	report, err := Check(t.Context(), db, store, Options{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	report, err = Check(t.Context(), db, store, Options{Repair: true, Verify: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"corrupt acct-1/img-2 marked"}, problems(report))
+	assert.Equal(t, 2, report.Blobs)
+	img, err := db.GetImage(t.Context(), "acct-1", "img-2")
+	require.NoError(t, err)
+	assert.Equal(t, "corrupt", img.Broken)
+}
+
+func TestJob_Close(t *testing.T) {
+	db, store := database.NewMemoryDB(), storage.NewMemory(0)
+	addImage(t, db, store, "acct-1", "img-1", nil)
+
+	j := StartJob(db, store, time.Millisecond, Options{Repair: true})
+	require.Eventually(t, func() bool {
+		img, err := db.GetImage(t.Context(), "acct-1", "img-1")
+		return err == nil && img.Broken == "missing"
+	}, time.Second, time.Millisecond)
+	j.Close()
+	j.Close()
+}
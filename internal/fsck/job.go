@@ -0,0 +1,63 @@
+package fsck
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+)
+
+// Job runs Check in the background at a fixed interval, logging each
+// problem and a summary of each run.
+type Job struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartJob starts a Job that first checks one interval from now.
+func StartJob(db database.Database, store storage.Storage, interval time.Duration, opts Options) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Job{cancel: cancel, done: make(chan struct{})}
+	go j.run(ctx, db, store, interval, opts)
+	return j
+}
+
+func (j *Job) run(ctx context.Context, db database.Database, store storage.Storage, interval time.Duration, opts Options) {
+	defer close(j.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := Check(ctx, db, store, opts)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				log.Printf("Fsck: check failed: %v", err)
+			}
+			continue
+		}
+		for _, p := range report.Problems {
+			if p.Action != ActionNone {
+				log.Printf("Fsck: %s (%s)", p, p.Action)
+			} else {
+				log.Printf("Fsck: %s", p)
+			}
+		}
+		log.Printf("Fsck: checked %d images and %d blobs: %d problems, %d marks cleared",
+			report.Images, report.Blobs, len(report.Problems), report.Cleared)
+	}
+}
+
+// Close stops the job, aborting a check in progress, and waits for it to
+// return.
+func (j *Job) Close() {
+	j.cancel()
+	<-j.done
+}
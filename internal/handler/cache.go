@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/leca/dt-cloudflare-images/internal/model"
+)
+
+// deliveryETag returns a strong ETag identifying the output of delivering
+// img with the given variant options. The same inputs always produce the
+// same tag, so clients can revalidate cached variants without the twin
+// reading the original or re-running the transform. The output format
+// follows from the original, which never changes for a given upload, so it
+// needs no part in the tag.
+func deliveryETag(img *model.Image, opts model.VariantOptions) string {
+	return computeETag(img.AccountID, img.ID, img.Uploaded.UTC().Format(time.RFC3339Nano),
+		opts.Fit, fmt.Sprint(opts.Width), fmt.Sprint(opts.Height), opts.Metadata)
+}
+
+// blobETag returns a strong ETag for the original bytes of img.
+func blobETag(img *model.Image) string {
+	return computeETag(img.AccountID, img.ID, img.Uploaded.UTC().Format(time.RFC3339Nano), "original")
+}
+
+// variantCacheKey returns the derivative cache key for a set of variant
+// options. Variants with identical options share cached outputs.
+func variantCacheKey(opts model.VariantOptions) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		opts.Fit, fmt.Sprint(opts.Width), fmt.Sprint(opts.Height), opts.Metadata,
+	}, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// computeETag hashes the given parts into a quoted ETag value.
+func computeETag(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// deliveryCacheControl returns the Cache-Control value Cloudflare sends for
+// delivered images, using the configured browser TTL.
+func (h *Handler) deliveryCacheControl() string {
+	return fmt.Sprintf("public, max-age=%d", h.browserTTL())
+}
+
+// blobCacheControl returns the Cache-Control value for the authenticated
+// blob endpoint. The response must not be stored by shared caches.
+func (h *Handler) blobCacheControl() string {
+	return fmt.Sprintf("private, max-age=%d", h.browserTTL())
+}
+
+func (h *Handler) browserTTL() int {
+	if h.Config.BrowserTTL < 0 {
+		return 0
+	}
+	return h.Config.BrowserTTL
+}
+
+// setCacheHeaders writes the validator and caching headers for a response.
+func setCacheHeaders(w http.ResponseWriter, etag string, modTime time.Time, cacheControl string) {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+}
+
+// notModified reports whether the request's conditional headers allow a 304
+// response. If-None-Match takes precedence over If-Modified-Since, as
+// required by RFC 9110.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatches(inm, etag)
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// HTTP dates have one-second resolution.
+		return !modTime.Truncate(time.Second).After(t)
+	}
+
+	return false
+}
+
+// etagListMatches performs the weak comparison used for If-None-Match
+// against a comma-separated list of entity tags.
+func etagListMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified sends a 304 response. The caching headers already set on
+// w are preserved; entity headers are dropped.
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/database"
+)
+
+// errInvalidToken is returned for continuation tokens that were not issued by
+// this server, were altered, or belong to a listing of another account or
+// with a different page size, sort order or filter set.
+var errInvalidToken = api.ErrInvalidContinuationToken
+
+// defaultCursorKey signs continuation tokens for handlers built without a
+// CursorKey. It is random, so such tokens do not survive a restart.
+var defaultCursorKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("handler: generating cursor key: " + err.Error())
+	}
+	return key
+}()
+
+// continuationToken is the signed payload of a V2 continuation token.
+type continuationToken struct {
+	// Cursor is the database cursor of the next page.
+	Cursor string `json:"c"`
+	// Account is the account whose images are listed.
+	Account string `json:"a"`
+	// PerPage is the page size of the listing.
+	PerPage int `json:"n"`
+	// Order is the sort order the cursor applies to.
+	Order string `json:"o"`
+	// Query is the digest of the creator and metadata filters the cursor
+	// was issued for.
+	Query string `json:"q"`
+}
+
+// cursorKey returns the key continuation tokens are signed with.
+func (h *Handler) cursorKey() []byte {
+	if len(h.CursorKey) > 0 {
+		return h.CursorKey
+	}
+	return defaultCursorKey
+}
+
+// encodeContinuationToken wraps a database cursor for the listing q of the
+// account in an opaque token: base64url(JSON payload) "." base64url(HMAC-SHA256
+// of the encoded payload). An empty cursor, marking the last page, stays
+// empty.
+func (h *Handler) encodeContinuationToken(accountID, cursor string, q database.ListV2Query) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	payload, err := json.Marshal(continuationToken{
+		Cursor:  cursor,
+		Account: accountID,
+		PerPage: q.PerPage,
+		Order:   q.SortOrder,
+		Query:   queryDigest(q),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(h.signCursor(encoded)), nil
+}
+
+// decodeContinuationToken returns the database cursor carried by token, which
+// must have been issued for the same account, and the same page size, sort
+// order and filters as q.
+func (h *Handler) decodeContinuationToken(accountID, token string, q database.ListV2Query) (string, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, h.signCursor(encoded)) {
+		return "", errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	var ct continuationToken
+	if err := json.Unmarshal(payload, &ct); err != nil || ct.Cursor == "" {
+		return "", errInvalidToken
+	}
+	if ct.Account != accountID || ct.PerPage != q.PerPage || ct.Order != q.SortOrder || ct.Query != queryDigest(q) {
+		return "", errInvalidToken
+	}
+	return ct.Cursor, nil
+}
+
+func (h *Handler) signCursor(encoded string) []byte {
+	m := hmac.New(sha256.New, h.cursorKey())
+	m.Write([]byte(encoded))
+	return m.Sum(nil)
+}
+
+// queryDigest identifies the filter set of a listing. Filters are compared in
+// the order given, which parseMetadataFilters keeps stable.
+func queryDigest(q database.ListV2Query) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// Encoding strings, float64s and bools cannot fail.
+	_ = enc.Encode(q.Creator)
+	for _, f := range q.Filters {
+		_ = enc.Encode(f)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
@@ -1,9 +1,12 @@
 package handler
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,25 +14,33 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/leca/dt-cloudflare-images/internal/api"
 	"github.com/leca/dt-cloudflare-images/internal/imageproc"
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
 )
 
-// DeliverImage handles GET /cdn/{account_id}/{image_id}/{variant_name} --
-// serves a transformed image, optionally enforcing signed URLs.
+// DeliverImage handles GET and HEAD /cdn/{account_id}/{image_id}/{variant_name} --
+// serves a transformed image, optionally enforcing signed URLs. Range
+// requests are served from the transformed output.
 func (h *Handler) DeliverImage(w http.ResponseWriter, r *http.Request) {
 	accountID := chi.URLParam(r, "account_id")
 	imageID := chi.URLParam(r, "image_id")
 	variantName := chi.URLParam(r, "variant_name")
 
-	img, err := h.DB.GetImage(accountID, imageID)
-	if err != nil || img == nil {
-		http.Error(w, "image not found", http.StatusNotFound)
+	img, err := h.DB.GetImage(r.Context(), accountID, imageID)
+	if err != nil {
+		writeDeliveryError(w, err, "image not found")
+		return
+	}
+	if img.Broken != "" {
+		writeDeliveryError(w, api.ErrImageBroken, "image original is unavailable")
 		return
 	}
 
-	variant, err := h.DB.GetVariant(accountID, variantName)
-	if err != nil || variant == nil {
-		http.Error(w, "variant not found", http.StatusNotFound)
+	variant, err := h.DB.GetVariant(r.Context(), accountID, variantName)
+	if err != nil {
+		writeDeliveryError(w, err, "variant not found")
 		return
 	}
 
@@ -41,26 +52,99 @@ func (h *Handler) DeliverImage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	rc, err := h.Store.Retrieve(accountID, imageID)
-	if err != nil {
-		http.Error(w, "image not found", http.StatusNotFound)
+	// Serve from the derivative cache when possible.
+	if h.Cache != nil {
+		if data, format, ok := h.Cache.Get(accountID, imageID, variantCacheKey(variant.Options)); ok {
+			h.serveDerivative(w, r, img, variant.Options, data, format, "HIT")
+			return
+		}
+	}
+
+	// The ETag comes from the record, so a conditional request is answered
+	// without reading the original.
+	etag := deliveryETag(img, variant.Options)
+	if notModified(r, etag, img.Uploaded) {
+		setCacheHeaders(w, etag, img.Uploaded, h.deliveryCacheControl())
+		w.Header().Set("cf-cache-status", "MISS")
+		writeNotModified(w)
 		return
 	}
-	defer rc.Close()
 
-	transformed, format, err := imageproc.Transform(rc, variant.Options)
-	if err != nil {
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+	transformed, format, err := renderVariant(r.Context(), h.Pool, h.Limits, h.Store, h.Cache, accountID, imageID, variant.Options)
+	var limitErr *imageproc.LimitError
+	switch {
+	case err == nil:
+	case errors.Is(err, imageproc.ErrSaturated):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, imageproc.ErrTimeout):
+		http.Error(w, "image processing timed out", http.StatusGatewayTimeout)
+		return
+	case errors.As(err, &limitErr):
+		// Like Cloudflare, report the rejected source in Cf-Resized.
+		w.Header().Set("Cf-Resized", fmt.Sprintf("err=%d", limitErr.Code))
+		http.Error(w, limitErr.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, context.Canceled):
+		// The client went away; nobody is listening.
+		return
+	default:
+		writeDeliveryError(w, err, "image not found")
 		return
 	}
 
-	ct := formatToContentType(format)
-	w.Header().Set("Content-Type", ct)
-	w.Header().Set("Content-Length", strconv.Itoa(len(transformed)))
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(transformed); err != nil {
-		log.Printf("DeliverImage: failed to write response: %v", err)
+	h.serveDerivative(w, r, img, variant.Options, transformed, format, "MISS")
+}
+
+// writeDeliveryError reports a failed lookup or render in DeliverImage, which
+// answers in plain text rather than with an API envelope.
+func writeDeliveryError(w http.ResponseWriter, err error, notFoundMsg string) {
+	if api.Classify(err).Status == http.StatusNotFound {
+		http.Error(w, notFoundMsg, http.StatusNotFound)
+		return
+	}
+	log.Printf("DeliverImage: %v", err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
+
+// renderVariant transforms the stored original of an image with opts, within
+// limits, and stores the output in cache, if non-nil. With a pool, the transform runs on
+// a pool worker and is shared with concurrent renders of the same output.
+func renderVariant(ctx context.Context, pool *imageproc.Pool, limits imageproc.Limits, store storage.Storage, cache *storage.DerivativeCache, accountID, imageID string, opts model.VariantOptions) ([]byte, string, error) {
+	key := variantCacheKey(opts)
+	render := func(ctx context.Context) ([]byte, string, error) {
+		rc, err := store.Retrieve(ctx, accountID, imageID)
+		if err != nil {
+			return nil, "", err
+		}
+		defer rc.Close()
+
+		data, format, err := imageproc.TransformWithLimits(ctx, rc, opts, limits)
+		if err != nil {
+			return nil, "", err
+		}
+		if cache != nil {
+			if err := cache.Put(accountID, imageID, key, format, data); err != nil {
+				log.Printf("renderVariant: failed to cache derivative: %v", err)
+			}
+		}
+		return data, format, nil
 	}
+
+	if pool == nil {
+		return render(ctx)
+	}
+	return pool.Do(ctx, accountID+"/"+imageID+"/"+key, render)
+}
+
+// serveDerivative writes a transformed image with its caching headers.
+// cacheStatus is reported in the cf-cache-status header.
+func (h *Handler) serveDerivative(w http.ResponseWriter, r *http.Request, img *model.Image, opts model.VariantOptions, data []byte, format, cacheStatus string) {
+	setCacheHeaders(w, deliveryETag(img, opts), img.Uploaded, h.deliveryCacheControl())
+	w.Header().Set("cf-cache-status", cacheStatus)
+	w.Header().Set("Content-Type", formatToContentType(format))
+	http.ServeContent(w, r, "", img.Uploaded, bytes.NewReader(data))
 }
 
 // verifySignature checks the sig and exp query parameters against the
@@ -85,7 +169,7 @@ func (h *Handler) verifySignature(r *http.Request, accountID, imageID, variantNa
 		return false
 	}
 
-	keys, err := h.DB.ListSigningKeys(accountID)
+	keys, err := h.DB.ListSigningKeys(r.Context(), accountID)
 	if err != nil || len(keys) == 0 {
 		return false
 	}
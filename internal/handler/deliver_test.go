@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -10,14 +11,19 @@ import (
 	"image/color"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/imageproc"
 	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -55,6 +61,7 @@ func signURL(keyValue, path, expStr string) string {
 func setupDeliverRouter(h *Handler) http.Handler {
 	r := chi.NewRouter()
 	r.Get("/cdn/{account_id}/{image_id}/{variant_name}", h.DeliverImage)
+	r.Head("/cdn/{account_id}/{image_id}/{variant_name}", h.DeliverImage)
 	return r
 }
 
@@ -68,7 +75,7 @@ func seedImageAndVariant(t *testing.T, h *Handler, imageID, variantName string,
 		RequireSignedURLs: requireSigned,
 		Uploaded:          time.Now().UTC(),
 	}
-	require.NoError(t, h.DB.CreateImage(img))
+	require.NoError(t, h.DB.CreateImage(t.Context(), img))
 
 	variant := &model.Variant{
 		ID:                     variantName,
@@ -76,9 +83,9 @@ func seedImageAndVariant(t *testing.T, h *Handler, imageID, variantName string,
 		Options:                model.VariantOptions{Fit: "scale-down", Width: 100, Height: 100, Metadata: "none"},
 		NeverRequireSignedURLs: neverRequireSigned,
 	}
-	require.NoError(t, h.DB.CreateVariant(variant))
+	require.NoError(t, h.DB.CreateVariant(t.Context(), variant))
 
-	_, err := h.Store.Store(testAccountID, imageID, bytes.NewReader(imgData))
+	_, err := h.Store.Store(t.Context(), testAccountID, imageID, bytes.NewReader(imgData))
 	require.NoError(t, err)
 }
 
@@ -124,7 +131,7 @@ func TestDeliverImage_ImageNotFound(t *testing.T) {
 		AccountID: testAccountID,
 		Options:   model.VariantOptions{Fit: "scale-down", Width: 100, Height: 100, Metadata: "none"},
 	}
-	require.NoError(t, h.DB.CreateVariant(variant))
+	require.NoError(t, h.DB.CreateVariant(t.Context(), variant))
 
 	req := httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/nonexistent/thumb", nil)
 	w := httptest.NewRecorder()
@@ -144,8 +151,8 @@ func TestDeliverImage_VariantNotFound(t *testing.T) {
 		Filename:  "test.jpg",
 		Uploaded:  time.Now().UTC(),
 	}
-	require.NoError(t, h.DB.CreateImage(img))
-	_, err := h.Store.Store(testAccountID, "img-3", bytes.NewReader(data))
+	require.NoError(t, h.DB.CreateImage(t.Context(), img))
+	_, err := h.Store.Store(t.Context(), testAccountID, "img-3", bytes.NewReader(data))
 	require.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-3/nonexistent", nil)
@@ -166,13 +173,13 @@ func TestDeliverImage_NoBlobInStorage(t *testing.T) {
 		Filename:  "test.jpg",
 		Uploaded:  time.Now().UTC(),
 	}
-	require.NoError(t, h.DB.CreateImage(img))
+	require.NoError(t, h.DB.CreateImage(t.Context(), img))
 	variant := &model.Variant{
 		ID:        "thumb",
 		AccountID: testAccountID,
 		Options:   model.VariantOptions{Fit: "scale-down", Width: 100, Height: 100, Metadata: "none"},
 	}
-	require.NoError(t, h.DB.CreateVariant(variant))
+	require.NoError(t, h.DB.CreateVariant(t.Context(), variant))
 
 	req := httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-4/thumb", nil)
 	w := httptest.NewRecorder()
@@ -181,6 +188,35 @@ func TestDeliverImage_NoBlobInStorage(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
+func TestDeliverImage_BrokenImage(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := chi.NewRouter()
+	router.Get("/cdn/{account_id}/{image_id}/{variant_name}", h.DeliverImage)
+	router.With(api.AccountIDMiddleware).Get("/accounts/{account_id}/images/v1/{image_id}/blob", h.GetImageBlob)
+
+	seedImageAndVariant(t, h, "img-23", "thumb", testJPEG(t), false, false)
+	require.NoError(t, h.DB.SetImageBroken(t.Context(), testAccountID, "img-23", "corrupt"))
+
+	// Neither delivery nor the blob endpoint reads the original.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-23/thumb", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "image original is unavailable\n", w.Body.String())
+	assert.Zero(t, h.Cache.Size())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/accounts/"+testAccountID+"/images/v1/img-23/blob", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `"message":"Image original is unavailable"`)
+
+	// Clearing the mark makes the image readable again.
+	require.NoError(t, h.DB.SetImageBroken(t.Context(), testAccountID, "img-23", ""))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-23/thumb", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
 func TestDeliverImage_SignedURL_Valid(t *testing.T) {
 	h := newTestHandler(t)
 	h.Config.EnforceSignedURLs = true
@@ -195,7 +231,7 @@ func TestDeliverImage_SignedURL_Valid(t *testing.T) {
 		Value:     "test-secret-key-value",
 		AccountID: testAccountID,
 	}
-	require.NoError(t, h.DB.CreateSigningKey(key))
+	require.NoError(t, h.DB.CreateSigningKey(t.Context(), key))
 
 	exp := time.Now().Add(time.Hour).Unix()
 	expStr := strconv.FormatInt(exp, 10)
@@ -224,7 +260,7 @@ func TestDeliverImage_SignedURL_Expired(t *testing.T) {
 		Value:     "test-secret-key-value",
 		AccountID: testAccountID,
 	}
-	require.NoError(t, h.DB.CreateSigningKey(key))
+	require.NoError(t, h.DB.CreateSigningKey(t.Context(), key))
 
 	// Expired 1 hour ago.
 	exp := time.Now().Add(-time.Hour).Unix()
@@ -253,7 +289,7 @@ func TestDeliverImage_SignedURL_WrongSignature(t *testing.T) {
 		Value:     "test-secret-key-value",
 		AccountID: testAccountID,
 	}
-	require.NoError(t, h.DB.CreateSigningKey(key))
+	require.NoError(t, h.DB.CreateSigningKey(t.Context(), key))
 
 	exp := time.Now().Add(time.Hour).Unix()
 	expStr := strconv.FormatInt(exp, 10)
@@ -280,7 +316,7 @@ func TestDeliverImage_SignedURL_MissingParams(t *testing.T) {
 		Value:     "test-secret-key-value",
 		AccountID: testAccountID,
 	}
-	require.NoError(t, h.DB.CreateSigningKey(key))
+	require.NoError(t, h.DB.CreateSigningKey(t.Context(), key))
 
 	// No sig or exp params.
 	path := fmt.Sprintf("/cdn/%s/img-8/thumb", testAccountID)
@@ -327,3 +363,319 @@ func TestDeliverImage_SignedURL_EnforcementOff(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
 }
+
+func TestDeliverImage_CacheHeaders(t *testing.T) {
+	h := newTestHandler(t)
+	h.Config.BrowserTTL = 3600
+	router := setupDeliverRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-11", "thumb", data, false, false)
+
+	req := httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-11/thumb", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+	assert.NotEmpty(t, w.Header().Get("Last-Modified"))
+	assert.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+
+	// A second request yields the same ETag.
+	w2 := httptest.NewRecorder()
+	router.ServeHTTP(w2, httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-11/thumb", nil))
+	assert.Equal(t, w.Header().Get("ETag"), w2.Header().Get("ETag"))
+}
+
+func TestDeliverImage_IfNoneMatch(t *testing.T) {
+	h := newTestHandler(t)
+	router := setupDeliverRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-12", "thumb", data, false, false)
+
+	path := "/cdn/" + testAccountID + "/img-12/thumb"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Empty(t, w.Body.Bytes())
+
+	// A stale ETag gets the full response.
+	req = httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Body.Bytes())
+}
+
+// countingStore counts the originals retrieved through it.
+type countingStore struct {
+	storage.Storage
+	retrieves atomic.Int64
+}
+
+func (s *countingStore) Retrieve(ctx context.Context, accountID, imageID string) (io.ReadCloser, error) {
+	s.retrieves.Add(1)
+	return s.Storage.Retrieve(ctx, accountID, imageID)
+}
+
+func TestDeliverImage_ReadsOriginalOncePerMiss(t *testing.T) {
+	h := newTestHandler(t)
+	store := &countingStore{Storage: h.Store}
+	h.Store = store
+	router := setupDeliverRouter(h)
+
+	seedImageAndVariant(t, h, "img-24", "thumb", testJPEG(t), false, false)
+
+	path := "/cdn/" + testAccountID + "/img-24/thumb"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), store.retrieves.Load())
+
+	// Revalidation does not read it at all.
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, int64(1), store.retrieves.Load())
+}
+
+func TestDeliverImage_ETagChangesWithVariantOptions(t *testing.T) {
+	h := newTestHandler(t)
+	router := setupDeliverRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-13", "thumb", data, false, false)
+
+	path := "/cdn/" + testAccountID + "/img-13/thumb"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	before := w.Header().Get("ETag")
+
+	variant, err := h.DB.GetVariant(t.Context(), testAccountID, "thumb")
+	require.NoError(t, err)
+	variant.Options.Width = 50
+	require.NoError(t, h.DB.UpdateVariant(t.Context(), variant))
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", before)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, before, w.Header().Get("ETag"))
+}
+
+func TestDeliverImage_IfModifiedSince(t *testing.T) {
+	h := newTestHandler(t)
+	router := setupDeliverRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-14", "thumb", data, false, false)
+
+	req := httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-14/thumb", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
+
+func TestDeliverImage_Head(t *testing.T) {
+	h := newTestHandler(t)
+	router := setupDeliverRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-15", "thumb", data, false, false)
+
+	path := "/cdn/" + testAccountID + "/img-15/thumb"
+	get := httptest.NewRecorder()
+	router.ServeHTTP(get, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusOK, get.Code)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodHead, path, nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(get.Body.Len()), w.Header().Get("Content-Length"))
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	assert.Empty(t, w.Body.Bytes())
+}
+
+func TestDeliverImage_Range(t *testing.T) {
+	h := newTestHandler(t)
+	router := setupDeliverRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-16", "thumb", data, false, false)
+
+	path := "/cdn/" + testAccountID + "/img-16/thumb"
+	full := httptest.NewRecorder()
+	router.ServeHTTP(full, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusOK, full.Code)
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Range", "bytes=0-9")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, fmt.Sprintf("bytes 0-9/%d", full.Body.Len()), w.Header().Get("Content-Range"))
+	assert.Equal(t, full.Body.Bytes()[:10], w.Body.Bytes())
+}
+
+// enableDerivativeCache attaches a derivative cache to the handler's filesystem store.
+func enableDerivativeCache(t *testing.T, h *Handler) {
+	t.Helper()
+	fs, ok := h.Store.(*storage.FileSystem)
+	require.True(t, ok)
+	h.Cache = storage.NewDerivativeCache(fs, 1<<20)
+}
+
+func TestDeliverImage_CacheStatus(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := setupDeliverRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-17", "thumb", data, false, false)
+
+	path := "/cdn/" + testAccountID + "/img-17/thumb"
+	first := httptest.NewRecorder()
+	router.ServeHTTP(first, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "MISS", first.Header().Get("cf-cache-status"))
+
+	second := httptest.NewRecorder()
+	router.ServeHTTP(second, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "HIT", second.Header().Get("cf-cache-status"))
+	assert.Equal(t, first.Body.Bytes(), second.Body.Bytes())
+	assert.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+	assert.Equal(t, "image/jpeg", second.Header().Get("Content-Type"))
+}
+
+func TestDeliverImage_CacheInvalidatedOnVariantUpdate(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := setupDeliverRouter(h)
+	variantRouter := setupVariantTestRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-18", "thumb", data, false, false)
+
+	path := "/cdn/" + testAccountID + "/img-18/thumb"
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+
+	req := httptest.NewRequest(http.MethodPatch, "/accounts/"+testAccountID+"/images/v1/variants/thumb",
+		bytes.NewBufferString(`{"options": {"width": 1}}`))
+	w := httptest.NewRecorder()
+	variantRouter.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(0), h.Cache.Size())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, "MISS", w.Header().Get("cf-cache-status"))
+}
+
+func TestDeliverImage_CacheInvalidatedOnVariantDelete(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := setupDeliverRouter(h)
+	variantRouter := setupVariantTestRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-19", "thumb", data, false, false)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-19/thumb", nil))
+	require.NotZero(t, h.Cache.Size())
+
+	w := httptest.NewRecorder()
+	variantRouter.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/accounts/"+testAccountID+"/images/v1/variants/thumb", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(0), h.Cache.Size())
+}
+
+func TestDeliverImage_CacheInvalidatedOnImageDelete(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := chi.NewRouter()
+	router.Get("/cdn/{account_id}/{image_id}/{variant_name}", h.DeliverImage)
+	router.With(api.AccountIDMiddleware).Delete("/accounts/{account_id}/images/v1/{image_id}", h.DeleteImage)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-20", "thumb", data, false, false)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-20/thumb", nil))
+	require.NotZero(t, h.Cache.Size())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/accounts/"+testAccountID+"/images/v1/img-20", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(0), h.Cache.Size())
+}
+
+func TestDeliverImage_PoolSaturated(t *testing.T) {
+	h := newTestHandler(t)
+	h.Pool = imageproc.NewPool(1, 0, time.Minute)
+	router := setupDeliverRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-21", "thumb", data, false, false)
+
+	// Occupy the only worker.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, _ = h.Pool.Do(context.Background(), "busy", func(context.Context) ([]byte, string, error) {
+			close(started)
+			<-release
+			return nil, "", nil
+		})
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-21/thumb", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	close(release)
+	<-done
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-21/thumb", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDeliverImage_SourceTooLarge(t *testing.T) {
+	h := newTestHandler(t)
+	h.Limits = imageproc.Limits{MaxDimension: 1}
+	router := setupDeliverRouter(h)
+
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-22", "thumb", data, false, false)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/img-22/thumb", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "err=9413", w.Header().Get("Cf-Resized"))
+	assert.Contains(t, w.Body.String(), "ERROR 9413")
+}
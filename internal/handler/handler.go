@@ -3,6 +3,8 @@ package handler
 import (
 	"github.com/leca/dt-cloudflare-images/internal/config"
 	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/fetch"
+	"github.com/leca/dt-cloudflare-images/internal/imageproc"
 	"github.com/leca/dt-cloudflare-images/internal/storage"
 )
 
@@ -11,4 +13,27 @@ type Handler struct {
 	DB     database.Database
 	Store  storage.Storage
 	Config *config.Config
+
+	// Cache stores transformed outputs for DeliverImage. Nil disables caching.
+	Cache *storage.DerivativeCache
+
+	// Warmer pre-renders variants after uploads and variant changes. Nil
+	// disables warming.
+	Warmer *Warmer
+
+	// Pool bounds concurrent transforms and de-duplicates identical renders.
+	// Nil runs every transform inline.
+	Pool *imageproc.Pool
+
+	// Limits bounds the size of images DeliverImage will transform. Zero
+	// fields take the imageproc defaults.
+	Limits imageproc.Limits
+
+	// Fetcher retrieves images for URL uploads. Nil uses an HTTP fetcher
+	// with default limits.
+	Fetcher fetch.Fetcher
+
+	// CursorKey signs V2 continuation tokens. Empty uses a random key
+	// generated at startup.
+	CursorKey []byte
 }
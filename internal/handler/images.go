@@ -1,9 +1,10 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -17,80 +18,72 @@ import (
 
 // buildVariantURLs constructs the variant URL list for an image by
 // querying all variants defined for the account.
-func (h *Handler) buildVariantURLs(accountID, imageID string) []string {
-	variants, err := h.DB.ListVariants(accountID)
-	if err != nil || len(variants) == 0 {
-		return []string{}
+func (h *Handler) buildVariantURLs(ctx context.Context, accountID, imageID string) []string {
+	return h.variantURLBuilder(ctx, accountID)(imageID)
+}
+
+// variantURLBuilder loads the variants of an account once and returns a
+// function constructing the variant URL list of any of its images. List
+// endpoints use it so that a page costs one variant query, not one per image.
+func (h *Handler) variantURLBuilder(ctx context.Context, accountID string) func(imageID string) []string {
+	variants, err := h.DB.ListVariants(ctx, accountID)
+	if err != nil {
+		log.Printf("variantURLBuilder: failed to list variants: %v", err)
+		variants = nil
 	}
-	urls := make([]string, 0, len(variants))
 	base := strings.TrimRight(h.Config.BaseURL, "/")
-	for _, v := range variants {
-		urls = append(urls, fmt.Sprintf("%s/cdn/%s/%s/%s", base, accountID, imageID, v.ID))
+	return func(imageID string) []string {
+		urls := make([]string, 0, len(variants))
+		for _, v := range variants {
+			urls = append(urls, fmt.Sprintf("%s/cdn/%s/%s/%s", base, accountID, imageID, v.ID))
+		}
+		return urls
 	}
-	return urls
 }
 
-// UploadImage handles POST /v1 -- multipart file upload or URL fetch.
-func (h *Handler) UploadImage(w http.ResponseWriter, r *http.Request) {
-	accountID := api.GetAccountID(r.Context())
+// maxCreatorLength is the longest creator Cloudflare accepts.
+const maxCreatorLength = 1024
 
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		api.BadRequest(w, "invalid multipart form: "+err.Error())
-		return
+// validateCreator checks a caller-supplied creator value.
+func validateCreator(creator string) error {
+	if len(creator) > maxCreatorLength {
+		return api.ErrInvalidCreator
 	}
+	return nil
+}
 
-	var (
-		reader   io.Reader
-		filename string
-	)
-
-	// Try file upload first.
-	file, header, err := r.FormFile("file")
-	if err == nil {
-		defer file.Close()
-		reader = file
-		filename = header.Filename
-	} else {
-		// Try URL fetch.
-		urlStr := r.FormValue("url")
-		if urlStr == "" {
-			api.BadRequest(w, "missing required field: file or url")
-			return
-		}
-		resp, err := http.Get(urlStr)
-		if err != nil {
-			api.BadRequest(w, "failed to fetch url: "+err.Error())
-			return
-		}
-		defer resp.Body.Close()
-		reader = resp.Body
-
-		// Derive filename from the URL path.
-		parts := strings.Split(urlStr, "/")
-		filename = parts[len(parts)-1]
-	}
+// UploadImage handles POST /v1 -- multipart file upload or URL fetch.
+func (h *Handler) UploadImage(w http.ResponseWriter, r *http.Request) {
+	accountID := api.GetAccountID(r.Context())
 
 	imageID := uuid.New().String()
 
-	// Store blob.
-	_, err = h.Store.Store(accountID, imageID, reader)
+	form, err := h.parseUploadForm(r, accountID, imageID)
 	if err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to store image: "+err.Error()))
+		api.WriteError(w, err)
 		return
 	}
 
-	// Parse optional metadata.
-	var meta map[string]interface{}
-	if metaStr := r.FormValue("metadata"); metaStr != "" {
-		if err := json.Unmarshal([]byte(metaStr), &meta); err != nil {
-			api.BadRequest(w, "invalid metadata JSON: "+err.Error())
-			return
+	if err := validateCreator(form.Creator); err != nil {
+		if form.Blob != nil {
+			h.discardBlob(r.Context(), accountID, imageID)
 		}
+		api.WriteError(w, err)
+		return
 	}
 
-	requireSigned := false
-	if v := r.FormValue("requireSignedURLs"); v == "true" {
-		requireSigned = true
+	filename := form.Filename
+	if form.Blob == nil {
+		// No file part; fetch from URL.
+		if form.URL == "" {
+			api.WriteError(w, api.ErrImageRequired)
+			return
+		}
+		fetched, ok := h.storeFromURL(w, r, accountID, imageID, form.URL)
+		if !ok {
+			return
+		}
+		filename = fetched
 	}
 
 	now := time.Now().UTC()
@@ -98,18 +91,23 @@ func (h *Handler) UploadImage(w http.ResponseWriter, r *http.Request) {
 		ID:                imageID,
 		AccountID:         accountID,
 		Filename:          filename,
-		Creator:           uuid.New().String(),
-		Meta:              meta,
-		RequireSignedURLs: requireSigned,
+		Creator:           form.Creator,
+		Meta:              form.Metadata,
+		RequireSignedURLs: form.RequireSignedURLs,
 		Uploaded:          now,
 	}
 
-	if err := h.DB.CreateImage(img); err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to create image record: "+err.Error()))
+	if err := h.DB.CreateImage(r.Context(), img); err != nil {
+		h.discardBlob(r.Context(), accountID, imageID)
+		api.WriteError(w, fmt.Errorf("failed to create image record: %w", err), api.ErrImageExists)
 		return
 	}
 
-	img.Variants = h.buildVariantURLs(accountID, imageID)
+	img.Variants = h.buildVariantURLs(r.Context(), accountID, imageID)
+
+	if h.Warmer != nil {
+		h.Warmer.WarmImage(accountID, imageID)
+	}
 
 	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(img))
 }
@@ -119,13 +117,13 @@ func (h *Handler) GetImage(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 	imageID := chi.URLParam(r, "image_id")
 
-	img, err := h.DB.GetImage(accountID, imageID)
+	img, err := h.DB.GetImage(r.Context(), accountID, imageID)
 	if err != nil {
-		api.NotFound(w, "image not found")
+		api.WriteError(w, err, api.ErrImageNotFound)
 		return
 	}
 
-	img.Variants = h.buildVariantURLs(accountID, img.ID)
+	img.Variants = h.buildVariantURLs(r.Context(), accountID, img.ID)
 	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(img))
 }
 
@@ -150,22 +148,12 @@ func (h *Handler) ListImages(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	images, total, err := h.DB.ListImages(accountID, page, perPage)
+	images, total, err := h.DB.ListImages(r.Context(), accountID, page, perPage)
 	if err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to list images"))
+		api.WriteError(w, fmt.Errorf("failed to list images: %w", err))
 		return
 	}
 
-	// Build variant URLs for each image.
-	for _, img := range images {
-		img.Variants = h.buildVariantURLs(accountID, img.ID)
-	}
-
-	// Ensure non-nil slice for JSON serialisation.
-	if images == nil {
-		images = []*model.Image{}
-	}
-
 	totalPages := 0
 	if perPage > 0 {
 		totalPages = (total + perPage - 1) / perPage
@@ -179,7 +167,16 @@ func (h *Handler) ListImages(w http.ResponseWriter, r *http.Request) {
 		TotalPages: totalPages,
 	}
 
-	api.WriteJSON(w, http.StatusOK, api.PaginatedResponse(map[string]interface{}{"images": images}, info))
+	// Pages hold up to 10,000 images, so the response is streamed.
+	variantURLs := h.variantURLBuilder(r.Context(), accountID)
+	lw := api.NewListWriter(w, http.StatusOK, "images")
+	for _, img := range images {
+		img.Variants = variantURLs(img.ID)
+		lw.Add(img)
+	}
+	if err := lw.Close(nil, &info); err != nil {
+		log.Printf("ListImages: failed to write response: %v", err)
+	}
 }
 
 // UpdateImage handles PATCH /v1/{image_id}.
@@ -187,18 +184,19 @@ func (h *Handler) UpdateImage(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 	imageID := chi.URLParam(r, "image_id")
 
-	img, err := h.DB.GetImage(accountID, imageID)
+	img, err := h.DB.GetImage(r.Context(), accountID, imageID)
 	if err != nil {
-		api.NotFound(w, "image not found")
+		api.WriteError(w, err, api.ErrImageNotFound)
 		return
 	}
 
 	var body struct {
 		Metadata          *map[string]interface{} `json:"metadata"`
 		RequireSignedURLs *bool                   `json:"requireSignedURLs"`
+		Creator           *string                 `json:"creator"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		api.BadRequest(w, "invalid JSON body: "+err.Error())
+		api.WriteError(w, api.ErrInvalidJSON)
 		return
 	}
 
@@ -208,13 +206,20 @@ func (h *Handler) UpdateImage(w http.ResponseWriter, r *http.Request) {
 	if body.RequireSignedURLs != nil {
 		img.RequireSignedURLs = *body.RequireSignedURLs
 	}
+	if body.Creator != nil {
+		if err := validateCreator(*body.Creator); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		img.Creator = *body.Creator
+	}
 
-	if err := h.DB.UpdateImage(img); err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to update image"))
+	if err := h.DB.UpdateImage(r.Context(), img); err != nil {
+		api.WriteError(w, fmt.Errorf("failed to update image: %w", err))
 		return
 	}
 
-	img.Variants = h.buildVariantURLs(accountID, img.ID)
+	img.Variants = h.buildVariantURLs(r.Context(), accountID, img.ID)
 	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(img))
 }
 
@@ -223,13 +228,17 @@ func (h *Handler) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 	imageID := chi.URLParam(r, "image_id")
 
-	if err := h.DB.DeleteImage(accountID, imageID); err != nil {
-		api.NotFound(w, "image not found")
+	if err := h.DB.DeleteImage(r.Context(), accountID, imageID); err != nil {
+		api.WriteError(w, err, api.ErrImageNotFound)
 		return
 	}
 
-	// Also delete the blob (best-effort).
-	_ = h.Store.Delete(accountID, imageID)
+	// Also delete the blob and any cached derivatives (best-effort). The
+	// record is gone, so this finishes even if the client has disconnected.
+	if h.Cache != nil {
+		h.Cache.InvalidateImage(accountID, imageID)
+	}
+	_ = h.Store.Delete(context.WithoutCancel(r.Context()), accountID, imageID)
 
 	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(struct{}{}))
 }
@@ -238,9 +247,9 @@ func (h *Handler) DeleteImage(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 
-	count, err := h.DB.CountImages(accountID)
+	count, err := h.DB.CountImages(r.Context(), accountID)
 	if err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to count images"))
+		api.WriteError(w, fmt.Errorf("failed to count images: %w", err))
 		return
 	}
 
@@ -1,54 +1,112 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"io"
-	"log"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
 )
 
-// GetImageBlob handles GET /v1/{image_id}/blob -- streams the original image bytes.
+// GetImageBlob handles GET and HEAD /v1/{image_id}/blob -- serves the original
+// image bytes, honouring conditional and Range requests. Only the bytes a
+// response needs are read from storage.
 func (h *Handler) GetImageBlob(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 	imageID := chi.URLParam(r, "image_id")
 
 	// Verify image record exists.
-	img, err := h.DB.GetImage(accountID, imageID)
-	if err != nil || img == nil {
-		api.NotFound(w, "image not found")
+	img, err := h.DB.GetImage(r.Context(), accountID, imageID)
+	if err != nil {
+		api.WriteError(w, err, api.ErrImageNotFound)
 		return
 	}
-
-	rc, err := h.Store.Retrieve(accountID, imageID)
-	if err != nil {
-		api.NotFound(w, "image blob not found")
+	if img.Broken != "" {
+		api.WriteError(w, api.ErrImageBroken)
 		return
 	}
-	defer rc.Close()
 
-	// Read up to 512 bytes for content-type detection.
-	buf := make([]byte, 512)
-	n, err := io.ReadAtLeast(rc, buf, 1)
+	info, err := h.Store.Stat(r.Context(), accountID, imageID)
 	if err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to read image"))
+		api.WriteError(w, err, api.ErrImageNotFound)
 		return
 	}
-	buf = buf[:n]
-
-	contentType := http.DetectContentType(buf)
+	content := &blobReader{
+		ctx:       r.Context(),
+		store:     h.Store,
+		accountID: accountID,
+		imageID:   imageID,
+		size:      info.Size,
+	}
+	defer content.Close()
 
-	w.Header().Set("Content-Type", contentType)
+	setCacheHeaders(w, blobETag(img), img.Uploaded, h.blobCacheControl())
 	w.Header().Set("Content-Disposition", "inline; filename=\""+img.Filename+"\"")
-	w.WriteHeader(http.StatusOK)
 
-	// Write the already-read bytes first, then stream the rest.
-	if _, err := w.Write(buf); err != nil {
-		log.Printf("GetImageBlob: failed to write response: %v", err)
-		return
+	// ServeContent sniffs the Content-Type, evaluates If-None-Match and
+	// If-Modified-Since against the headers set above, sets Content-Length
+	// from the size, and handles HEAD and Range requests.
+	http.ServeContent(w, r, "", img.Uploaded, content)
+}
+
+// blobReader is an io.ReadSeeker over a stored original of known size. It
+// opens a ranged read from the current offset on the first Read after a
+// Seek, so seeking costs nothing and only the bytes read are fetched.
+type blobReader struct {
+	ctx                context.Context
+	store              storage.Storage
+	accountID, imageID string
+	size               int64
+
+	offset int64
+	rc     io.ReadCloser // open from offset; nil until read
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.rc == nil {
+		rc, err := b.store.RetrieveRange(b.ctx, b.accountID, b.imageID, b.offset, b.size-b.offset)
+		if err != nil {
+			return 0, err
+		}
+		b.rc = rc
+	}
+	n, err := b.rc.Read(p)
+	b.offset += int64(n)
+	if err == io.EOF && b.offset < b.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, errors.New("blob: negative position")
+	}
+	if offset != b.offset {
+		b.Close()
+		b.offset = offset
 	}
-	if _, err := io.Copy(w, rc); err != nil {
-		log.Printf("GetImageBlob: failed to stream response: %v", err)
+	return offset, nil
+}
+
+// Close closes the open ranged read, if any.
+func (b *blobReader) Close() error {
+	if b.rc == nil {
+		return nil
 	}
+	err := b.rc.Close()
+	b.rc = nil
+	return err
 }
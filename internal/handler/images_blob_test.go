@@ -13,7 +13,7 @@ func TestGetImageBlob(t *testing.T) {
 	ts := testServer(t)
 	defer ts.Close()
 
-	content := []byte("fake-png-image-blob-content-for-testing")
+	content := fakePNG("fake-png-image-blob-content-for-testing")
 	uploaded := uploadAndDecode(t, ts, content, "photo.png")
 
 	req := authReq("GET", baseURL(ts)+"/"+uploaded.ID+"/blob", nil)
@@ -22,6 +22,7 @@ func TestGetImageBlob(t *testing.T) {
 	defer resp.Body.Close()
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(content)), resp.ContentLength)
 
 	body, err := io.ReadAll(resp.Body)
 	require.NoError(t, err)
@@ -43,3 +44,106 @@ func TestGetImageBlob_NotFound(t *testing.T) {
 
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 }
+
+func TestGetImageBlob_ConditionalRequest(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	uploaded := uploadAndDecode(t, ts, fakePNG("conditional-blob-content"), "photo.png")
+
+	req := authReq("GET", baseURL(ts)+"/"+uploaded.ID+"/blob", nil)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+	assert.Contains(t, resp.Header.Get("Cache-Control"), "private")
+
+	req = authReq("GET", baseURL(ts)+"/"+uploaded.ID+"/blob", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+}
+
+func TestGetImageBlob_Range(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	content := fakePNG("0123456789ab")
+	uploaded := uploadAndDecode(t, ts, content, "photo.png")
+
+	req := authReq("GET", baseURL(ts)+"/"+uploaded.ID+"/blob", nil)
+	req.Header.Set("Range", "bytes=10-")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 10-19/20", resp.Header.Get("Content-Range"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content[10:], body)
+}
+
+func TestGetImageBlob_MiddleRange(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	content := fakePNG("0123456789ab")
+	uploaded := uploadAndDecode(t, ts, content, "photo.png")
+
+	req := authReq("GET", baseURL(ts)+"/"+uploaded.ID+"/blob", nil)
+	req.Header.Set("Range", "bytes=5-9")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 5-9/20", resp.Header.Get("Content-Range"))
+	assert.Equal(t, int64(5), resp.ContentLength)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content[5:10], body)
+}
+
+func TestGetImageBlob_RangeNotSatisfiable(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	uploaded := uploadAndDecode(t, ts, fakePNG("short"), "photo.png")
+
+	req := authReq("GET", baseURL(ts)+"/"+uploaded.ID+"/blob", nil)
+	req.Header.Set("Range", "bytes=100-200")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+}
+
+func TestGetImageBlob_Head(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	content := fakePNG("head-request-content")
+	uploaded := uploadAndDecode(t, ts, content, "photo.png")
+
+	req := authReq("HEAD", baseURL(ts)+"/"+uploaded.ID+"/blob", nil)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(content)), resp.ContentLength)
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
+}
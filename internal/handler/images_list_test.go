@@ -0,0 +1,166 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/config"
+	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/handler"
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingDB counts the ListVariants queries made through it.
+type countingDB struct {
+	database.Database
+	listVariants atomic.Int64
+}
+
+func (db *countingDB) ListVariants(ctx context.Context, accountID string) ([]*model.Variant, error) {
+	db.listVariants.Add(1)
+	return db.Database.ListVariants(ctx, accountID)
+}
+
+// setupListTest returns a router serving both list endpoints over a database
+// seeded with images and variants.
+func setupListTest(tb testing.TB, images, variants int) (*countingDB, http.Handler) {
+	tb.Helper()
+
+	sqlDB, err := database.NewSQLiteDB(filepath.Join(tb.TempDir(), "list.db"))
+	require.NoError(tb, err)
+	tb.Cleanup(func() { sqlDB.Close() })
+
+	base := time.Now().UTC()
+	for i := 0; i < images; i++ {
+		require.NoError(tb, sqlDB.CreateImage(tb.Context(), &model.Image{
+			ID:        fmt.Sprintf("img-%05d", i),
+			AccountID: testAccountID,
+			Filename:  fmt.Sprintf("img-%05d.jpg", i),
+			Uploaded:  base.Add(time.Duration(i) * time.Second),
+		}))
+	}
+	for i := 0; i < variants; i++ {
+		require.NoError(tb, sqlDB.CreateVariant(tb.Context(), &model.Variant{
+			ID:        fmt.Sprintf("variant-%d", i),
+			AccountID: testAccountID,
+			Options:   model.VariantOptions{Fit: "scale-down", Width: 100, Height: 100, Metadata: "none"},
+		}))
+	}
+
+	db := &countingDB{Database: sqlDB}
+	h := &handler.Handler{
+		DB:     db,
+		Store:  storage.NewFileSystem(tb.TempDir()),
+		Config: &config.Config{BaseURL: "http://localhost:8080"},
+	}
+
+	r := chi.NewRouter()
+	r.Route("/accounts/{account_id}/images", func(r chi.Router) {
+		r.Use(api.AccountIDMiddleware)
+		r.Get("/v1", h.ListImages)
+		r.Get("/v2", h.ListImagesV2)
+	})
+	return db, r
+}
+
+func TestListEndpoints_LoadVariantsOnce(t *testing.T) {
+	db, router := setupListTest(t, 50, 3)
+
+	for _, path := range []string{"/v1?per_page=50", "/v2?per_page=50"} {
+		t.Run(path, func(t *testing.T) {
+			db.listVariants.Store(0)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/accounts/"+testAccountID+"/images"+path, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, int64(1), db.listVariants.Load())
+
+			var env envelope
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &env))
+			assert.True(t, env.Success)
+			assert.NotNil(t, env.Errors)
+
+			var result struct {
+				Images []imageResult `json:"images"`
+			}
+			require.NoError(t, json.Unmarshal(env.Result, &result))
+			require.Len(t, result.Images, 50)
+			assert.Equal(t, []string{
+				"http://localhost:8080/cdn/" + testAccountID + "/img-00049/variant-0",
+				"http://localhost:8080/cdn/" + testAccountID + "/img-00049/variant-1",
+				"http://localhost:8080/cdn/" + testAccountID + "/img-00049/variant-2",
+			}, result.Images[49].Variants)
+		})
+	}
+}
+
+func TestListImages_StreamedEnvelope(t *testing.T) {
+	_, router := setupListTest(t, 3, 0)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/accounts/"+testAccountID+"/images/v1?per_page=2&page=2", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var env paginatedEnvelope
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &env))
+	assert.True(t, env.Success)
+	assert.Equal(t, 2, env.ResultInfo.Page)
+	assert.Equal(t, 1, env.ResultInfo.Count)
+	assert.Equal(t, 3, env.ResultInfo.TotalCount)
+	assert.Equal(t, 2, env.ResultInfo.TotalPages)
+
+	var result struct {
+		Images []imageResult `json:"images"`
+	}
+	require.NoError(t, json.Unmarshal(env.Result, &result))
+	require.Len(t, result.Images, 1)
+	assert.Equal(t, []string{}, result.Images[0].Variants)
+}
+
+// BenchmarkListImages lists a page of 10,000 images with 10 variants.
+// "per-image" reproduces the former behaviour of one ListVariants query per
+// image and a fully buffered response; "handler" is ListImages.
+func BenchmarkListImages(b *testing.B) {
+	db, router := setupListTest(b, 10000, 10)
+	path := "/accounts/" + testAccountID + "/images/v1?per_page=10000"
+
+	b.Run("per-image", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			images, _, err := db.ListImages(b.Context(), testAccountID, 1, 10000)
+			require.NoError(b, err)
+			for _, img := range images {
+				variants, err := db.ListVariants(b.Context(), testAccountID)
+				require.NoError(b, err)
+				img.Variants = make([]string, 0, len(variants))
+				for _, v := range variants {
+					img.Variants = append(img.Variants, "http://localhost:8080/cdn/"+testAccountID+"/"+img.ID+"/"+v.ID)
+				}
+			}
+			api.WriteJSON(httptest.NewRecorder(), http.StatusOK,
+				api.PaginatedResponse(map[string]interface{}{"images": images}, api.ResultInfo{}))
+		}
+	})
+
+	b.Run("handler", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			if w.Code != http.StatusOK {
+				b.Fatalf("status %d", w.Code)
+			}
+		}
+	})
+}
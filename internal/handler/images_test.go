@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/leca/dt-cloudflare-images/internal/config"
@@ -23,20 +24,25 @@ const (
 	testAccountID = "test-account"
 )
 
-// testServer creates a test HTTP server backed by in-memory SQLite
+// testServer creates a test HTTP server backed by an in-memory database
 // and a temporary filesystem storage directory.
 func testServer(t *testing.T) *httptest.Server {
 	t.Helper()
 
-	db, err := database.NewSQLiteDB("file::memory:?cache=shared")
-	require.NoError(t, err)
-	t.Cleanup(func() { db.Close() })
-
 	tmpDir, err := os.MkdirTemp("", "dt-images-test-*")
 	require.NoError(t, err)
 	t.Cleanup(func() { os.RemoveAll(tmpDir) })
 
-	store := storage.NewFileSystem(tmpDir)
+	return testServerWithStore(t, storage.NewFileSystem(tmpDir))
+}
+
+// testServerWithStore creates a test HTTP server backed by an in-memory
+// database and store.
+func testServerWithStore(t *testing.T, store storage.Storage) *httptest.Server {
+	t.Helper()
+
+	db := database.NewMemoryDB()
+	t.Cleanup(func() { db.Close() })
 
 	cfg := &config.Config{
 		AuthToken:      testToken,
@@ -107,12 +113,19 @@ type paginatedEnvelope struct {
 type imageResult struct {
 	ID                string                 `json:"id"`
 	Filename          string                 `json:"filename"`
+	Creator           string                 `json:"creator"`
 	Meta              map[string]interface{} `json:"meta"`
 	RequireSignedURLs bool                   `json:"requireSignedURLs"`
 	Variants          []string               `json:"variants"`
 	Draft             bool                   `json:"draft"`
 }
 
+// fakePNG returns a PNG signature followed by body: enough to pass the
+// upload's format check, though not a decodable image.
+func fakePNG(body string) []byte {
+	return append([]byte("\x89PNG\r\n\x1a\n"), body...)
+}
+
 // uploadFile is a helper that uploads a file and returns the response.
 func uploadFile(t *testing.T, ts *httptest.Server, content []byte, fileName string) *http.Response {
 	t.Helper()
@@ -145,7 +158,7 @@ func TestUploadImage_File(t *testing.T) {
 	ts := testServer(t)
 	defer ts.Close()
 
-	content := []byte("fake-image-data")
+	content := fakePNG("fake-image-data")
 	img := uploadAndDecode(t, ts, content, "photo.png")
 
 	assert.NotEmpty(t, img.ID)
@@ -171,11 +184,37 @@ func TestUploadImage_MissingFile(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
 
+func TestUploadImage_StorageFull(t *testing.T) {
+	store := storage.NewMemory(16)
+	ts := testServerWithStore(t, store)
+	defer ts.Close()
+
+	resp := uploadFile(t, ts, bytes.Repeat([]byte("x"), 1024), "big.png")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var env struct {
+		Errors []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	decodeResponse(t, resp, &env)
+	require.Len(t, env.Errors, 1)
+	assert.Equal(t, 5400, env.Errors[0].Code)
+	assert.Equal(t, "Bad request: storage limit exceeded", env.Errors[0].Message)
+
+	// The rejected upload left no image behind.
+	resp, err := http.DefaultClient.Do(authReq("GET", baseURL(ts), nil))
+	require.NoError(t, err)
+	var list paginatedEnvelope
+	decodeResponse(t, resp, &list)
+	assert.Equal(t, 0, list.ResultInfo.TotalCount)
+}
+
 func TestGetImage(t *testing.T) {
 	ts := testServer(t)
 	defer ts.Close()
 
-	uploaded := uploadAndDecode(t, ts, []byte("data"), "test.jpg")
+	uploaded := uploadAndDecode(t, ts, fakePNG("data"), "test.jpg")
 
 	req := authReq("GET", baseURL(ts)+"/"+uploaded.ID, nil)
 	resp, err := http.DefaultClient.Do(req)
@@ -208,9 +247,9 @@ func TestListImages(t *testing.T) {
 	defer ts.Close()
 
 	// Upload a few images.
-	uploadAndDecode(t, ts, []byte("img1"), "a.png")
-	uploadAndDecode(t, ts, []byte("img2"), "b.png")
-	uploadAndDecode(t, ts, []byte("img3"), "c.png")
+	uploadAndDecode(t, ts, fakePNG("img1"), "a.png")
+	uploadAndDecode(t, ts, fakePNG("img2"), "b.png")
+	uploadAndDecode(t, ts, fakePNG("img3"), "c.png")
 
 	req := authReq("GET", baseURL(ts), nil)
 	resp, err := http.DefaultClient.Do(req)
@@ -235,7 +274,7 @@ func TestListImages_Pagination(t *testing.T) {
 
 	// Upload 5 images.
 	for i := 0; i < 5; i++ {
-		uploadAndDecode(t, ts, []byte("img"), "img.png")
+		uploadAndDecode(t, ts, fakePNG("img"), "img.png")
 	}
 
 	// Request page 1 with per_page=2.
@@ -265,7 +304,7 @@ func TestUpdateImage(t *testing.T) {
 	ts := testServer(t)
 	defer ts.Close()
 
-	uploaded := uploadAndDecode(t, ts, []byte("data"), "original.png")
+	uploaded := uploadAndDecode(t, ts, fakePNG("data"), "original.png")
 
 	updateBody := `{"metadata":{"key":"value"},"requireSignedURLs":true}`
 	req := authReq("PATCH", baseURL(ts)+"/"+uploaded.ID, bytes.NewBufferString(updateBody))
@@ -283,11 +322,69 @@ func TestUpdateImage(t *testing.T) {
 	assert.Equal(t, "value", img.Meta["key"])
 }
 
+func TestUploadImage_Creator(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	fw, err := w.CreateFormFile("file", "photo.png")
+	require.NoError(t, err)
+	_, err = fw.Write(fakePNG("data"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteField("creator", "user-42"))
+	require.NoError(t, w.Close())
+
+	req := authReq("POST", baseURL(ts), &buf)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	var env envelope
+	decodeResponse(t, resp, &env)
+	require.True(t, env.Success)
+	var img imageResult
+	require.NoError(t, json.Unmarshal(env.Result, &img))
+	assert.Equal(t, "user-42", img.Creator)
+
+	// Without a creator the field is empty.
+	plain := uploadAndDecode(t, ts, fakePNG("data"), "plain.png")
+	assert.Empty(t, plain.Creator)
+}
+
+func TestUpdateImage_Creator(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	uploaded := uploadAndDecode(t, ts, fakePNG("data"), "original.png")
+
+	req := authReq("PATCH", baseURL(ts)+"/"+uploaded.ID, bytes.NewBufferString(`{"creator":"user-7"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	var env envelope
+	decodeResponse(t, resp, &env)
+	require.True(t, env.Success)
+	var img imageResult
+	require.NoError(t, json.Unmarshal(env.Result, &img))
+	assert.Equal(t, "user-7", img.Creator)
+
+	// Over-long creators are rejected.
+	long := `{"creator":"` + strings.Repeat("x", 1025) + `"}`
+	req = authReq("PATCH", baseURL(ts)+"/"+uploaded.ID, bytes.NewBufferString(long))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
 func TestDeleteImage(t *testing.T) {
 	ts := testServer(t)
 	defer ts.Close()
 
-	uploaded := uploadAndDecode(t, ts, []byte("data"), "to-delete.png")
+	uploaded := uploadAndDecode(t, ts, fakePNG("data"), "to-delete.png")
 
 	req := authReq("DELETE", baseURL(ts)+"/"+uploaded.ID, nil)
 	resp, err := http.DefaultClient.Do(req)
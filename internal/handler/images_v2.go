@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,58 +15,114 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/database"
 	"github.com/leca/dt-cloudflare-images/internal/model"
 )
 
-// metadataFilter represents a single metadata filter parsed from query params.
-type metadataFilter struct {
-	Key   string
-	Op    string
-	Value string
-}
+// maxMetadataFilters is the number of metadata filters a V2 listing accepts.
+const maxMetadataFilters = 5
 
 // parseMetadataFilters extracts metadata filters from query parameters.
 // Filters have the form metadata[key][op]=value where op is one of:
-// eq, ne, lt, gt, lte, gte.
-func parseMetadataFilters(r *http.Request) ([]metadataFilter, error) {
-	var filters []metadataFilter
-
-	for param, values := range r.URL.Query() {
-		if !strings.HasPrefix(param, "metadata[") {
-			continue
+// eq, ne, lt, gt, lte, gte, in. Nested keys are addressed either as
+// metadata[a][b][op] or metadata[a.b][op].
+//
+// Values are typed: true and false are booleans, anything strconv.ParseFloat
+// accepts is a number, and anything else -- or a JSON-quoted string such as
+// "42" -- is a string. An in value is a JSON array or a comma-separated list.
+func parseMetadataFilters(r *http.Request) ([]database.MetadataFilter, error) {
+	query := r.URL.Query()
+	params := make([]string, 0, len(query))
+	for param := range query {
+		if strings.HasPrefix(param, "metadata[") {
+			params = append(params, param)
 		}
+	}
+	sort.Strings(params)
 
-		// Parse metadata[key][op] format.
-		rest := strings.TrimPrefix(param, "metadata[")
-		closeBracket := strings.Index(rest, "]")
-		if closeBracket < 0 {
-			continue
+	var filters []database.MetadataFilter
+	for _, param := range params {
+		segments, ok := bracketSegments(strings.TrimPrefix(param, "metadata"))
+		if !ok || len(segments) < 2 {
+			return nil, fmt.Errorf("malformed metadata filter: %s", param)
+		}
+		key := strings.Join(segments[:len(segments)-1], ".")
+		op := segments[len(segments)-1]
+
+		raw := query.Get(param)
+		var values []interface{}
+		if op == "in" {
+			var err error
+			if values, err = parseFilterList(raw); err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %w", param, err)
+			}
+		} else {
+			values = []interface{}{parseFilterValue(raw)}
 		}
-		key := rest[:closeBracket]
-		rest = rest[closeBracket+1:]
 
-		if !strings.HasPrefix(rest, "[") || !strings.HasSuffix(rest, "]") {
-			continue
+		f := database.MetadataFilter{Key: key, Op: op, Values: values}
+		if err := f.Validate(); err != nil {
+			return nil, err
 		}
-		op := rest[1 : len(rest)-1]
+		filters = append(filters, f)
+	}
 
-		switch op {
-		case "eq", "ne", "lt", "gt", "lte", "gte":
-			// valid
-		default:
-			return nil, fmt.Errorf("unsupported metadata filter operator: %s", op)
+	return filters, nil
+}
+
+// bracketSegments splits "[a][b][c]" into a, b and c.
+func bracketSegments(s string) ([]string, bool) {
+	var segments []string
+	for s != "" {
+		if s[0] != '[' {
+			return nil, false
+		}
+		end := strings.IndexByte(s, ']')
+		if end < 2 {
+			return nil, false
 		}
+		segments = append(segments, s[1:end])
+		s = s[end+1:]
+	}
+	return segments, true
+}
 
-		if len(values) > 0 {
-			filters = append(filters, metadataFilter{
-				Key:   key,
-				Op:    op,
-				Value: values[0],
-			})
+// parseFilterValue types a single filter value.
+func parseFilterValue(raw string) interface{} {
+	switch raw {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	// NaN and infinities, which JSON cannot hold, are matched as strings.
+	if n, err := strconv.ParseFloat(raw, 64); err == nil && !math.IsNaN(n) && !math.IsInf(n, 0) {
+		return n
+	}
+	if len(raw) >= 2 && raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal([]byte(raw), &s); err == nil {
+			return s
 		}
 	}
+	return raw
+}
 
-	return filters, nil
+// parseFilterList parses the value of an in filter.
+func parseFilterList(raw string) ([]interface{}, error) {
+	if strings.HasPrefix(raw, "[") {
+		var values []interface{}
+		if err := json.Unmarshal([]byte(raw), &values); err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+	parts := strings.Split(raw, ",")
+	values := make([]interface{}, len(parts))
+	for i, part := range parts {
+		values[i] = parseFilterValue(strings.TrimSpace(part))
+	}
+	return values, nil
 }
 
 // ListImagesV2 handles GET /v2 -- cursor-based pagination with optional metadata filtering.
@@ -89,51 +148,57 @@ func (h *Handler) ListImagesV2(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Parse continuation_token (cursor).
-	cursor := r.URL.Query().Get("continuation_token")
+	// Parse creator filter.
+	creator := r.URL.Query().Get("creator")
 
 	// Parse metadata filters.
 	filters, err := parseMetadataFilters(r)
 	if err != nil {
-		api.BadRequest(w, err.Error())
+		api.WriteError(w, api.ErrBadRequest.WithDetail(err.Error()))
 		return
 	}
-	if len(filters) > 5 {
-		api.BadRequest(w, "too many metadata filters (max 5)")
+	if len(filters) > maxMetadataFilters {
+		api.WriteError(w, api.ErrTooManyMetadataFilters)
 		return
 	}
 
-	var images []*model.Image
-	var nextCursor string
+	q := database.ListV2Query{
+		PerPage:   perPage,
+		SortOrder: sortOrder,
+		Creator:   creator,
+		Filters:   filters,
+	}
 
-	if len(filters) > 0 {
-		// Use first filter only for now.
-		f := filters[0]
-		images, nextCursor, err = h.DB.ListImagesWithFilter(accountID, cursor, perPage, sortOrder, f.Key, f.Op, f.Value)
-	} else {
-		images, nextCursor, err = h.DB.ListImagesV2(accountID, cursor, perPage, sortOrder)
+	// Parse continuation_token, which must come from a listing of the same
+	// account with the same page size, sort order and filters.
+	if token := r.URL.Query().Get("continuation_token"); token != "" {
+		if q.Cursor, err = h.decodeContinuationToken(accountID, token, q); err != nil {
+			api.WriteError(w, err)
+			return
+		}
 	}
+
+	images, cursor, err := h.DB.ListImagesV2(r.Context(), accountID, q)
 	if err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to list images"))
+		api.WriteError(w, fmt.Errorf("failed to list images: %w", err))
 		return
 	}
 
-	// Build variant URLs for each image.
-	for _, img := range images {
-		img.Variants = h.buildVariantURLs(accountID, img.ID)
+	nextToken, err := h.encodeContinuationToken(accountID, cursor, q)
+	if err != nil {
+		api.WriteError(w, fmt.Errorf("failed to encode continuation_token: %w", err))
+		return
 	}
 
-	// Ensure non-nil slice for JSON serialisation.
-	if images == nil {
-		images = []*model.Image{}
+	variantURLs := h.variantURLBuilder(r.Context(), accountID)
+	lw := api.NewListWriter(w, http.StatusOK, "images")
+	for _, img := range images {
+		img.Variants = variantURLs(img.ID)
+		lw.Add(img)
 	}
-
-	result := map[string]interface{}{
-		"images":             images,
-		"continuation_token": nextCursor,
+	if err := lw.Close(map[string]interface{}{"continuation_token": nextToken}, nil); err != nil {
+		log.Printf("ListImagesV2: failed to write response: %v", err)
 	}
-
-	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(result))
 }
 
 // CreateDirectUpload handles POST /v2/direct_upload.
@@ -143,6 +208,7 @@ func (h *Handler) CreateDirectUpload(w http.ResponseWriter, r *http.Request) {
 	// Parse request body -- support both JSON and form-encoded.
 	var expiry time.Time
 	var metadata map[string]interface{}
+	var creator string
 
 	contentType := r.Header.Get("Content-Type")
 
@@ -150,37 +216,45 @@ func (h *Handler) CreateDirectUpload(w http.ResponseWriter, r *http.Request) {
 		var body struct {
 			Expiry   string                 `json:"expiry"`
 			Metadata map[string]interface{} `json:"metadata"`
+			Creator  string                 `json:"creator"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
-			api.BadRequest(w, "invalid JSON body: "+err.Error())
+			api.WriteError(w, api.ErrInvalidJSON)
 			return
 		}
 		if body.Expiry != "" {
 			parsed, err := time.Parse(time.RFC3339, body.Expiry)
 			if err != nil {
-				api.BadRequest(w, "invalid expiry format, use RFC3339")
+				api.WriteError(w, api.ErrInvalidExpiry)
 				return
 			}
 			expiry = parsed
 		}
 		metadata = body.Metadata
+		creator = body.Creator
 	} else {
 		// Try form-encoded / multipart.
 		_ = r.ParseMultipartForm(1 << 20)
 		if v := r.FormValue("expiry"); v != "" {
 			parsed, err := time.Parse(time.RFC3339, v)
 			if err != nil {
-				api.BadRequest(w, "invalid expiry format, use RFC3339")
+				api.WriteError(w, api.ErrInvalidExpiry)
 				return
 			}
 			expiry = parsed
 		}
 		if v := r.FormValue("metadata"); v != "" {
 			if err := json.Unmarshal([]byte(v), &metadata); err != nil {
-				api.BadRequest(w, "invalid metadata JSON: "+err.Error())
+				api.WriteError(w, api.ErrInvalidMetadata)
 				return
 			}
 		}
+		creator = r.FormValue("creator")
+	}
+
+	if err := validateCreator(creator); err != nil {
+		api.WriteError(w, err)
+		return
 	}
 
 	// Default expiry: 30 minutes from now.
@@ -199,10 +273,11 @@ func (h *Handler) CreateDirectUpload(w http.ResponseWriter, r *http.Request) {
 		Expiry:    expiry,
 		Metadata:  metadata,
 		Completed: false,
+		Creator:   creator,
 	}
 
-	if err := h.DB.CreateDirectUpload(du); err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to create direct upload: "+err.Error()))
+	if err := h.DB.CreateDirectUpload(r.Context(), du); err != nil {
+		api.WriteError(w, fmt.Errorf("failed to create direct upload: %w", err))
 		return
 	}
 
@@ -224,49 +299,40 @@ func (h *Handler) CreateDirectUpload(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) HandleDirectUpload(w http.ResponseWriter, r *http.Request) {
 	uploadID := chi.URLParam(r, "upload_id")
 	if uploadID == "" {
-		api.BadRequest(w, "upload_id is required")
+		api.WriteError(w, api.ErrBadRequest.WithDetail("upload_id is required"))
 		return
 	}
 
-	du, err := h.DB.GetDirectUpload(uploadID)
+	du, err := h.DB.GetDirectUpload(r.Context(), uploadID)
 	if err != nil {
-		api.NotFound(w, "direct upload not found")
+		api.WriteError(w, err, api.ErrUploadNotFound)
 		return
 	}
 
 	// Check expiry.
 	if time.Now().UTC().After(du.Expiry) {
-		api.BadRequest(w, "upload URL has expired")
+		api.WriteError(w, api.ErrUploadExpired)
 		return
 	}
 
 	// Check already completed.
 	if du.Completed {
-		api.Conflict(w, "upload already completed")
-		return
-	}
-
-	// Parse multipart form for file.
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		api.BadRequest(w, "invalid multipart form: "+err.Error())
+		api.WriteError(w, api.ErrUploadCompleted)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		api.BadRequest(w, "missing required field: file")
-		return
-	}
-	defer file.Close()
-
 	// Use the upload ID as the image ID.
 	imageID := uploadID
 	accountID := du.AccountID
 
-	// Store the file.
-	_, err = h.Store.Store(accountID, imageID, file)
+	// Stream the file into storage.
+	form, err := h.parseUploadForm(r, accountID, imageID)
 	if err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to store image: "+err.Error()))
+		api.WriteError(w, err)
+		return
+	}
+	if form.Blob == nil {
+		api.WriteError(w, api.ErrFileRequired)
 		return
 	}
 
@@ -275,32 +341,30 @@ func (h *Handler) HandleDirectUpload(w http.ResponseWriter, r *http.Request) {
 	img := &model.Image{
 		ID:        imageID,
 		AccountID: accountID,
-		Filename:  header.Filename,
-		Creator:   uuid.New().String(),
+		Filename:  form.Filename,
+		Creator:   du.Creator,
 		Meta:      du.Metadata,
 		Uploaded:  now,
 		Draft:     true,
 	}
 
-	if err := h.DB.CreateImage(img); err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to create image record: "+err.Error()))
+	if err := h.DB.CreateImage(r.Context(), img); err != nil {
+		h.discardBlob(r.Context(), accountID, imageID)
+		api.WriteError(w, fmt.Errorf("failed to create image record: %w", err), api.ErrImageExists)
 		return
 	}
 
-	// If the direct upload had metadata, set it in the metadata table too.
-	if len(du.Metadata) > 0 {
-		if err := h.DB.SetImageMetadata(accountID, imageID, du.Metadata); err != nil {
-			// Non-fatal: log but continue.
-			_ = err
-		}
-	}
-
 	// Mark direct upload as completed.
-	if err := h.DB.CompleteDirectUpload(uploadID); err != nil {
+	if err := h.DB.CompleteDirectUpload(r.Context(), uploadID); err != nil {
 		// Non-fatal: the image is already created.
 		_ = err
 	}
 
-	img.Variants = h.buildVariantURLs(accountID, imageID)
+	img.Variants = h.buildVariantURLs(r.Context(), accountID, imageID)
+
+	if h.Warmer != nil {
+		h.Warmer.WarmImage(accountID, imageID)
+	}
+
 	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(img))
 }
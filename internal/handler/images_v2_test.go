@@ -40,8 +40,7 @@ func setupV2TestRouter(h *handler.Handler) http.Handler {
 func setupV2Test(t *testing.T) (database.Database, *handler.Handler, http.Handler) {
 	t.Helper()
 
-	db, err := database.NewSQLiteDB("file::memory:?cache=shared")
-	require.NoError(t, err)
+	db := database.NewMemoryDB()
 	t.Cleanup(func() { db.Close() })
 
 	tmpDir, err := os.MkdirTemp("", "dt-images-v2-test-*")
@@ -101,10 +100,7 @@ func createTestImage(t *testing.T, db database.Database, id, accountID, filename
 		Uploaded:  time.Now().UTC(),
 		Meta:      meta,
 	}
-	require.NoError(t, db.CreateImage(img))
-	if len(meta) > 0 {
-		require.NoError(t, db.SetImageMetadata(accountID, id, meta))
-	}
+	require.NoError(t, db.CreateImage(t.Context(), img))
 }
 
 // --------------------------------------------------------------------------
@@ -147,7 +143,7 @@ func TestListImagesV2_ContinuationToken(t *testing.T) {
 			Filename:  fmt.Sprintf("img%d.jpg", i),
 			Uploaded:  time.Now().UTC().Add(time.Duration(i) * time.Second),
 		}
-		require.NoError(t, db.CreateImage(img))
+		require.NoError(t, db.CreateImage(t.Context(), img))
 	}
 
 	// First page: per_page=2
@@ -216,6 +212,95 @@ func TestListImagesV2_ContinuationToken(t *testing.T) {
 	assert.Equal(t, 5, len(allIDs), "should have seen all 5 images across pages")
 }
 
+// v2FirstToken returns the continuation token of the first page of query.
+func v2FirstToken(t *testing.T, router http.Handler, query string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, v2AuthReq("GET", v2BaseURL()+"?per_page=1&"+query, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var result struct {
+		ContinuationToken string `json:"continuation_token"`
+	}
+	require.NoError(t, json.Unmarshal(v2DecodeEnvelope(t, w).Result, &result))
+	require.NotEmpty(t, result.ContinuationToken)
+	return result.ContinuationToken
+}
+
+func TestListImagesV2_ContinuationTokenIsOpaque(t *testing.T) {
+	db, _, router := setupV2Test(t)
+	for i := 0; i < 3; i++ {
+		createTestImage(t, db, fmt.Sprintf("opaque-%d", i), testAccountID, "a.jpg", map[string]interface{}{"k": "v"})
+	}
+
+	token := v2FirstToken(t, router, "metadata[k][eq]=v")
+	assert.NotContains(t, token, "opaque-")
+	assert.NotContains(t, token, "|")
+
+	// The token is accepted by the listing it came from.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, v2AuthReq("GET", v2BaseURL()+"?per_page=1&metadata[k][eq]=v&continuation_token="+token, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// An equivalent spelling of the filter is the same listing.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, v2AuthReq("GET", v2BaseURL()+"?per_page=1&metadata[k][eq]=%22v%22&continuation_token="+token, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestListImagesV2_RejectsForeignTokens(t *testing.T) {
+	db, _, router := setupV2Test(t)
+	for i := 0; i < 3; i++ {
+		createTestImage(t, db, fmt.Sprintf("foreign-%d", i), testAccountID, "a.jpg", map[string]interface{}{"k": "v"})
+	}
+
+	token := v2FirstToken(t, router, "metadata[k][eq]=v")
+	payload, sig, ok := strings.Cut(token, ".")
+	require.True(t, ok)
+
+	tests := map[string]string{
+		"other filter":   "metadata[k][ne]=w&continuation_token=" + token,
+		"no filter":      "continuation_token=" + token,
+		"creator":        "metadata[k][eq]=v&creator=user-a&continuation_token=" + token,
+		"sort order":     "metadata[k][eq]=v&sort_order=desc&continuation_token=" + token,
+		"raw cursor":     "metadata[k][eq]=v&continuation_token=2024-01-01T00:00:00Z%7Cforeign-0",
+		"tampered":       "metadata[k][eq]=v&continuation_token=" + payload + "x." + sig,
+		"bad signature":  "metadata[k][eq]=v&continuation_token=" + payload + ".AAAA",
+		"no signature":   "metadata[k][eq]=v&continuation_token=" + payload,
+		"not base64":     "metadata[k][eq]=v&continuation_token=%25%25%25.%25%25",
+		"other instance": "metadata[k][eq]=v&continuation_token=" + token,
+		"other account":  "metadata[k][eq]=v&continuation_token=" + token,
+		"page size":      "metadata[k][eq]=v&continuation_token=" + token,
+	}
+	for name, query := range tests {
+		t.Run(name, func(t *testing.T) {
+			router := router
+			if name == "other instance" {
+				// A server with a different key does not accept the token.
+				_, h, _ := setupV2Test(t)
+				h.CursorKey = []byte("another-secret")
+				router = setupV2TestRouter(h)
+			}
+			url := v2BaseURL() + "?per_page=1&" + query
+			switch name {
+			case "other account":
+				url = "/accounts/other-account/images/v2?per_page=1&" + query
+			case "page size":
+				url = v2BaseURL() + "?per_page=2&" + query
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, v2AuthReq("GET", url, nil))
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp api.Response
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Len(t, resp.Errors, 1)
+			assert.Equal(t, 5400, resp.Errors[0].Code)
+			assert.Contains(t, resp.Errors[0].Message, "continuation_token")
+		})
+	}
+}
+
 func TestListImagesV2_MetadataFilter(t *testing.T) {
 	db, _, router := setupV2Test(t)
 
@@ -256,6 +341,147 @@ func TestListImagesV2_MetadataFilter(t *testing.T) {
 	assert.Equal(t, "tagged2.jpg", result.Images[0].Filename)
 }
 
+// v2FilenamesFor lists the filenames of the images a V2 listing returns for
+// query, in upload order.
+func v2FilenamesFor(t *testing.T, router http.Handler, query string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, v2AuthReq("GET", v2BaseURL()+"?per_page=100&"+query, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var result struct {
+		Images []imageResult `json:"images"`
+	}
+	require.NoError(t, json.Unmarshal(v2DecodeEnvelope(t, w).Result, &result))
+	names := make([]string, len(result.Images))
+	for i, img := range result.Images {
+		names[i] = img.Filename
+	}
+	return names
+}
+
+func TestListImagesV2_TypedMetadataFilters(t *testing.T) {
+	db, _, router := setupV2Test(t)
+
+	base := time.Now().UTC()
+	for i, meta := range []map[string]interface{}{
+		{"rank": 2, "flag": true, "owner": map[string]interface{}{"team": "red"}},
+		{"rank": 15, "flag": false, "owner": map[string]interface{}{"team": "blue"}},
+		{"rank": "15", "flag": "true"},
+		{"rank": "NaN", "flag": "-Inf"},
+	} {
+		require.NoError(t, db.CreateImage(t.Context(), &model.Image{
+			ID:        uuid.New().String(),
+			AccountID: testAccountID,
+			Filename:  fmt.Sprintf("img%d.jpg", i),
+			Meta:      meta,
+			Uploaded:  base.Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"metadata[rank][gt]=10", []string{"img1.jpg"}},
+		{"metadata[rank][eq]=%2215%22", []string{"img2.jpg"}},
+		{"metadata[flag][eq]=true", []string{"img0.jpg"}},
+		{"metadata[owner][team][eq]=blue", []string{"img1.jpg"}},
+		{"metadata[owner.team][in]=red,blue", []string{"img0.jpg", "img1.jpg"}},
+		{"metadata[rank][in]=%5B2,%2215%22%5D", []string{"img0.jpg", "img2.jpg"}},
+		{"metadata[rank][lte]=15&metadata[flag][eq]=false", []string{"img1.jpg"}},
+		{"metadata[rank][gte]=1&metadata[owner][team][eq]=green", []string{}},
+		{"metadata[rank][eq]=NaN", []string{"img3.jpg"}},
+		{"metadata[flag][in]=-Inf,true", []string{"img0.jpg", "img3.jpg"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.want, v2FilenamesFor(t, router, tt.query))
+		})
+	}
+}
+
+func TestListImagesV2_InvalidMetadataFilters(t *testing.T) {
+	_, _, router := setupV2Test(t)
+
+	for _, query := range []string{
+		"metadata[k][like]=x",
+		"metadata[k]=x",
+		"metadata[k][]=x",
+		"metadata[flag][gt]=true",
+		"metadata[k][in]=%5B1,",
+		"metadata[a][eq]=1&metadata[b][eq]=1&metadata[c][eq]=1&metadata[d][eq]=1&metadata[e][eq]=1&metadata[f][eq]=1",
+	} {
+		t.Run(query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, v2AuthReq("GET", v2BaseURL()+"?"+query, nil))
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+func TestListImagesV2_CreatorFilter(t *testing.T) {
+	db, _, router := setupV2Test(t)
+
+	for i, creator := range []string{"user-a", "user-b", "user-a"} {
+		require.NoError(t, db.CreateImage(t.Context(), &model.Image{
+			ID:        fmt.Sprintf("creator-%d", i),
+			AccountID: testAccountID,
+			Creator:   creator,
+			Uploaded:  time.Now().UTC(),
+		}))
+	}
+
+	req := v2AuthReq("GET", v2BaseURL()+"?creator=user-a", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	env := v2DecodeEnvelope(t, w)
+	var result struct {
+		Images []imageResult `json:"images"`
+	}
+	require.NoError(t, json.Unmarshal(env.Result, &result))
+	require.Len(t, result.Images, 2)
+	for _, img := range result.Images {
+		assert.Equal(t, "user-a", img.Creator)
+	}
+}
+
+func TestDirectUpload_Creator(t *testing.T) {
+	_, _, router := setupV2Test(t)
+
+	body := bytes.NewBufferString(`{"creator":"user-9"}`)
+	req := v2AuthReq("POST", v2BaseURL()+"/direct_upload", body)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(v2DecodeEnvelope(t, w).Result, &created))
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "direct.png")
+	require.NoError(t, err)
+	_, err = fw.Write(fakePNG("fake-image-data"))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	uploadReq := httptest.NewRequest("POST", "/upload/"+created.ID, &buf)
+	uploadReq.Header.Set("Content-Type", mw.FormDataContentType())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, uploadReq)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var img imageResult
+	require.NoError(t, json.Unmarshal(v2DecodeEnvelope(t, w).Result, &img))
+	assert.Equal(t, "user-9", img.Creator)
+}
+
 func TestCreateDirectUpload(t *testing.T) {
 	_, _, router := setupV2Test(t)
 
@@ -311,7 +537,7 @@ func TestDirectUpload_FullFlow(t *testing.T) {
 	mw := multipart.NewWriter(&buf)
 	fw, err := mw.CreateFormFile("file", "direct-upload.png")
 	require.NoError(t, err)
-	_, err = fw.Write([]byte("fake-image-data"))
+	_, err = fw.Write(fakePNG("fake-image-data"))
 	require.NoError(t, err)
 	require.NoError(t, mw.Close())
 
@@ -350,7 +576,7 @@ func TestDirectUpload_FullFlow(t *testing.T) {
 	mw2 := multipart.NewWriter(&buf2)
 	fw2, err := mw2.CreateFormFile("file", "another.png")
 	require.NoError(t, err)
-	_, err = fw2.Write([]byte("more-data"))
+	_, err = fw2.Write(fakePNG("more-data"))
 	require.NoError(t, err)
 	require.NoError(t, mw2.Close())
 
@@ -362,7 +588,7 @@ func TestDirectUpload_FullFlow(t *testing.T) {
 	assert.Equal(t, http.StatusConflict, w.Code)
 
 	// Step 5: Verify metadata was stored by checking it exists in DB.
-	du, err := db.GetDirectUpload(createResult.ID)
+	du, err := db.GetDirectUpload(t.Context(), createResult.ID)
 	require.NoError(t, err)
 	assert.True(t, du.Completed)
 }
@@ -392,7 +618,7 @@ func TestDirectUpload_Expired(t *testing.T) {
 	mw := multipart.NewWriter(&buf)
 	fw, err := mw.CreateFormFile("file", "expired.png")
 	require.NoError(t, err)
-	_, err = fw.Write([]byte("fake-data"))
+	_, err = fw.Write(fakePNG("fake-data"))
 	require.NoError(t, err)
 	require.NoError(t, mw.Close())
 
@@ -413,5 +639,5 @@ func TestDirectUpload_Expired(t *testing.T) {
 	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &errEnv))
 	assert.False(t, errEnv.Success)
 	require.Len(t, errEnv.Errors, 1)
-	assert.Equal(t, "upload URL has expired", errEnv.Errors[0].Message)
+	assert.Equal(t, "Bad request: upload URL has expired", errEnv.Errors[0].Message)
 }
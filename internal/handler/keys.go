@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
@@ -16,7 +17,7 @@ func (h *Handler) CreateSigningKey(w http.ResponseWriter, r *http.Request) {
 	keyName := chi.URLParam(r, "signing_key_name")
 
 	if keyName == "" {
-		api.BadRequest(w, "signing key name is required")
+		api.WriteError(w, api.ErrSigningKeyNameRequired)
 		return
 	}
 
@@ -27,8 +28,8 @@ func (h *Handler) CreateSigningKey(w http.ResponseWriter, r *http.Request) {
 		CreatedAt: time.Now().UTC(),
 	}
 
-	if err := h.DB.CreateSigningKey(key); err != nil {
-		api.BadRequest(w, "failed to create signing key: "+err.Error())
+	if err := h.DB.CreateSigningKey(r.Context(), key); err != nil {
+		api.WriteError(w, fmt.Errorf("failed to create signing key: %w", err))
 		return
 	}
 
@@ -39,9 +40,9 @@ func (h *Handler) CreateSigningKey(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) ListSigningKeys(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 
-	keys, err := h.DB.ListSigningKeys(accountID)
+	keys, err := h.DB.ListSigningKeys(r.Context(), accountID)
 	if err != nil {
-		api.WriteJSON(w, http.StatusInternalServerError, api.ErrorResponse(9500, "failed to list signing keys"))
+		api.WriteError(w, fmt.Errorf("failed to list signing keys: %w", err))
 		return
 	}
 
@@ -61,13 +62,13 @@ func (h *Handler) DeleteSigningKey(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 	keyName := chi.URLParam(r, "signing_key_name")
 
-	if err := h.DB.DeleteSigningKey(accountID, keyName); err != nil {
-		api.NotFound(w, "signing key not found")
+	if err := h.DB.DeleteSigningKey(r.Context(), accountID, keyName); err != nil {
+		api.WriteError(w, err, api.ErrSigningKeyNotFound)
 		return
 	}
 
 	// Check if this was the last key; if so, auto-create a "default" key.
-	remaining, err := h.DB.ListSigningKeys(accountID)
+	remaining, err := h.DB.ListSigningKeys(r.Context(), accountID)
 	if err == nil && len(remaining) == 0 {
 		defaultKey := &model.SigningKey{
 			Name:      "default",
@@ -75,7 +76,7 @@ func (h *Handler) DeleteSigningKey(w http.ResponseWriter, r *http.Request) {
 			AccountID: accountID,
 			CreatedAt: time.Now().UTC(),
 		}
-		_ = h.DB.CreateSigningKey(defaultKey)
+		_ = h.DB.CreateSigningKey(r.Context(), defaultKey)
 	}
 
 	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(struct{}{}))
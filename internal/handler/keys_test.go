@@ -187,7 +187,7 @@ func TestDeleteSigningKey_LastKey_AutoCreatesDefault(t *testing.T) {
 	assert.NotEmpty(t, defaultKey["value"])
 
 	// Verify the auto-created key is actually a valid SigningKey in DB.
-	keys, err := h.DB.ListSigningKeys(testAccountID)
+	keys, err := h.DB.ListSigningKeys(t.Context(), testAccountID)
 	require.NoError(t, err)
 	require.Len(t, keys, 1)
 	assert.Equal(t, "default", keys[0].Name)
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/leca/dt-cloudflare-images/internal/api"
+)
+
+// maxPurgeItems is the number of files or prefixes Cloudflare accepts in a
+// single purge request.
+const maxPurgeItems = 30
+
+// purgeCacheRequest is the JSON body for POST /zones/{zone_id}/purge_cache.
+// Entries in Files are either URL strings or {"url": ..., "headers": ...}
+// objects, as Cloudflare accepts both.
+type purgeCacheRequest struct {
+	Files           []json.RawMessage `json:"files"`
+	Prefixes        []string          `json:"prefixes"`
+	PurgeEverything bool              `json:"purge_everything"`
+}
+
+// deliveryTarget is the part of a delivery URL that identifies cached
+// content: /cdn[/{account_id}[/{image_id}[/{variant_name}]]]. The zero
+// deliveryTarget addresses every delivery URL.
+type deliveryTarget struct {
+	AccountID   string
+	ImageID     string
+	VariantName string
+}
+
+// PurgeCache handles POST /zones/{zone_id}/purge_cache -- emulates
+// Cloudflare's cache purge by dropping derivatives of the twin's delivery
+// URLs. Zones are not modelled; any zone ID is accepted.
+func (h *Handler) PurgeCache(w http.ResponseWriter, r *http.Request) {
+	zoneID := chi.URLParam(r, "zone_id")
+
+	var req purgeCacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.WriteError(w, api.ErrPurgeInvalidJSON)
+		return
+	}
+
+	modes := 0
+	if len(req.Files) > 0 {
+		modes++
+	}
+	if len(req.Prefixes) > 0 {
+		modes++
+	}
+	if req.PurgeEverything {
+		modes++
+	}
+	if modes != 1 {
+		api.WriteError(w, api.ErrPurgeTarget)
+		return
+	}
+	if len(req.Files) > maxPurgeItems || len(req.Prefixes) > maxPurgeItems {
+		api.WriteError(w, api.ErrTooManyPurges)
+		return
+	}
+
+	// Validate everything before purging anything.
+	var targets []deliveryTarget
+	for i, raw := range req.Files {
+		fileURL, ok := purgeFileURL(raw)
+		if !ok {
+			api.WriteError(w, api.ErrInvalidPurgeURL.WithPointer(fmt.Sprintf("/files/%d", i)))
+			return
+		}
+		target, ok := parseDeliveryTarget(fileURL)
+		if !ok || target.VariantName == "" {
+			// Not a delivery URL of this twin: nothing is cached for it.
+			continue
+		}
+		targets = append(targets, target)
+	}
+	for i, prefix := range req.Prefixes {
+		if prefix == "" {
+			api.WriteError(w, api.ErrEmptyPrefix.WithPointer(fmt.Sprintf("/prefixes/%d", i)))
+			return
+		}
+		if target, ok := parseDeliveryTarget(prefix); ok {
+			targets = append(targets, target)
+		}
+	}
+
+	if h.Cache != nil {
+		if req.PurgeEverything {
+			h.Cache.Purge()
+		}
+		for _, t := range targets {
+			h.purgeTarget(r.Context(), t)
+		}
+	}
+
+	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(map[string]string{"id": zoneID}))
+}
+
+// purgeTarget drops the cached derivatives addressed by t.
+func (h *Handler) purgeTarget(ctx context.Context, t deliveryTarget) {
+	switch {
+	case t.AccountID == "":
+		h.Cache.Purge()
+	case t.ImageID == "":
+		h.Cache.InvalidateAccount(t.AccountID)
+	case t.VariantName == "":
+		h.Cache.InvalidateImage(t.AccountID, t.ImageID)
+	default:
+		variant, err := h.DB.GetVariant(ctx, t.AccountID, t.VariantName)
+		if err != nil {
+			return
+		}
+		h.Cache.Invalidate(t.AccountID, t.ImageID, variantCacheKey(variant.Options))
+	}
+}
+
+// purgeFileURL extracts the URL from a files entry.
+func purgeFileURL(raw json.RawMessage) (string, bool) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, true
+	}
+	var obj struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil || obj.URL == "" {
+		return "", false
+	}
+	return obj.URL, true
+}
+
+// parseDeliveryTarget maps a delivery URL or purge prefix onto the twin's
+// /cdn/{account_id}/{image_id}/{variant_name} route. Prefixes may omit the
+// scheme, as Cloudflare's do. Matching is by whole path segment, so a host
+// alone or host/cdn covers every delivery URL of the zone.
+func parseDeliveryTarget(raw string) (deliveryTarget, bool) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return deliveryTarget{}, false
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) == 1 && (segments[0] == "" || segments[0] == "cdn") {
+		return deliveryTarget{}, true
+	}
+	if len(segments) < 2 || len(segments) > 4 || segments[0] != "cdn" {
+		return deliveryTarget{}, false
+	}
+	for _, seg := range segments[1:] {
+		if seg == "" {
+			return deliveryTarget{}, false
+		}
+	}
+
+	t := deliveryTarget{AccountID: segments[1]}
+	if len(segments) > 2 {
+		t.ImageID = segments[2]
+	}
+	if len(segments) > 3 {
+		t.VariantName = segments[3]
+	}
+	return t, true
+}
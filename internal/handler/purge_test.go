@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupPurgeTestRouter wires the delivery and purge routes.
+func setupPurgeTestRouter(h *Handler) http.Handler {
+	r := chi.NewRouter()
+	r.Get("/cdn/{account_id}/{image_id}/{variant_name}", h.DeliverImage)
+	r.Post("/zones/{zone_id}/purge_cache", h.PurgeCache)
+	return r
+}
+
+// warmDelivery requests a delivery URL so its output lands in the cache.
+func warmDelivery(t *testing.T, router http.Handler, imageID, variantName string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/"+imageID+"/"+variantName, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+// deliveryCacheStatus returns the cf-cache-status of a delivery request.
+func deliveryCacheStatus(t *testing.T, router http.Handler, imageID, variantName string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/"+imageID+"/"+variantName, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Header().Get("cf-cache-status")
+}
+
+func purge(t *testing.T, router http.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/zones/zone-1/purge_cache", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// seedPurgeFixtures stores two images and two variants.
+func seedPurgeFixtures(t *testing.T, h *Handler) {
+	t.Helper()
+	data := testJPEG(t)
+	seedImageAndVariant(t, h, "img-a", "thumb", data, false, false)
+	img := &model.Image{ID: "img-b", AccountID: testAccountID, Filename: "b.jpg"}
+	require.NoError(t, h.DB.CreateImage(t.Context(), img))
+	_, err := h.Store.Store(t.Context(), testAccountID, "img-b", bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, h.DB.CreateVariant(t.Context(), &model.Variant{
+		ID:        "large",
+		AccountID: testAccountID,
+		Options:   model.VariantOptions{Fit: "contain", Width: 4, Height: 4, Metadata: "none"},
+	}))
+}
+
+func TestPurgeCache_Files(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := setupPurgeTestRouter(h)
+	seedPurgeFixtures(t, h)
+
+	warmDelivery(t, router, "img-a", "thumb")
+	warmDelivery(t, router, "img-a", "large")
+
+	w := purge(t, router, `{"files": ["http://localhost:8080/cdn/`+testAccountID+`/img-a/thumb"]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp api.Response
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Success)
+	result, ok := resp.Result.(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, "zone-1", result["id"])
+
+	assert.Equal(t, "MISS", deliveryCacheStatus(t, router, "img-a", "thumb"))
+	assert.Equal(t, "HIT", deliveryCacheStatus(t, router, "img-a", "large"))
+}
+
+func TestPurgeCache_FileObjects(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := setupPurgeTestRouter(h)
+	seedPurgeFixtures(t, h)
+
+	warmDelivery(t, router, "img-a", "thumb")
+
+	w := purge(t, router, `{"files": [{"url": "http://localhost:8080/cdn/`+testAccountID+`/img-a/thumb?sig=abc", "headers": {"Accept": "image/webp"}}]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, "MISS", deliveryCacheStatus(t, router, "img-a", "thumb"))
+}
+
+func TestPurgeCache_Prefixes(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := setupPurgeTestRouter(h)
+	seedPurgeFixtures(t, h)
+
+	warmDelivery(t, router, "img-a", "thumb")
+	warmDelivery(t, router, "img-a", "large")
+	warmDelivery(t, router, "img-b", "thumb")
+
+	w := purge(t, router, `{"prefixes": ["localhost:8080/cdn/`+testAccountID+`/img-a"]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, "MISS", deliveryCacheStatus(t, router, "img-a", "thumb"))
+	assert.Equal(t, "MISS", deliveryCacheStatus(t, router, "img-a", "large"))
+	assert.Equal(t, "HIT", deliveryCacheStatus(t, router, "img-b", "thumb"))
+}
+
+func TestPurgeCache_AccountPrefix(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := setupPurgeTestRouter(h)
+	seedPurgeFixtures(t, h)
+
+	warmDelivery(t, router, "img-a", "thumb")
+	warmDelivery(t, router, "img-b", "thumb")
+
+	w := purge(t, router, `{"prefixes": ["localhost:8080/cdn/`+testAccountID+`"]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(0), h.Cache.Size())
+}
+
+func TestPurgeCache_ZonePrefix(t *testing.T) {
+	for _, prefix := range []string{"localhost:8080/cdn", "localhost:8080"} {
+		t.Run(prefix, func(t *testing.T) {
+			h := newTestHandler(t)
+			enableDerivativeCache(t, h)
+			router := setupPurgeTestRouter(h)
+			seedPurgeFixtures(t, h)
+
+			warmDelivery(t, router, "img-a", "thumb")
+			warmDelivery(t, router, "img-b", "large")
+
+			w := purge(t, router, `{"prefixes": ["`+prefix+`"]}`)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, int64(0), h.Cache.Size())
+		})
+	}
+}
+
+func TestPurgeCache_Everything(t *testing.T) {
+	h := newTestHandler(t)
+	enableDerivativeCache(t, h)
+	router := setupPurgeTestRouter(h)
+	seedPurgeFixtures(t, h)
+
+	warmDelivery(t, router, "img-a", "thumb")
+	warmDelivery(t, router, "img-b", "large")
+
+	w := purge(t, router, `{"purge_everything": true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(0), h.Cache.Size())
+}
+
+func TestPurgeCache_Validation(t *testing.T) {
+	h := newTestHandler(t)
+	router := setupPurgeTestRouter(h)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"empty", `{}`},
+		{"invalid json", `{`},
+		{"multiple modes", `{"files": ["http://x/cdn/a/b/c"], "purge_everything": true}`},
+		{"bad file entry", `{"files": [42]}`},
+		{"empty prefix", `{"prefixes": [""]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := purge(t, router, tt.body)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+func TestPurgeCache_TooManyFiles(t *testing.T) {
+	h := newTestHandler(t)
+	router := setupPurgeTestRouter(h)
+
+	files := make([]string, maxPurgeItems+1)
+	for i := range files {
+		files[i] = "http://localhost:8080/cdn/" + testAccountID + "/img/thumb"
+	}
+	body, err := json.Marshal(map[string]interface{}{"files": files})
+	require.NoError(t, err)
+
+	w := purge(t, router, string(body))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestParseDeliveryTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want deliveryTarget
+		ok   bool
+	}{
+		{"http://localhost:8080/cdn/acct/img/thumb", deliveryTarget{"acct", "img", "thumb"}, true},
+		{"localhost:8080/cdn/acct/img", deliveryTarget{"acct", "img", ""}, true},
+		{"example.com/cdn/acct/", deliveryTarget{"acct", "", ""}, true},
+		{"http://localhost:8080/accounts/acct/images/v1", deliveryTarget{}, false},
+		{"http://localhost:8080/cdn", deliveryTarget{}, true},
+		{"localhost:8080/cdn/", deliveryTarget{}, true},
+		{"localhost:8080", deliveryTarget{}, true},
+		{"localhost:8080/cdnx", deliveryTarget{}, false},
+		{"http://localhost:8080/cdn/a/b/c/d", deliveryTarget{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseDeliveryTarget(tt.in)
+		assert.Equal(t, tt.ok, ok, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
@@ -30,8 +30,7 @@ func setupStatsTestRouter(h *Handler) http.Handler {
 // newStatsTestHandler creates a handler with a specific ImageAllowance.
 func newStatsTestHandler(t *testing.T, allowance int) *Handler {
 	t.Helper()
-	db, err := database.NewSQLiteDB("file::memory:?cache=shared")
-	require.NoError(t, err)
+	db := database.NewMemoryDB()
 	t.Cleanup(func() { db.Close() })
 
 	tmpDir := t.TempDir()
@@ -75,7 +74,7 @@ func TestGetStats_WithImages(t *testing.T) {
 
 	// Create images directly in the database.
 	for i := 0; i < 5; i++ {
-		err := h.DB.CreateImage(&model.Image{
+		err := h.DB.CreateImage(t.Context(), &model.Image{
 			ID:        uuid.New().String(),
 			AccountID: testAccountID,
 			Filename:  "test.jpg",
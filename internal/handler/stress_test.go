@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/config"
+	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/imageproc"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConcurrentUploadsListingsAndDeliveries drives uploads, listings and
+// deliveries in parallel against a file-backed database, so that writes on
+// the single writer connection interleave with reads on the reader pool. Run
+// it with -race.
+func TestConcurrentUploadsListingsAndDeliveries(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+
+	db, err := database.NewSQLiteDB(filepath.Join(t.TempDir(), "stress.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	h := &Handler{
+		DB:     db,
+		Store:  storage.NewFileSystem(t.TempDir()),
+		Config: &config.Config{BaseURL: "http://localhost:8080"},
+		Pool:   imageproc.NewPool(4, 64, 10*time.Second),
+	}
+	enableDerivativeCache(t, h)
+	jpeg := testJPEG(t)
+	seedImageAndVariant(t, h, "seed", "thumb", jpeg, false, false)
+
+	r := chi.NewRouter()
+	r.Route("/accounts/{account_id}/images", func(r chi.Router) {
+		r.Use(api.AccountIDMiddleware)
+		r.Post("/v1", h.UploadImage)
+		r.Get("/v1", h.ListImages)
+		r.Get("/v2", h.ListImagesV2)
+	})
+	r.Get("/cdn/{account_id}/{image_id}/{variant_name}", h.DeliverImage)
+
+	const workers, iterations = 4, 15
+	requests := map[string]func() *http.Request{
+		"upload": func() *http.Request {
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+			fw, _ := mw.CreateFormFile("file", "photo.jpg")
+			_, _ = fw.Write(jpeg)
+			_ = mw.WriteField("metadata", `{"n": 1}`)
+			_ = mw.Close()
+			req := httptest.NewRequest(http.MethodPost, "/accounts/"+testAccountID+"/images/v1", &buf)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			return req
+		},
+		"list-v1": func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/accounts/"+testAccountID+"/images/v1?per_page=50", nil)
+		},
+		"list-v2": func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/accounts/"+testAccountID+"/images/v2?metadata[n][eq]=1", nil)
+		},
+		"deliver": func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/seed/thumb", nil)
+		},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, len(requests)*workers*iterations)
+	for name, newReq := range requests {
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < iterations; j++ {
+					w := httptest.NewRecorder()
+					r.ServeHTTP(w, newReq())
+					if w.Code != http.StatusOK {
+						errs <- fmt.Sprintf("%s: %d %s", name, w.Code, w.Body.String())
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	count, err := db.CountImages(t.Context(), testAccountID)
+	require.NoError(t, err)
+	assert.Equal(t, 1+workers*iterations, count)
+}
@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/fetch"
+	"github.com/leca/dt-cloudflare-images/internal/imageproc"
+)
+
+// maxUploadFieldBytes bounds the size of the non-file fields of an upload.
+const maxUploadFieldBytes = 1 << 20
+
+// errStoreFailed wraps storage failures from parseUploadForm, which
+// api.WriteError reports by the storage error they wrap rather than as bad
+// requests.
+var errStoreFailed = errors.New("failed to store image")
+
+// uploadedBlob describes an uploaded file as it was streamed into storage.
+type uploadedBlob struct {
+	Size   int64
+	SHA256 string
+	// Format is the sniffed image format, as reported by
+	// imageproc.OutputFormat.
+	Format string
+}
+
+// uploadForm holds the fields of a multipart upload.
+type uploadForm struct {
+	URL               string
+	Metadata          map[string]interface{}
+	RequireSignedURLs bool
+	Creator           string
+	Filename          string
+
+	// Blob is set when a file part was streamed into storage.
+	Blob *uploadedBlob
+}
+
+// sourceError wraps a failure to read the data of an upload, as opposed to a
+// failure to store it.
+type sourceError struct {
+	err error
+}
+
+func (e *sourceError) Error() string { return e.err.Error() }
+func (e *sourceError) Unwrap() error { return e.err }
+
+// sourceReader records the first error, other than io.EOF, returned by r.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// blobSniffer observes the bytes of an upload on their way into storage,
+// hashing them and keeping the head for format sniffing.
+type blobSniffer struct {
+	hash hash.Hash
+	size int64
+	head []byte
+}
+
+func newBlobSniffer() *blobSniffer {
+	return &blobSniffer{hash: sha256.New(), head: make([]byte, 0, 512)}
+}
+
+func (s *blobSniffer) Write(p []byte) (int, error) {
+	s.hash.Write(p)
+	s.size += int64(len(p))
+	if n := cap(s.head) - len(s.head); n > 0 {
+		s.head = append(s.head, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+func (s *blobSniffer) result() *uploadedBlob {
+	return &uploadedBlob{
+		Size:   s.size,
+		SHA256: hex.EncodeToString(s.hash.Sum(nil)),
+		Format: imageproc.OutputFormat(s.head),
+	}
+}
+
+// storeStream pipes src into storage, computing the blob's size, digest and
+// format in the same pass. A failed store leaves nothing behind; if it failed
+// because src could not be read, the error is a *sourceError. Data in no
+// recognised image format is discarded with api.ErrInvalidImage.
+func (h *Handler) storeStream(ctx context.Context, accountID, imageID string, src io.Reader) (*uploadedBlob, error) {
+	sr := &sourceReader{r: src}
+	s := newBlobSniffer()
+	if _, err := h.Store.Store(ctx, accountID, imageID, io.TeeReader(sr, s)); err != nil {
+		h.discardBlob(ctx, accountID, imageID)
+		if sr.err != nil {
+			return nil, &sourceError{err: sr.err}
+		}
+		return nil, err
+	}
+	blob := s.result()
+	if blob.Format == "" {
+		h.discardBlob(ctx, accountID, imageID)
+		return nil, api.ErrInvalidImage
+	}
+	return blob, nil
+}
+
+// parseUploadForm reads a multipart upload without buffering it. The first
+// "file" part is streamed straight into storage as accountID/imageID; other
+// parts are read as small form fields. On error nothing is left in storage,
+// whatever the order of the parts. Storage failures wrap errStoreFailed; any
+// other error wraps the api.Error for the malformed request.
+func (h *Handler) parseUploadForm(r *http.Request, accountID, imageID string) (*uploadForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", api.ErrInvalidUpload, err)
+	}
+
+	form := &uploadForm{}
+	if err := h.readUploadParts(r.Context(), mr, form, accountID, imageID); err != nil {
+		if form.Blob != nil {
+			h.discardBlob(r.Context(), accountID, imageID)
+		}
+		return nil, err
+	}
+	return form, nil
+}
+
+// readUploadParts consumes every part of an upload form into form.
+func (h *Handler) readUploadParts(ctx context.Context, mr *multipart.Reader, form *uploadForm, accountID, imageID string) error {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", api.ErrInvalidUpload, err)
+		}
+		err = h.readUploadPart(ctx, part, form, accountID, imageID)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readUploadPart consumes a single part of an upload form into form.
+func (h *Handler) readUploadPart(ctx context.Context, part *multipart.Part, form *uploadForm, accountID, imageID string) error {
+	name := part.FormName()
+	if name == "file" {
+		if form.Blob != nil {
+			// Only the first file is kept, as with Request.FormFile.
+			return nil
+		}
+		blob, err := h.storeStream(ctx, accountID, imageID, part)
+		var se *sourceError
+		if errors.As(err, &se) {
+			// The client's body, not storage, failed.
+			return fmt.Errorf("%w: %w", api.ErrInvalidUpload, se.err)
+		}
+		if errors.Is(err, api.ErrInvalidImage) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errStoreFailed, err)
+		}
+		form.Blob = blob
+		form.Filename = part.FileName()
+		return nil
+	}
+
+	value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldBytes+1))
+	if err != nil {
+		return fmt.Errorf("%w: %w", api.ErrInvalidUpload, err)
+	}
+	if len(value) > maxUploadFieldBytes {
+		return api.ErrFieldTooLarge.WithPointer("/" + name)
+	}
+
+	switch name {
+	case "url":
+		form.URL = string(value)
+	case "metadata":
+		if len(value) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(value, &form.Metadata); err != nil {
+			return fmt.Errorf("%w: %w", api.ErrInvalidMetadata, err)
+		}
+	case "requireSignedURLs":
+		form.RequireSignedURLs = string(value) == "true"
+	case "creator":
+		form.Creator = string(value)
+	}
+	return nil
+}
+
+// discardBlob removes a blob stored for an upload that did not complete. It
+// runs to completion even if ctx has been cancelled.
+func (h *Handler) discardBlob(ctx context.Context, accountID, imageID string) {
+	if err := h.Store.Delete(context.WithoutCancel(ctx), accountID, imageID); err != nil {
+		log.Printf("discardBlob: failed to delete %s/%s: %v", accountID, imageID, err)
+	}
+}
+
+// fetcher returns the Fetcher used for URL uploads.
+func (h *Handler) fetcher() fetch.Fetcher {
+	if h.Fetcher != nil {
+		return h.Fetcher
+	}
+	return defaultFetcher
+}
+
+// defaultFetcher serves handlers built without a Fetcher.
+var defaultFetcher = fetch.NewHTTPFetcher(fetch.Options{MaxRedirects: -1})
+
+// storeFromURL fetches rawURL and streams it into storage. It writes an error
+// response and returns false on failure.
+func (h *Handler) storeFromURL(w http.ResponseWriter, r *http.Request, accountID, imageID, rawURL string) (filename string, ok bool) {
+	res, err := h.fetcher().Fetch(r.Context(), rawURL)
+	if err != nil {
+		writeFetchError(w, err)
+		return "", false
+	}
+	defer res.Body.Close()
+
+	if _, err := h.storeStream(r.Context(), accountID, imageID, res.Body); err != nil {
+		var se *sourceError
+		if errors.As(err, &se) {
+			writeFetchError(w, se.err)
+			return "", false
+		}
+		if errors.Is(err, api.ErrInvalidImage) {
+			api.WriteError(w, err)
+			return "", false
+		}
+		api.WriteError(w, fmt.Errorf("%w: %w", errStoreFailed, err))
+		return "", false
+	}
+	return res.Filename, true
+}
+
+// writeFetchError reports a failed URL fetch.
+func writeFetchError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fetch.ErrTooLarge) {
+		api.WriteError(w, api.ErrImageTooLarge)
+		return
+	}
+	api.WriteError(w, api.ErrFetchFailed.WithDetail(err.Error()))
+}
@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/fetch"
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// formPart is one field of a multipart body built by multipartBody.
+type formPart struct {
+	name     string
+	filename string // non-empty for file parts
+	content  []byte
+}
+
+// multipartBody encodes parts, in order, as a multipart form.
+func multipartBody(t *testing.T, parts ...formPart) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		if p.filename != "" {
+			fw, err := mw.CreateFormFile(p.name, p.filename)
+			require.NoError(t, err)
+			_, err = fw.Write(p.content)
+			require.NoError(t, err)
+			continue
+		}
+		require.NoError(t, mw.WriteField(p.name, string(p.content)))
+	}
+	require.NoError(t, mw.Close())
+	return &buf, mw.FormDataContentType()
+}
+
+// newUploadTestHandler returns a handler whose storage lives in the returned
+// directory, so tests can inspect what was written.
+func newUploadTestHandler(t *testing.T) (*Handler, string) {
+	t.Helper()
+	h := newTestHandler(t)
+	dir := t.TempDir()
+	h.Store = storage.NewFileSystem(dir)
+	return h, dir
+}
+
+// storedOriginals returns the originals found under a storage directory.
+func storedOriginals(t *testing.T, dir string) []string {
+	t.Helper()
+	var found []string
+	require.NoError(t, filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && d.Name() == "original" {
+			found = append(found, path)
+		}
+		return err
+	}))
+	return found
+}
+
+func postUpload(h *Handler, body *bytes.Buffer, contentType string) *httptest.ResponseRecorder {
+	r := chi.NewRouter()
+	r.With(api.AccountIDMiddleware).Post("/accounts/{account_id}/images/v1", h.UploadImage)
+
+	req := httptest.NewRequest(http.MethodPost, "/accounts/"+testAccountID+"/images/v1", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUploadImage_Streaming(t *testing.T) {
+	h, dir := newUploadTestHandler(t)
+
+	content := testPNG(t)
+	body, ct := multipartBody(t,
+		formPart{name: "metadata", content: []byte(`{"k":"v"}`)},
+		formPart{name: "file", filename: "photo.png", content: content},
+		formPart{name: "requireSignedURLs", content: []byte("true")},
+	)
+	w := postUpload(h, body, ct)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Result model.Image `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "photo.png", resp.Result.Filename)
+	assert.Equal(t, "v", resp.Result.Meta["k"])
+	assert.True(t, resp.Result.RequireSignedURLs)
+	assert.Len(t, storedOriginals(t, dir), 1)
+}
+
+func TestUploadImage_InvalidMetadataLeavesNoBlob(t *testing.T) {
+	content := testPNG(t)
+	tests := []struct {
+		name  string
+		parts []formPart
+	}{
+		{
+			name: "metadata before file",
+			parts: []formPart{
+				{name: "metadata", content: []byte("{not json")},
+				{name: "file", filename: "photo.png", content: content},
+			},
+		},
+		{
+			name: "metadata after file",
+			parts: []formPart{
+				{name: "file", filename: "photo.png", content: content},
+				{name: "metadata", content: []byte("{not json")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, dir := newUploadTestHandler(t)
+			body, ct := multipartBody(t, tt.parts...)
+			w := postUpload(h, body, ct)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), api.ErrInvalidMetadata.Message)
+			assert.Empty(t, storedOriginals(t, dir))
+		})
+	}
+}
+
+func TestUploadImage_NotMultipart(t *testing.T) {
+	h, _ := newUploadTestHandler(t)
+	w := postUpload(h, bytes.NewBufferString(`{"url":"x"}`), "application/json")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandleDirectUpload_InvalidMetadataLeavesNoBlob(t *testing.T) {
+	h, dir := newUploadTestHandler(t)
+	require.NoError(t, h.DB.CreateDirectUpload(t.Context(), &model.DirectUpload{
+		ID:        "du-stream-1",
+		AccountID: testAccountID,
+		Expiry:    time.Now().UTC().Add(time.Hour),
+	}))
+
+	r := chi.NewRouter()
+	r.Post("/upload/{upload_id}", h.HandleDirectUpload)
+
+	body, ct := multipartBody(t,
+		formPart{name: "file", filename: "photo.png", content: testPNG(t)},
+		formPart{name: "metadata", content: []byte("[")},
+	)
+	req := httptest.NewRequest(http.MethodPost, "/upload/du-stream-1", body)
+	req.Header.Set("Content-Type", ct)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, storedOriginals(t, dir))
+}
+
+func TestStoreStream_DigestAndFormat(t *testing.T) {
+	h, _ := newUploadTestHandler(t)
+	content := testJPEG(t)
+
+	blob, err := h.storeStream(t.Context(), testAccountID, "img-stream", bytes.NewReader(content))
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(content)
+	assert.Equal(t, int64(len(content)), blob.Size)
+	assert.Equal(t, hex.EncodeToString(sum[:]), blob.SHA256)
+	assert.Equal(t, "jpeg", blob.Format)
+}
+
+func TestUploadImage_NotAnImage(t *testing.T) {
+	h, dir := newUploadTestHandler(t)
+	body, ct := multipartBody(t, formPart{name: "file", filename: "notes.png", content: []byte("plain text")})
+	w := postUpload(h, body, ct)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), api.ErrInvalidImage.Message)
+	assert.Empty(t, storedOriginals(t, dir))
+	count, err := h.DB.CountImages(t.Context(), testAccountID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestUploadImage_BodyReadError(t *testing.T) {
+	h, dir := newUploadTestHandler(t)
+	body, ct := multipartBody(t, formPart{name: "file", filename: "photo.jpg", content: testJPEG(t)})
+
+	// The client's body fails partway through the file.
+	r := chi.NewRouter()
+	r.With(api.AccountIDMiddleware).Post("/accounts/{account_id}/images/v1", h.UploadImage)
+	broken := io.MultiReader(io.LimitReader(body, int64(body.Len()/2)), iotest.ErrReader(errors.New("connection reset")))
+	req := httptest.NewRequest(http.MethodPost, "/accounts/"+testAccountID+"/images/v1", broken)
+	req.Header.Set("Content-Type", ct)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), api.ErrInvalidUpload.Message)
+	assert.Empty(t, storedOriginals(t, dir))
+}
+
+func TestUploadImage_URLFromFixtureOrigin(t *testing.T) {
+	h, dir := newUploadTestHandler(t)
+
+	origin := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(origin, "images.example.com", "cats"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "images.example.com", "cats", "tabby.png"), testPNG(t), 0644))
+	h.Fetcher = fetch.NewFixtureFetcher(origin, 0)
+
+	body, ct := multipartBody(t, formPart{name: "url", content: []byte("https://images.example.com/cats/tabby.png?w=100")})
+	w := postUpload(h, body, ct)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Result model.Image `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "tabby.png", resp.Result.Filename)
+	assert.Len(t, storedOriginals(t, dir), 1)
+}
+
+func TestUploadImage_URLErrors(t *testing.T) {
+	origin := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(origin, "example.com"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "example.com", "big.png"), make([]byte, 64), 0644))
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{"missing fixture", "https://example.com/nope.png", http.StatusBadRequest},
+		{"bad scheme", "file:///etc/passwd", http.StatusBadRequest},
+		{"too large", "https://example.com/big.png", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, dir := newUploadTestHandler(t)
+			h.Fetcher = fetch.NewFixtureFetcher(origin, 16)
+
+			body, ct := multipartBody(t, formPart{name: "url", content: []byte(tt.url)})
+			w := postUpload(h, body, ct)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			assert.Empty(t, storedOriginals(t, dir))
+		})
+	}
+}
+
+func TestUploadImage_ClientGone(t *testing.T) {
+	h, dir := newUploadTestHandler(t)
+	body, ct := multipartBody(t, formPart{name: "file", filename: "photo.jpg", content: testJPEG(t)})
+
+	r := chi.NewRouter()
+	r.With(api.AccountIDMiddleware).Post("/accounts/{account_id}/images/v1", h.UploadImage)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/accounts/"+testAccountID+"/images/v1", body).WithContext(ctx)
+	req.Header.Set("Content-Type", ct)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Empty(t, storedOriginals(t, dir))
+	count, err := h.DB.CountImages(t.Context(), testAccountID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
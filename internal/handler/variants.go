@@ -2,8 +2,8 @@ package handler
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/leca/dt-cloudflare-images/internal/api"
@@ -19,9 +19,6 @@ var validFitModes = map[string]bool{
 	"pad":        true,
 }
 
-// maxVariantsPerAccount is the Cloudflare Images limit on variants.
-const maxVariantsPerAccount = 100
-
 // createVariantRequest is the JSON body for creating a variant.
 type createVariantRequest struct {
 	ID                     string                `json:"id"`
@@ -41,28 +38,17 @@ func (h *Handler) CreateVariant(w http.ResponseWriter, r *http.Request) {
 
 	var req createVariantRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		api.BadRequest(w, "invalid JSON body")
+		api.WriteError(w, api.ErrInvalidJSON)
 		return
 	}
 
 	if req.ID == "" {
-		api.BadRequest(w, "variant id is required")
+		api.WriteError(w, api.ErrVariantIDRequired)
 		return
 	}
 
 	if !validFitModes[req.Options.Fit] {
-		api.BadRequest(w, "invalid fit mode: must be one of scale-down, contain, cover, crop, pad")
-		return
-	}
-
-	// Check variant count limit.
-	count, err := h.DB.CountVariants(accountID)
-	if err != nil {
-		api.BadRequest(w, "failed to count variants")
-		return
-	}
-	if count >= maxVariantsPerAccount {
-		api.BadRequest(w, "maximum number of variants reached")
+		api.WriteError(w, api.ErrInvalidFit)
 		return
 	}
 
@@ -73,15 +59,15 @@ func (h *Handler) CreateVariant(w http.ResponseWriter, r *http.Request) {
 		NeverRequireSignedURLs: req.NeverRequireSignedURLs,
 	}
 
-	if err := h.DB.CreateVariant(variant); err != nil {
-		if strings.Contains(err.Error(), "UNIQUE") || strings.Contains(err.Error(), "unique") {
-			api.Conflict(w, "variant already exists")
-			return
-		}
-		api.BadRequest(w, "failed to create variant")
+	if err := h.DB.CreateVariant(r.Context(), variant); err != nil {
+		api.WriteError(w, err, api.ErrVariantExists, api.ErrTooManyVariants)
 		return
 	}
 
+	if h.Warmer != nil {
+		h.Warmer.WarmVariant(accountID, variant.Options)
+	}
+
 	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(variant))
 }
 
@@ -89,9 +75,9 @@ func (h *Handler) CreateVariant(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) ListVariants(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 
-	variants, err := h.DB.ListVariants(accountID)
+	variants, err := h.DB.ListVariants(r.Context(), accountID)
 	if err != nil {
-		api.BadRequest(w, "failed to list variants")
+		api.WriteError(w, fmt.Errorf("failed to list variants: %w", err))
 		return
 	}
 
@@ -113,9 +99,9 @@ func (h *Handler) GetVariant(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 	variantID := chi.URLParam(r, "variant_id")
 
-	variant, err := h.DB.GetVariant(accountID, variantID)
+	variant, err := h.DB.GetVariant(r.Context(), accountID, variantID)
 	if err != nil {
-		api.NotFound(w, "variant not found")
+		api.WriteError(w, err, api.ErrVariantNotFound)
 		return
 	}
 
@@ -127,21 +113,22 @@ func (h *Handler) UpdateVariant(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 	variantID := chi.URLParam(r, "variant_id")
 
-	existing, err := h.DB.GetVariant(accountID, variantID)
+	existing, err := h.DB.GetVariant(r.Context(), accountID, variantID)
 	if err != nil {
-		api.NotFound(w, "variant not found")
+		api.WriteError(w, err, api.ErrVariantNotFound)
 		return
 	}
 
 	var req updateVariantRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		api.BadRequest(w, "invalid JSON body")
+		api.WriteError(w, api.ErrInvalidJSON)
 		return
 	}
 
+	oldOptions := existing.Options
 	if req.Options != nil {
 		if req.Options.Fit != "" && !validFitModes[req.Options.Fit] {
-			api.BadRequest(w, "invalid fit mode: must be one of scale-down, contain, cover, crop, pad")
+			api.WriteError(w, api.ErrInvalidFit)
 			return
 		}
 		if req.Options.Fit != "" {
@@ -162,11 +149,18 @@ func (h *Handler) UpdateVariant(w http.ResponseWriter, r *http.Request) {
 		existing.NeverRequireSignedURLs = *req.NeverRequireSignedURLs
 	}
 
-	if err := h.DB.UpdateVariant(existing); err != nil {
-		api.BadRequest(w, "failed to update variant")
+	if err := h.DB.UpdateVariant(r.Context(), existing); err != nil {
+		api.WriteError(w, fmt.Errorf("failed to update variant: %w", err))
 		return
 	}
 
+	if h.Cache != nil && existing.Options != oldOptions {
+		h.Cache.InvalidateKey(accountID, variantCacheKey(oldOptions))
+	}
+	if h.Warmer != nil {
+		h.Warmer.WarmVariant(accountID, existing.Options)
+	}
+
 	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(existing))
 }
 
@@ -175,10 +169,20 @@ func (h *Handler) DeleteVariant(w http.ResponseWriter, r *http.Request) {
 	accountID := api.GetAccountID(r.Context())
 	variantID := chi.URLParam(r, "variant_id")
 
-	if err := h.DB.DeleteVariant(accountID, variantID); err != nil {
-		api.NotFound(w, "variant not found")
+	existing, err := h.DB.GetVariant(r.Context(), accountID, variantID)
+	if err != nil {
+		api.WriteError(w, err, api.ErrVariantNotFound)
+		return
+	}
+
+	if err := h.DB.DeleteVariant(r.Context(), accountID, variantID); err != nil {
+		api.WriteError(w, err, api.ErrVariantNotFound)
 		return
 	}
 
+	if h.Cache != nil {
+		h.Cache.InvalidateKey(accountID, variantCacheKey(existing.Options))
+	}
+
 	api.WriteJSON(w, http.StatusOK, api.SuccessResponse(struct{}{}))
 }
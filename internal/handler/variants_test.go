@@ -34,8 +34,7 @@ func setupVariantTestRouter(h *Handler) http.Handler {
 
 func newTestHandler(t *testing.T) *Handler {
 	t.Helper()
-	db, err := database.NewSQLiteDB("file::memory:?cache=shared")
-	require.NoError(t, err)
+	db := database.NewMemoryDB()
 	t.Cleanup(func() { db.Close() })
 
 	tmpDir := t.TempDir()
@@ -225,6 +224,38 @@ func TestGetVariant_NotFound(t *testing.T) {
 	assert.False(t, resp.Success)
 }
 
+func TestGetVariant_DatabaseFailure(t *testing.T) {
+	h := newTestHandler(t)
+	router := setupVariantTestRouter(h)
+	require.NoError(t, h.DB.Close())
+
+	req := httptest.NewRequest(http.MethodGet, "/accounts/"+testAccountID+"/images/v1/variants/hero", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	var resp api.Response
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.Success)
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "Internal error", resp.Errors[0].Message)
+}
+
+func TestCreateVariant_Duplicate(t *testing.T) {
+	h := newTestHandler(t)
+	router := setupVariantTestRouter(h)
+
+	body := `{"id": "hero", "options": {"fit": "scale-down", "width": 100, "height": 100, "metadata": "none"}}`
+	for i, want := range []int{http.StatusOK, http.StatusConflict} {
+		req := httptest.NewRequest(http.MethodPost, "/accounts/"+testAccountID+"/images/v1/variants", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Code, "request %d: %s", i, w.Body.String())
+	}
+}
+
 func TestUpdateVariant(t *testing.T) {
 	h := newTestHandler(t)
 	router := setupVariantTestRouter(h)
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/imageproc"
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/leca/dt-cloudflare-images/internal/storage"
+)
+
+// warmPageSize is the number of images fetched per page when warming a
+// variant across an account.
+const warmPageSize = 1000
+
+// warmJob renders one image with one set of variant options.
+type warmJob struct {
+	accountID string
+	imageID   string
+	options   model.VariantOptions
+}
+
+// Warmer pre-renders named variants into the derivative cache in the
+// background so that the first delivery of a fresh image is a cache hit.
+// Work is processed by a fixed number of workers from a bounded queue; jobs
+// submitted from request paths are dropped when the queue is full.
+type Warmer struct {
+	DB    database.Database
+	Store storage.Storage
+	Cache *storage.DerivativeCache
+	Pool  *imageproc.Pool
+
+	// Limits bounds each render; zero fields take the imageproc defaults.
+	Limits imageproc.Limits
+
+	// ctx is cancelled by Close, aborting in-flight listings and renders.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	jobs    chan warmJob
+	done    chan struct{}
+	workers sync.WaitGroup
+	// listers counts the WarmVariant listings in progress.
+	listers sync.WaitGroup
+	closeMu sync.Once
+
+	// mu guards pending, the number of queued jobs and listings, and
+	// closed; idle is signalled when pending drops to zero.
+	mu      sync.Mutex
+	idle    *sync.Cond
+	pending int
+	closed  bool
+}
+
+// NewWarmer starts a Warmer with the given number of workers and queue size.
+// Renders run on pool when it is non-nil; it should not be the delivery
+// pool, or warming would take the capacity of live requests.
+func NewWarmer(db database.Database, store storage.Storage, cache *storage.DerivativeCache, pool *imageproc.Pool, workers, queueSize int) *Warmer {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wm := &Warmer{
+		DB:     db,
+		Store:  store,
+		Cache:  cache,
+		Pool:   pool,
+		ctx:    ctx,
+		cancel: cancel,
+		jobs:   make(chan warmJob, queueSize),
+		done:   make(chan struct{}),
+	}
+	wm.idle = sync.NewCond(&wm.mu)
+	wm.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go wm.work()
+	}
+	return wm
+}
+
+// WarmImage queues rendering of every variant of the account for one image.
+func (wm *Warmer) WarmImage(accountID, imageID string) {
+	variants, err := wm.DB.ListVariants(wm.ctx, accountID)
+	if err != nil {
+		log.Printf("Warmer: failed to list variants: %v", err)
+		return
+	}
+	for _, v := range variants {
+		wm.tryEnqueue(warmJob{accountID: accountID, imageID: imageID, options: v.Options})
+	}
+}
+
+// WarmVariant queues rendering of one variant for every image in the
+// account. Images are listed in the background; the listing waits for queue
+// space rather than dropping work.
+func (wm *Warmer) WarmVariant(accountID string, options model.VariantOptions) {
+	wm.mu.Lock()
+	if wm.closed {
+		wm.mu.Unlock()
+		return
+	}
+	wm.pending++
+	wm.listers.Add(1)
+	wm.mu.Unlock()
+	go func() {
+		defer wm.listers.Done()
+		defer wm.finish()
+		for page := 1; ; page++ {
+			images, _, err := wm.DB.ListImages(wm.ctx, accountID, page, warmPageSize)
+			if err != nil {
+				log.Printf("Warmer: failed to list images: %v", err)
+				return
+			}
+			for _, img := range images {
+				if !wm.enqueue(warmJob{accountID: accountID, imageID: img.ID, options: options}) {
+					return
+				}
+			}
+			if len(images) < warmPageSize {
+				return
+			}
+		}
+	}()
+}
+
+// Wait blocks until all queued work has been processed, or discarded by
+// Close.
+func (wm *Warmer) Wait() {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	for wm.pending > 0 {
+		wm.idle.Wait()
+	}
+}
+
+// Close stops the workers. Queued jobs that have not started are discarded,
+// and work submitted afterwards is ignored.
+func (wm *Warmer) Close() {
+	wm.closeMu.Do(func() {
+		wm.mu.Lock()
+		wm.closed = true
+		wm.mu.Unlock()
+		close(wm.done)
+		wm.cancel()
+		wm.listers.Wait()
+		wm.workers.Wait()
+		// Nothing can be queued any more.
+		for {
+			select {
+			case <-wm.jobs:
+				wm.finish()
+			default:
+				return
+			}
+		}
+	})
+}
+
+// finish counts one queued job or listing as done.
+func (wm *Warmer) finish() {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	wm.pending--
+	if wm.pending == 0 {
+		wm.idle.Broadcast()
+	}
+}
+
+// tryEnqueue queues a job without blocking, dropping it if the queue is full
+// or the Warmer is closed.
+func (wm *Warmer) tryEnqueue(job warmJob) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.closed {
+		return
+	}
+	select {
+	case wm.jobs <- job:
+		wm.pending++
+	default:
+	}
+}
+
+// enqueue queues a job, waiting for space. It returns false once the Warmer
+// is closed. Only listings call it, and Close waits for them before it
+// discards the queue.
+func (wm *Warmer) enqueue(job warmJob) bool {
+	wm.mu.Lock()
+	if wm.closed {
+		wm.mu.Unlock()
+		return false
+	}
+	wm.pending++
+	wm.mu.Unlock()
+	select {
+	case wm.jobs <- job:
+		return true
+	case <-wm.done:
+		wm.finish()
+		return false
+	}
+}
+
+func (wm *Warmer) work() {
+	defer wm.workers.Done()
+	for {
+		select {
+		case <-wm.done:
+			return
+		case job := <-wm.jobs:
+			wm.render(job)
+			wm.finish()
+		}
+	}
+}
+
+// render transforms the original and stores the result in the cache,
+// skipping outputs that are already cached.
+func (wm *Warmer) render(job warmJob) {
+	if wm.Cache.Contains(job.accountID, job.imageID, variantCacheKey(job.options)) {
+		return
+	}
+	if _, _, err := renderVariant(wm.ctx, wm.Pool, wm.Limits, wm.Store, wm.Cache, job.accountID, job.imageID, job.options); err != nil && !errors.Is(err, imageproc.ErrSaturated) && !errors.Is(err, context.Canceled) {
+		log.Printf("Warmer: failed to render %s/%s: %v", job.accountID, job.imageID, err)
+	}
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/leca/dt-cloudflare-images/internal/api"
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// enableWarmer attaches a derivative cache and a warmer to the handler.
+func enableWarmer(t *testing.T, h *Handler, workers, queueSize int) {
+	t.Helper()
+	enableDerivativeCache(t, h)
+	h.Warmer = NewWarmer(h.DB, h.Store, h.Cache, nil, workers, queueSize)
+	t.Cleanup(h.Warmer.Close)
+}
+
+func TestWarmer_WarmImage(t *testing.T) {
+	h := newTestHandler(t)
+	enableWarmer(t, h, 2, 10)
+
+	seedImageAndVariant(t, h, "img-1", "thumb", testJPEG(t), false, false)
+	large := model.VariantOptions{Fit: "contain", Width: 8, Height: 8, Metadata: "none"}
+	require.NoError(t, h.DB.CreateVariant(t.Context(), &model.Variant{ID: "large", AccountID: testAccountID, Options: large}))
+
+	h.Warmer.WarmImage(testAccountID, "img-1")
+	h.Warmer.Wait()
+
+	thumb, err := h.DB.GetVariant(t.Context(), testAccountID, "thumb")
+	require.NoError(t, err)
+	assert.True(t, h.Cache.Contains(testAccountID, "img-1", variantCacheKey(thumb.Options)))
+	assert.True(t, h.Cache.Contains(testAccountID, "img-1", variantCacheKey(large)))
+}
+
+func TestWarmer_WarmVariant(t *testing.T) {
+	h := newTestHandler(t)
+	enableWarmer(t, h, 2, 1)
+
+	data := testJPEG(t)
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("img-%d", i)
+		require.NoError(t, h.DB.CreateImage(t.Context(), &model.Image{ID: id, AccountID: testAccountID, Uploaded: time.Now().UTC()}))
+		_, err := h.Store.Store(t.Context(), testAccountID, id, bytes.NewReader(data))
+		require.NoError(t, err)
+	}
+
+	opts := model.VariantOptions{Fit: "cover", Width: 1, Height: 1, Metadata: "none"}
+	h.Warmer.WarmVariant(testAccountID, opts)
+	h.Warmer.Wait()
+
+	// Even with a queue of one, every image is rendered.
+	for i := 0; i < 5; i++ {
+		assert.True(t, h.Cache.Contains(testAccountID, fmt.Sprintf("img-%d", i), variantCacheKey(opts)))
+	}
+}
+
+func TestWarmer_SkipsMissingOriginals(t *testing.T) {
+	h := newTestHandler(t)
+	enableWarmer(t, h, 1, 10)
+
+	require.NoError(t, h.DB.CreateImage(t.Context(), &model.Image{ID: "img-1", AccountID: testAccountID, Uploaded: time.Now().UTC()}))
+	require.NoError(t, h.DB.CreateVariant(t.Context(), &model.Variant{
+		ID:        "thumb",
+		AccountID: testAccountID,
+		Options:   model.VariantOptions{Fit: "scale-down", Width: 10, Height: 10, Metadata: "none"},
+	}))
+
+	h.Warmer.WarmImage(testAccountID, "img-1")
+	h.Warmer.Wait()
+
+	assert.Equal(t, int64(0), h.Cache.Size())
+}
+
+func TestWarmer_CloseIsIdempotent(t *testing.T) {
+	h := newTestHandler(t)
+	enableWarmer(t, h, 1, 1)
+
+	h.Warmer.Close()
+	h.Warmer.Close()
+
+	// Work submitted after Close is discarded without blocking.
+	h.Warmer.WarmVariant(testAccountID, model.VariantOptions{Fit: "scale-down"})
+	h.Warmer.Wait()
+}
+
+func TestWarmer_CloseDiscardsQueuedJobs(t *testing.T) {
+	h := newTestHandler(t)
+	enableWarmer(t, h, 1, 10)
+	for _, id := range []string{"thumb", "large", "small"} {
+		require.NoError(t, h.DB.CreateVariant(t.Context(), &model.Variant{
+			ID:        id,
+			AccountID: testAccountID,
+			Options:   model.VariantOptions{Fit: "scale-down", Width: 10, Height: 10, Metadata: "none"},
+		}))
+	}
+
+	// Jobs are queued for an image that is never stored, and some may
+	// still be queued when the Warmer closes.
+	h.Warmer.WarmImage(testAccountID, "img-1")
+	h.Warmer.Close()
+	h.Warmer.WarmImage(testAccountID, "img-2")
+
+	done := make(chan struct{})
+	go func() {
+		h.Warmer.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait blocked after Close")
+	}
+}
+
+func TestUploadImage_WarmsVariants(t *testing.T) {
+	h := newTestHandler(t)
+	h.Config.BaseURL = "http://localhost:8080"
+	enableWarmer(t, h, 1, 10)
+
+	opts := model.VariantOptions{Fit: "scale-down", Width: 1, Height: 1, Metadata: "none"}
+	require.NoError(t, h.DB.CreateVariant(t.Context(), &model.Variant{ID: "thumb", AccountID: testAccountID, Options: opts}))
+
+	r := chi.NewRouter()
+	r.With(api.AccountIDMiddleware).Post("/accounts/{account_id}/images/v1", h.UploadImage)
+	r.Get("/cdn/{account_id}/{image_id}/{variant_name}", h.DeliverImage)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "photo.jpg")
+	require.NoError(t, err)
+	_, err = fw.Write(testJPEG(t))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/accounts/"+testAccountID+"/images/v1", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Result model.Image `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	h.Warmer.Wait()
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cdn/"+testAccountID+"/"+resp.Result.ID+"/thumb", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "HIT", w.Header().Get("cf-cache-status"))
+}
+
+func TestCreateVariant_WarmsExistingImages(t *testing.T) {
+	h := newTestHandler(t)
+	enableWarmer(t, h, 1, 10)
+	router := setupVariantTestRouter(h)
+
+	require.NoError(t, h.DB.CreateImage(t.Context(), &model.Image{ID: "img-1", AccountID: testAccountID, Uploaded: time.Now().UTC()}))
+	_, err := h.Store.Store(t.Context(), testAccountID, "img-1", bytes.NewReader(testPNG(t)))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/accounts/"+testAccountID+"/images/v1/variants",
+		bytes.NewBufferString(createVariantJSON("thumb", "scale-down", 1, 1)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	h.Warmer.Wait()
+
+	opts := model.VariantOptions{Fit: "scale-down", Width: 1, Height: 1, Metadata: "none"}
+	assert.True(t, h.Cache.Contains(testAccountID, "img-1", variantCacheKey(opts)))
+}
@@ -0,0 +1,96 @@
+package imageproc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Default limits, matching those Cloudflare applies to image transformations.
+const (
+	DefaultMaxInputBytes      = 70 << 20
+	DefaultMaxPixels          = 100_000_000
+	DefaultMaxDimension       = 12_000
+	DefaultMaxOutputDimension = 12_000
+)
+
+// ErrLimitExceeded matches every *LimitError.
+var ErrLimitExceeded = errors.New("image limit exceeded")
+
+// LimitError reports a source image rejected by Limits. Code is the
+// Cloudflare delivery error code describing the violation.
+type LimitError struct {
+	Code    int
+	Message string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("ERROR %d: %s", e.Code, e.Message)
+}
+
+// Is makes errors.Is(err, ErrLimitExceeded) true for any LimitError.
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// Limits bounds the resources a single transform may use. Zero fields take
+// the corresponding default.
+type Limits struct {
+	// MaxInputBytes is the largest source file accepted.
+	MaxInputBytes int64
+	// MaxPixels is the largest source area (width × height) accepted.
+	MaxPixels int64
+	// MaxDimension is the largest source width or height accepted.
+	MaxDimension int
+	// MaxOutputDimension caps the requested output width and height.
+	MaxOutputDimension int
+}
+
+// DefaultLimits returns the limits used by Transform.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxInputBytes:      DefaultMaxInputBytes,
+		MaxPixels:          DefaultMaxPixels,
+		MaxDimension:       DefaultMaxDimension,
+		MaxOutputDimension: DefaultMaxOutputDimension,
+	}
+}
+
+// withDefaults fills zero fields from DefaultLimits.
+func (l Limits) withDefaults() Limits {
+	d := DefaultLimits()
+	if l.MaxInputBytes <= 0 {
+		l.MaxInputBytes = d.MaxInputBytes
+	}
+	if l.MaxPixels <= 0 {
+		l.MaxPixels = d.MaxPixels
+	}
+	if l.MaxDimension <= 0 {
+		l.MaxDimension = d.MaxDimension
+	}
+	if l.MaxOutputDimension <= 0 {
+		l.MaxOutputDimension = d.MaxOutputDimension
+	}
+	return l
+}
+
+// checkSize rejects sources whose declared dimensions exceed the limits.
+func (l Limits) checkSize(width, height int) error {
+	if width > l.MaxDimension || height > l.MaxDimension {
+		return &LimitError{
+			Code:    9413,
+			Message: fmt.Sprintf("image dimensions %dx%d exceed the maximum of %d pixels per side", width, height, l.MaxDimension),
+		}
+	}
+	if int64(width)*int64(height) > l.MaxPixels {
+		return &LimitError{
+			Code:    9413,
+			Message: fmt.Sprintf("image area of %d pixels exceeds the maximum of %d", int64(width)*int64(height), l.MaxPixels),
+		}
+	}
+	return nil
+}
+
+// capOutput clamps requested output dimensions to MaxOutputDimension.
+func (l Limits) capOutput(width, height int) (int, int) {
+	return min(width, l.MaxOutputDimension), min(height, l.MaxOutputDimension)
+}
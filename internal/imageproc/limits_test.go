@@ -0,0 +1,96 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/leca/dt-cloudflare-images/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pngBomb returns a tiny PNG whose header declares a w x h canvas. Only the
+// signature and IHDR chunk are present, which is all DecodeConfig reads.
+func pngBomb(w, h uint32) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'})
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], w)
+	binary.BigEndian.PutUint32(ihdr[4:8], h)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // RGBA
+
+	chunk := append([]byte("IHDR"), ihdr...)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	buf.Write(chunk)
+	_ = binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestTransform_RejectsDecompressionBomb(t *testing.T) {
+	data := pngBomb(50000, 50000)
+	require.Less(t, len(data), 100)
+
+	_, _, err := Transform(bytes.NewReader(data), model.VariantOptions{Fit: "scale-down", Width: 100, Height: 100})
+	require.ErrorIs(t, err, ErrLimitExceeded)
+
+	var le *LimitError
+	require.ErrorAs(t, err, &le)
+	assert.Equal(t, 9413, le.Code)
+}
+
+func TestTransformWithLimits_MaxPixels(t *testing.T) {
+	data := createTestPNG(t, 100, 100)
+
+	_, _, err := TransformWithLimits(context.Background(), bytes.NewReader(data), model.VariantOptions{}, Limits{MaxPixels: 9999})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+
+	_, _, err = TransformWithLimits(context.Background(), bytes.NewReader(data), model.VariantOptions{}, Limits{MaxPixels: 10000})
+	assert.NoError(t, err)
+}
+
+func TestTransformWithLimits_MaxDimension(t *testing.T) {
+	data := createTestJPEG(t, 200, 10)
+
+	_, _, err := TransformWithLimits(context.Background(), bytes.NewReader(data), model.VariantOptions{}, Limits{MaxDimension: 199})
+	var le *LimitError
+	require.ErrorAs(t, err, &le)
+	assert.Equal(t, 9413, le.Code)
+}
+
+func TestTransformWithLimits_MaxInputBytes(t *testing.T) {
+	data := createTestJPEG(t, 50, 50)
+
+	_, _, err := TransformWithLimits(context.Background(), bytes.NewReader(data), model.VariantOptions{}, Limits{MaxInputBytes: int64(len(data) - 1)})
+	var le *LimitError
+	require.ErrorAs(t, err, &le)
+	assert.Equal(t, 9402, le.Code)
+
+	_, _, err = TransformWithLimits(context.Background(), bytes.NewReader(data), model.VariantOptions{}, Limits{MaxInputBytes: int64(len(data))})
+	assert.NoError(t, err)
+}
+
+func TestTransformWithLimits_GIFChecked(t *testing.T) {
+	data := createTestGIF(t, 100, 100)
+
+	_, _, err := TransformWithLimits(context.Background(), bytes.NewReader(data), model.VariantOptions{}, Limits{MaxDimension: 50})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+}
+
+func TestTransformWithLimits_CapsOutputDimensions(t *testing.T) {
+	data := createTestJPEG(t, 10, 10)
+
+	out, _, err := TransformWithLimits(context.Background(), bytes.NewReader(data), model.VariantOptions{
+		Fit:    "contain",
+		Width:  500,
+		Height: 500,
+	}, Limits{MaxOutputDimension: 40})
+	require.NoError(t, err)
+	w, h := decodeSize(t, out)
+	assert.Equal(t, 40, w)
+	assert.Equal(t, 40, h)
+}
@@ -0,0 +1,120 @@
+package imageproc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrSaturated is returned by Pool.Do when every worker is busy and the
+// wait queue is full.
+var ErrSaturated = errors.New("transform pool saturated")
+
+// ErrTimeout is returned by Pool.Do when a transform does not complete
+// within the pool's timeout.
+var ErrTimeout = errors.New("transform timed out")
+
+// RenderFunc produces encoded image bytes and their format. It should give
+// up once ctx is done.
+type RenderFunc func(ctx context.Context) ([]byte, string, error)
+
+// Pool bounds the number of transforms running at once. At most workers
+// renders run concurrently and at most queueSize more wait for a worker;
+// beyond that Do fails fast with ErrSaturated. Concurrent calls with the same
+// key share a single render.
+type Pool struct {
+	slots   chan struct{}
+	admit   chan struct{}
+	timeout time.Duration
+	group   singleflight.Group
+}
+
+// renderResult carries a RenderFunc's output through singleflight.
+type renderResult struct {
+	data   []byte
+	format string
+}
+
+// NewPool creates a Pool. A timeout of zero or less disables the timeout.
+func NewPool(workers, queueSize int, timeout time.Duration) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &Pool{
+		slots:   make(chan struct{}, workers),
+		admit:   make(chan struct{}, workers+queueSize),
+		timeout: timeout,
+	}
+}
+
+// Do runs render on a pool worker and returns its result. Calls that share
+// key while a render is in flight wait for that render instead of starting
+// their own. Do returns ctx.Err() if ctx is done first, and ErrTimeout if the
+// render (including time spent queued) exceeds the pool's timeout.
+//
+// The render's context carries the values of the ctx that started it but is
+// cancelled only by the timeout, since other callers may be waiting for it.
+// A render keeps its worker, and its place in the queue, until it returns,
+// so one that ignores its context still counts against the pool's bounds.
+func (p *Pool) Do(ctx context.Context, key string, render RenderFunc) ([]byte, string, error) {
+	ch := p.group.DoChan(key, func() (interface{}, error) {
+		return p.run(context.WithoutCancel(ctx), render)
+	})
+
+	var expired <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, "", res.Err
+		}
+		out, _ := res.Val.(renderResult)
+		return out.data, out.format, nil
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	case <-expired:
+		return nil, "", ErrTimeout
+	}
+}
+
+// run admits render to the queue, waits for a worker and executes it with
+// a context that the pool's timeout cancels.
+func (p *Pool) run(ctx context.Context, render RenderFunc) (interface{}, error) {
+	select {
+	case p.admit <- struct{}{}:
+	default:
+		return nil, ErrSaturated
+	}
+	defer func() { <-p.admit }()
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	}
+	defer func() { <-p.slots }()
+
+	data, format, err := render(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, ErrTimeout
+		}
+		return nil, err
+	}
+	return renderResult{data: data, format: format}, nil
+}
@@ -0,0 +1,134 @@
+package imageproc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingRender returns a RenderFunc that signals started and then waits for
+// release before returning data.
+func blockingRender(started chan<- struct{}, release <-chan struct{}, data string) RenderFunc {
+	return func(context.Context) ([]byte, string, error) {
+		if started != nil {
+			started <- struct{}{}
+		}
+		<-release
+		return []byte(data), "png", nil
+	}
+}
+
+func TestPool_Do(t *testing.T) {
+	p := NewPool(2, 2, time.Second)
+
+	data, format, err := p.Do(context.Background(), "k", func(context.Context) ([]byte, string, error) {
+		return []byte("out"), "jpeg", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("out"), data)
+	assert.Equal(t, "jpeg", format)
+}
+
+func TestPool_Saturated(t *testing.T) {
+	p := NewPool(1, 1, time.Minute)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _, _ = p.Do(context.Background(), "a", blockingRender(started, release, "a"))
+	}()
+	<-started // "a" holds the worker.
+	go func() {
+		defer wg.Done()
+		_, _, _ = p.Do(context.Background(), "b", blockingRender(started, release, "b"))
+	}()
+
+	// Wait until "b" has been admitted to the queue.
+	require.Eventually(t, func() bool { return len(p.admit) == 2 }, time.Second, time.Millisecond)
+
+	_, _, err := p.Do(context.Background(), "c", blockingRender(nil, release, "c"))
+	assert.ErrorIs(t, err, ErrSaturated)
+
+	close(release)
+	wg.Wait()
+}
+
+func TestPool_SingleflightSharesRender(t *testing.T) {
+	p := NewPool(4, 4, time.Minute)
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	render := func(context.Context) ([]byte, string, error) {
+		calls.Add(1)
+		<-release
+		return []byte("shared"), "png", nil
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	results := make([][]byte, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, _, err := p.Do(context.Background(), "same", render)
+			assert.NoError(t, err)
+			results[i] = data
+		}()
+	}
+
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	// Give the remaining callers time to join the in-flight render.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	for _, r := range results {
+		assert.Equal(t, []byte("shared"), r)
+	}
+}
+
+func TestPool_Timeout(t *testing.T) {
+	p := NewPool(1, 0, 20*time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+
+	_, _, err := p.Do(context.Background(), "slow", blockingRender(nil, release, "slow"))
+	assert.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestPool_TimeoutCancelsRender(t *testing.T) {
+	p := NewPool(1, 0, 20*time.Millisecond)
+	returned := make(chan struct{})
+
+	_, _, err := p.Do(context.Background(), "slow", func(ctx context.Context) ([]byte, string, error) {
+		defer close(returned)
+		<-ctx.Done()
+		return nil, "", ctx.Err()
+	})
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	// The worker is released once the render gives up.
+	<-returned
+	require.Eventually(t, func() bool { return len(p.slots) == 0 && len(p.admit) == 0 }, time.Second, time.Millisecond)
+}
+
+func TestPool_ContextCanceled(t *testing.T) {
+	p := NewPool(1, 0, time.Minute)
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := p.Do(ctx, "k", blockingRender(nil, release, "k"))
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -2,6 +2,7 @@ package imageproc
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
 	"image/gif"
@@ -54,42 +55,92 @@ func IsSVG(data []byte) bool {
 		bytes.Contains([]byte(header), []byte("<?xml")) && bytes.Contains([]byte(header), []byte("<svg"))
 }
 
+// OutputFormat reports the format Transform produces for a source whose
+// leading bytes are header: "svg", or the result of DetectFormat otherwise.
+// The first 512 bytes of the source are sufficient.
+func OutputFormat(header []byte) string {
+	if IsSVG(header) {
+		return "svg"
+	}
+	return DetectFormat(header)
+}
+
 // Transform applies the variant options to the source image data and returns
 // the processed image bytes and the output format (e.g., "jpeg", "png").
+// The source is checked against DefaultLimits.
 func Transform(src io.Reader, opts model.VariantOptions) ([]byte, string, error) {
-	data, err := io.ReadAll(src)
+	return TransformWithLimits(context.Background(), src, opts, DefaultLimits())
+}
+
+// TransformWithLimits is like Transform but checks the source against limits.
+// Sources that are too large, in bytes or in declared dimensions, are
+// rejected with a *LimitError before any pixels are decoded. Reading,
+// decoding and encoding stop with ctx.Err() once ctx is done.
+func TransformWithLimits(ctx context.Context, src io.Reader, opts model.VariantOptions, limits Limits) ([]byte, string, error) {
+	limits = limits.withDefaults()
+
+	data, err := io.ReadAll(io.LimitReader(contextReader{ctx, src}, limits.MaxInputBytes+1))
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
 		return nil, "", fmt.Errorf("reading source: %w", err)
 	}
+	if int64(len(data)) > limits.MaxInputBytes {
+		return nil, "", &LimitError{
+			Code:    9402,
+			Message: fmt.Sprintf("image exceeds the maximum file size of %d bytes", limits.MaxInputBytes),
+		}
+	}
+
+	format := OutputFormat(data)
 
 	// SVG passthrough: return as-is.
-	if IsSVG(data) {
+	if format == "svg" {
 		return data, "svg", nil
 	}
 
-	format := DetectFormat(data)
+	if format == "" {
+		return nil, "", fmt.Errorf("unsupported or unrecognized image format")
+	}
+
+	// Check the declared dimensions before decoding, so that a small file
+	// declaring a huge canvas never gets its pixels allocated.
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding image header: %w", err)
+	}
+	if err := limits.checkSize(cfg.Width, cfg.Height); err != nil {
+		return nil, "", err
+	}
 
 	// GIF passthrough: return as-is (no frame-by-frame processing).
 	if format == "gif" {
 		return data, "gif", nil
 	}
 
-	if format == "" {
-		return nil, "", fmt.Errorf("unsupported or unrecognized image format")
-	}
-
 	// Decode the image.
-	img, _, err := image.Decode(bytes.NewReader(data))
+	img, _, err := image.Decode(contextReader{ctx, bytes.NewReader(data)})
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
 		return nil, "", fmt.Errorf("decoding image: %w", err)
 	}
 
 	// Apply transformation based on fit mode.
+	opts.Width, opts.Height = limits.capOutput(opts.Width, opts.Height)
 	img = applyFit(img, opts)
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
 
 	// Encode back to the original format.
-	out, err := encodeImage(img, format)
+	out, err := encodeImage(ctx, img, format)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
 		return nil, "", fmt.Errorf("encoding image: %w", err)
 	}
 
@@ -187,21 +238,22 @@ func fitPad(img image.Image, targetW, targetH int) image.Image {
 }
 
 // encodeImage encodes an image to the specified format and returns the bytes.
-func encodeImage(img image.Image, format string) ([]byte, error) {
+func encodeImage(ctx context.Context, img image.Image, format string) ([]byte, error) {
 	var buf bytes.Buffer
+	w := contextWriter{ctx, &buf}
 	switch format {
 	case "jpeg":
-		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		err := jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
 		if err != nil {
 			return nil, err
 		}
 	case "png":
-		err := png.Encode(&buf, img)
+		err := png.Encode(w, img)
 		if err != nil {
 			return nil, err
 		}
 	case "gif":
-		err := gif.Encode(&buf, img, nil)
+		err := gif.Encode(w, img, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -210,3 +262,31 @@ func encodeImage(img image.Image, format string) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+// contextReader fails reads once its context is done, so that decoding stops
+// part way through an image.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// contextWriter fails writes once its context is done, so that encoding
+// stops part way through an image.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
@@ -2,6 +2,7 @@ package imageproc
 
 import (
 	"bytes"
+	"context"
 	"image"
 	"image/color"
 	"image/gif"
@@ -234,6 +235,14 @@ func TestTransform_JPEG_Format(t *testing.T) {
 	assert.Equal(t, 50, h)
 }
 
+func TestTransformWithLimits_Canceled(t *testing.T) {
+	data := createTestPNG(t, 100, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := TransformWithLimits(ctx, bytes.NewReader(data), model.VariantOptions{Width: 50}, DefaultLimits())
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
 func TestDetectFormat(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -13,6 +13,12 @@ type Image struct {
 	Uploaded          time.Time              `json:"uploaded"`
 	Variants          []string               `json:"variants"`
 	Draft             bool                   `json:"draft,omitempty"`
+
+	// Broken is why fsck found the stored original unusable, e.g.
+	// "missing" or "corrupt"; empty if it was not. It is internal to the
+	// twin: delivery and blob reads refuse broken images, and fsck reports
+	// them, but the image API does not show the mark.
+	Broken string `json:"-"`
 }
 
 // Variant represents a named image transformation preset.
@@ -47,4 +53,5 @@ type DirectUpload struct {
 	Expiry    time.Time              `json:"-"`
 	Metadata  map[string]interface{} `json:"-"`
 	Completed bool                   `json:"-"`
+	Creator   string                 `json:"-"`
 }
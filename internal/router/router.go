@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -11,7 +12,10 @@ import (
 	"github.com/leca/dt-cloudflare-images/internal/api"
 	"github.com/leca/dt-cloudflare-images/internal/config"
 	"github.com/leca/dt-cloudflare-images/internal/database"
+	"github.com/leca/dt-cloudflare-images/internal/fetch"
+	"github.com/leca/dt-cloudflare-images/internal/fsck"
 	"github.com/leca/dt-cloudflare-images/internal/handler"
+	"github.com/leca/dt-cloudflare-images/internal/imageproc"
 	"github.com/leca/dt-cloudflare-images/internal/storage"
 )
 
@@ -21,6 +25,9 @@ type Server struct {
 	Store  storage.Storage
 	Config *config.Config
 	Router chi.Router
+
+	warmer *handler.Warmer
+	fsck   *fsck.Job
 }
 
 // New creates a new Server with a fully configured chi router.
@@ -33,14 +40,58 @@ func New(db database.Database, store storage.Storage, cfg *config.Config) *Serve
 		Config: cfg,
 	}
 
+	// The derivative cache lives next to originals, so it is only available
+	// with filesystem storage.
+	if fs, ok := store.(*storage.FileSystem); ok && cfg.CacheMaxBytes > 0 {
+		h.Cache = storage.NewDerivativeCache(fs, int64(cfg.CacheMaxBytes))
+	}
+	h.Limits = imageproc.Limits{
+		MaxInputBytes:      int64(cfg.MaxImageBytes),
+		MaxPixels:          int64(cfg.MaxImagePixels),
+		MaxDimension:       cfg.MaxImageDimension,
+		MaxOutputDimension: cfg.MaxOutputDimension,
+	}
+	if cfg.FetchFixtureDir != "" {
+		h.Fetcher = fetch.NewFixtureFetcher(cfg.FetchFixtureDir, int64(cfg.FetchMaxBytes))
+	} else {
+		h.Fetcher = fetch.NewHTTPFetcher(fetch.Options{
+			Timeout:      time.Duration(cfg.FetchTimeout) * time.Second,
+			MaxBytes:     int64(cfg.FetchMaxBytes),
+			MaxRedirects: cfg.FetchMaxRedirects,
+			AllowPrivate: cfg.FetchAllowPrivate,
+		})
+	}
+	if cfg.CursorSecret != "" {
+		h.CursorKey = []byte(cfg.CursorSecret)
+	}
+	if cfg.TransformWorkers > 0 {
+		h.Pool = imageproc.NewPool(cfg.TransformWorkers, cfg.TransformQueue, time.Duration(cfg.TransformTimeout)*time.Second)
+	}
+	if cfg.WarmVariants && h.Cache != nil {
+		// Warming renders on a pool of its own, so that it never takes
+		// transform capacity from deliveries.
+		warmPool := imageproc.NewPool(cfg.WarmWorkers, 0, time.Duration(cfg.TransformTimeout)*time.Second)
+		h.Warmer = handler.NewWarmer(db, store, h.Cache, warmPool, cfg.WarmWorkers, cfg.WarmQueueSize)
+		h.Warmer.Limits = h.Limits
+		s.warmer = h.Warmer
+	}
+
+	if cfg.FsckInterval > 0 {
+		s.fsck = fsck.StartJob(db, store, time.Duration(cfg.FsckInterval)*time.Second, fsck.Options{
+			Repair:    cfg.FsckRepair,
+			Verify:    cfg.FsckVerify,
+			OrphanAge: time.Duration(cfg.FsckOrphanAge) * time.Second,
+		})
+	}
+
 	r := chi.NewRouter()
 
 	// CORS — must be before other middleware to handle preflight OPTIONS
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
-		ExposedHeaders:   []string{"Content-Length", "Content-Type"},
+		ExposedHeaders:   []string{"Content-Length", "Content-Type", "ETag", "Last-Modified", "Cache-Control", "Accept-Ranges", "Content-Range", "cf-cache-status"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
@@ -80,22 +131,37 @@ func New(db database.Database, store storage.Storage, cfg *config.Config) *Serve
 		r.Patch("/v1/{image_id}", h.UpdateImage)
 		r.Delete("/v1/{image_id}", h.DeleteImage)
 		r.Get("/v1/{image_id}/blob", h.GetImageBlob)
+		r.Head("/v1/{image_id}/blob", h.GetImageBlob)
 
 		// V2 image endpoints.
 		r.Get("/v2", h.ListImagesV2)
 		r.Post("/v2/direct_upload", h.CreateDirectUpload)
 	})
 
+	// Cache purge emulation for the delivery routes.
+	r.With(api.AuthMiddleware(cfg.AuthToken)).Post("/zones/{zone_id}/purge_cache", h.PurgeCache)
+
 	// Direct upload endpoint (no auth required).
 	r.Post("/upload/{upload_id}", h.HandleDirectUpload)
 
 	// Image delivery endpoint (no auth required).
 	r.Get("/cdn/{account_id}/{image_id}/{variant_name}", h.DeliverImage)
+	r.Head("/cdn/{account_id}/{image_id}/{variant_name}", h.DeliverImage)
 
 	s.Router = r
 	return s
 }
 
+// Close stops background work started by the server.
+func (s *Server) Close() {
+	if s.warmer != nil {
+		s.warmer.Close()
+	}
+	if s.fsck != nil {
+		s.fsck.Close()
+	}
+}
+
 // Health returns a simple health-check response.
 func (s *Server) Health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// blobDir holds the blobs of a content-addressed FileSystem, by SHA-256, at
+// <basePath>/.blobs/<first two hex digits>/<hex digest>.
+const blobDir = ".blobs"
+
+// blobIndex counts the references to each blob of a content-addressed
+// FileSystem. The originals' hash files are the record of which image uses
+// which blob; the counts are rebuilt from them when first needed.
+type blobIndex struct {
+	mu   sync.Mutex
+	refs map[string]int // by hex digest; nil until loaded
+}
+
+// NewContentAddressedFileSystem creates a FileSystem storage rooted at
+// basePath that keeps one copy of each distinct blob. Each original is a
+// hard link to its blob, so reads are unchanged, and a blob is removed when
+// the last image referring to it is deleted or overwritten.
+func NewContentAddressedFileSystem(basePath string) *FileSystem {
+	fs := &FileSystem{basePath: basePath, blobs: &blobIndex{}}
+	fs.detectLegacy()
+	return fs
+}
+
+// blobPath returns the path of the blob with the given hex digest.
+func (fs *FileSystem) blobPath(sum string) string {
+	return filepath.Join(fs.basePath, blobDir, sum[:2], sum)
+}
+
+// storeBlob is Store for a content-addressed FileSystem. The data is hashed
+// as it is written to a temp file, which becomes the blob unless one with
+// the same digest already exists; the original is then linked to the blob.
+func (fs *FileSystem) storeBlob(ctx context.Context, accountID, imageID string, data io.Reader) (int64, error) {
+	root := filepath.Join(fs.basePath, blobDir)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return 0, fmt.Errorf("creating directory %s: %w", root, err)
+	}
+	tmp, err := os.CreateTemp(root, "upload-*")
+	if err != nil {
+		return 0, fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), contextReader{ctx: ctx, r: data})
+	if err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("writing data: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("closing temp file: %w", err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	fs.blobs.mu.Lock()
+	defer fs.blobs.mu.Unlock()
+	if err := fs.loadRefsLocked(); err != nil {
+		return 0, err
+	}
+
+	blob := fs.blobPath(sum)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return 0, fmt.Errorf("creating directory %s: %w", filepath.Dir(blob), err)
+		}
+		if err := os.Rename(tmp.Name(), blob); err != nil {
+			return 0, fmt.Errorf("renaming temp file to %s: %w", blob, err)
+		}
+	} else if err != nil {
+		return 0, fmt.Errorf("checking blob %s: %w", blob, err)
+	}
+	fs.blobs.refs[sum]++
+
+	dir := fs.imagePath(accountID, imageID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fs.releaseLocked(sum)
+		return 0, fmt.Errorf("creating directory %s: %w", dir, err)
+	}
+	old, err := fs.readHash(accountID, imageID)
+	if err != nil {
+		fs.releaseLocked(sum)
+		return 0, err
+	}
+
+	// Link under a temporary name, then rename over any previous original.
+	link := filepath.Join(dir, "upload-"+sum)
+	os.Remove(link)
+	if err := os.Link(blob, link); err != nil {
+		fs.releaseLocked(sum)
+		return 0, fmt.Errorf("linking %s: %w", blob, err)
+	}
+	dst := fs.originalPath(accountID, imageID)
+	if err := os.Rename(link, dst); err != nil {
+		os.Remove(link)
+		fs.releaseLocked(sum)
+		return 0, fmt.Errorf("renaming link to %s: %w", dst, err)
+	}
+	// Should recording the new digest fail, the old blob keeps the
+	// reference: a stale count only ever leaves a blob behind.
+	if err := writeFileAtomic(dst+hashSuffix, []byte(sum)); err != nil {
+		return 0, err
+	}
+	if old != "" {
+		fs.releaseLocked(old)
+	}
+	return n, nil
+}
+
+// deleteBlob is Delete for a content-addressed FileSystem: it removes the
+// image directory and drops the image's reference to its blob.
+func (fs *FileSystem) deleteBlob(accountID, imageID string) error {
+	fs.blobs.mu.Lock()
+	defer fs.blobs.mu.Unlock()
+	if err := fs.loadRefsLocked(); err != nil {
+		return err
+	}
+
+	sum, err := fs.readHash(accountID, imageID)
+	if err != nil {
+		return err
+	}
+	if err := fs.removeImageDir(accountID, imageID); err != nil {
+		return err
+	}
+	if sum != "" {
+		fs.releaseLocked(sum)
+	}
+	return nil
+}
+
+// releaseLocked drops a reference to the blob with the given digest,
+// removing the blob with its last reference. The caller holds blobs.mu.
+func (fs *FileSystem) releaseLocked(sum string) {
+	if fs.blobs.refs[sum] > 1 {
+		fs.blobs.refs[sum]--
+		return
+	}
+	delete(fs.blobs.refs, sum)
+	// A blob left behind is only wasted space.
+	_ = os.Remove(fs.blobPath(sum))
+}
+
+// loadRefsLocked counts the references to each blob from the hash files of
+// the originals, if it has not already. The caller holds blobs.mu.
+func (fs *FileSystem) loadRefsLocked() error {
+	if fs.blobs.refs != nil {
+		return nil
+	}
+	refs := make(map[string]int)
+	err := filepath.WalkDir(fs.basePath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == blobDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != "original"+hashSuffix {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if sum := strings.TrimSpace(string(b)); isHexDigest(sum) {
+			refs[sum]++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("indexing blobs: %w", err)
+	}
+	fs.blobs.refs = refs
+	return nil
+}
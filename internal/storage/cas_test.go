@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentAddressed_Contract(t *testing.T) {
+	runContract(t, func(t *testing.T) Storage { return NewContentAddressedFileSystem(t.TempDir()) })
+}
+
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// blobCount returns the number of blobs in a content-addressed store.
+func blobCount(t *testing.T, fs *FileSystem) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(filepath.Join(fs.basePath, blobDir), func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && isHexDigest(d.Name()) {
+			n++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return n
+}
+
+func TestContentAddressed_StoresEachBlobOnce(t *testing.T) {
+	fs := NewContentAddressedFileSystem(t.TempDir())
+
+	for _, id := range []string{"img-1", "img-2"} {
+		_, err := fs.Store(t.Context(), "acct-1", id, strings.NewReader("same bytes"))
+		require.NoError(t, err)
+	}
+	_, err := fs.Store(t.Context(), "acct-2", "img-1", strings.NewReader("same bytes"))
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, blobCount(t, fs))
+	blob, err := os.Stat(fs.blobPath(digest("same bytes")))
+	require.NoError(t, err)
+	original, err := os.Stat(fs.originalPath("acct-2", "img-1"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(blob, original), "original is not linked to its blob")
+}
+
+func TestContentAddressed_DeleteKeepsSharedBlob(t *testing.T) {
+	fs := NewContentAddressedFileSystem(t.TempDir())
+	for _, id := range []string{"img-1", "img-2"} {
+		_, err := fs.Store(t.Context(), "acct-1", id, strings.NewReader("shared"))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", "img-1"))
+	assert.Equal(t, 1, blobCount(t, fs))
+	data, err := os.ReadFile(fs.originalPath("acct-1", "img-2"))
+	require.NoError(t, err)
+	assert.Equal(t, "shared", string(data))
+
+	// The last reference takes the blob with it.
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", "img-2"))
+	assert.Equal(t, 0, blobCount(t, fs))
+}
+
+func TestContentAddressed_OverwriteReleasesOldBlob(t *testing.T) {
+	fs := NewContentAddressedFileSystem(t.TempDir())
+
+	_, err := fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("v1"))
+	require.NoError(t, err)
+	_, err = fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("v1"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, blobCount(t, fs))
+
+	_, err = fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("v2"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, blobCount(t, fs))
+	_, err = os.Stat(fs.blobPath(digest("v1")))
+	assert.True(t, os.IsNotExist(err), "expected the replaced blob to be removed")
+}
+
+func TestContentAddressed_StatReportsImageStoreTime(t *testing.T) {
+	fs := NewContentAddressedFileSystem(t.TempDir())
+	_, err := fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("shared"))
+	require.NoError(t, err)
+	// The blob, and img-1 with it, were stored long ago.
+	old := time.Now().Add(-24 * time.Hour)
+	require.NoError(t, os.Chtimes(fs.blobPath(digest("shared")), old, old))
+	require.NoError(t, os.Chtimes(fs.originalPath("acct-1", "img-1")+hashSuffix, old, old))
+
+	start := time.Now().Add(-time.Second)
+	_, err = fs.Store(t.Context(), "acct-1", "img-2", strings.NewReader("shared"))
+	require.NoError(t, err)
+
+	info, err := fs.Stat(t.Context(), "acct-1", "img-2")
+	require.NoError(t, err)
+	assert.True(t, info.ModTime.After(start), "img-2 dated %v, its blob's time", info.ModTime)
+	info, err = fs.Stat(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	assert.WithinDuration(t, old, info.ModTime, time.Second)
+}
+
+func TestContentAddressed_CountsSurviveRestart(t *testing.T) {
+	base := t.TempDir()
+	fs := NewContentAddressedFileSystem(base)
+	for _, id := range []string{"img-1", "img-2"} {
+		_, err := fs.Store(t.Context(), "acct-1", id, strings.NewReader("shared"))
+		require.NoError(t, err)
+	}
+
+	// A new instance counts the references from disk.
+	fs = NewContentAddressedFileSystem(base)
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", "img-1"))
+	assert.Equal(t, 1, blobCount(t, fs))
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", "img-2"))
+	assert.Equal(t, 0, blobCount(t, fs))
+}
+
+func TestContentAddressed_WorksWithDerivativeCache(t *testing.T) {
+	fs := NewContentAddressedFileSystem(t.TempDir())
+	_, err := fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("original"))
+	require.NoError(t, err)
+
+	c := NewDerivativeCache(fs, 1<<20)
+	require.NoError(t, c.Put("acct-1", "img-1", "abc", "png", []byte("derived")))
+	data, _, ok := c.Get("acct-1", "img-1", "abc")
+	require.True(t, ok)
+	assert.Equal(t, "derived", string(data))
+
+	// Blobs are not taken for derivatives on reload.
+	assert.Len(t, NewDerivativeCache(fs, 1<<20).entries, 1)
+}
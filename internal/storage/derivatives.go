@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// derivativePrefix marks derivative files inside an image directory.
+const derivativePrefix = "variant-"
+
+// DerivativeCache persists transformed image outputs next to their original
+// in a FileSystem store, as variant-<key>.<format> in the image directory.
+// Total disk usage is bounded by maxBytes; the least recently used entries
+// are evicted first. The LRU index lives in memory and is rebuilt from disk
+// by NewDerivativeCache, ordered by file modification time.
+type DerivativeCache struct {
+	fs       *FileSystem
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List // front = most recently used
+	entries map[derivativeID]*list.Element
+	size    int64
+}
+
+// derivativeID identifies one cached output.
+type derivativeID struct {
+	accountID string
+	imageID   string
+	key       string
+}
+
+type derivativeEntry struct {
+	id     derivativeID
+	format string
+	size   int64
+}
+
+// NewDerivativeCache creates a cache that stores derivatives in fs and keeps
+// their total size at or below maxBytes. Derivatives already on disk are
+// indexed; files that cannot be read are skipped.
+func NewDerivativeCache(fs *FileSystem, maxBytes int64) *DerivativeCache {
+	c := &DerivativeCache{
+		fs:       fs,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[derivativeID]*list.Element),
+	}
+	c.load()
+	return c
+}
+
+// load indexes the derivatives found under the store's base path and evicts
+// any excess over maxBytes.
+func (c *DerivativeCache) load() {
+	type found struct {
+		entry   *derivativeEntry
+		modTime time.Time
+	}
+	var all []found
+
+	_ = filepath.WalkDir(c.fs.basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(c.fs.basePath, path)
+		if err != nil {
+			return nil
+		}
+		accountID, imageID, name, ok := splitDerivativePath(rel)
+		if !ok {
+			return nil
+		}
+		key, format, ok := parseDerivativeName(name)
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		all = append(all, found{
+			entry: &derivativeEntry{
+				id:     derivativeID{accountID: accountID, imageID: imageID, key: key},
+				format: format,
+				size:   info.Size(),
+			},
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+
+	// Oldest first, so that the most recent end up at the front.
+	sort.Slice(all, func(i, j int) bool { return all[i].modTime.Before(all[j].modTime) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range all {
+		c.entries[f.entry.id] = c.lru.PushFront(f.entry)
+		c.size += f.entry.size
+	}
+	c.evictLocked()
+}
+
+// Get returns the cached output for key and its format. ok is false on a miss.
+func (c *DerivativeCache) Get(accountID, imageID, key string) (data []byte, format string, ok bool) {
+	id := derivativeID{accountID: accountID, imageID: imageID, key: key}
+
+	c.mu.Lock()
+	el, found := c.entries[id]
+	if !found {
+		c.mu.Unlock()
+		return nil, "", false
+	}
+	c.lru.MoveToFront(el)
+	entry := entryOf(el)
+	c.mu.Unlock()
+
+	data, err := os.ReadFile(c.derivativePath(id, entry.format))
+	if err != nil {
+		// The file vanished underneath the index (e.g. the image directory
+		// was removed); forget the entry.
+		c.mu.Lock()
+		if cur, ok := c.entries[id]; ok && cur == el {
+			c.removeLocked(el)
+		}
+		c.mu.Unlock()
+		return nil, "", false
+	}
+	return data, entry.format, true
+}
+
+// Contains reports whether a derivative for key is cached, without reading it
+// or affecting its recency.
+func (c *DerivativeCache) Contains(accountID, imageID, key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[derivativeID{accountID: accountID, imageID: imageID, key: key}]
+	return ok
+}
+
+// Put stores data as the derivative for key, replacing any previous entry,
+// then evicts least recently used entries until the cache fits maxBytes.
+// Outputs larger than maxBytes are not cached. Put is a no-op when the
+// image's original has been deleted.
+func (c *DerivativeCache) Put(accountID, imageID, key, format string, data []byte) error {
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return nil
+	}
+
+	id := derivativeID{accountID: accountID, imageID: imageID, key: key}
+	dir := c.fs.imagePath(accountID, imageID)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("checking directory %s: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "derived-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing derivative: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temp file: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[id]; ok {
+		c.removeLocked(el)
+	}
+
+	dst := c.derivativePath(id, format)
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return fmt.Errorf("renaming temp file to %s: %w", dst, err)
+	}
+	tmpPath = ""
+
+	c.entries[id] = c.lru.PushFront(&derivativeEntry{id: id, format: format, size: size})
+	c.size += size
+	c.evictLocked()
+	return nil
+}
+
+// Invalidate drops the derivative for key of a single image.
+func (c *DerivativeCache) Invalidate(accountID, imageID, key string) {
+	id := derivativeID{accountID: accountID, imageID: imageID, key: key}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[id]; ok {
+		c.removeLocked(el)
+	}
+}
+
+// InvalidateImage drops every derivative of the given image.
+func (c *DerivativeCache) InvalidateImage(accountID, imageID string) {
+	c.invalidate(func(id derivativeID) bool {
+		return id.accountID == accountID && id.imageID == imageID
+	})
+}
+
+// InvalidateKey drops the derivative for key from every image in the account.
+func (c *DerivativeCache) InvalidateKey(accountID, key string) {
+	c.invalidate(func(id derivativeID) bool {
+		return id.accountID == accountID && id.key == key
+	})
+}
+
+// InvalidateAccount drops every derivative belonging to the account.
+func (c *DerivativeCache) InvalidateAccount(accountID string) {
+	c.invalidate(func(id derivativeID) bool {
+		return id.accountID == accountID
+	})
+}
+
+// Purge drops every derivative in the cache.
+func (c *DerivativeCache) Purge() {
+	c.invalidate(func(derivativeID) bool { return true })
+}
+
+// Size returns the total number of bytes currently cached.
+func (c *DerivativeCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *DerivativeCache) invalidate(match func(derivativeID) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, el := range c.entries {
+		if match(id) {
+			c.removeLocked(el)
+		}
+	}
+}
+
+// evictLocked removes least recently used entries until size <= maxBytes.
+func (c *DerivativeCache) evictLocked() {
+	for c.size > c.maxBytes {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.removeLocked(el)
+	}
+}
+
+// removeLocked deletes an entry from the index and from disk.
+func (c *DerivativeCache) removeLocked(el *list.Element) {
+	entry := entryOf(el)
+	c.lru.Remove(el)
+	delete(c.entries, entry.id)
+	c.size -= entry.size
+	os.Remove(c.derivativePath(entry.id, entry.format))
+}
+
+// entryOf returns the entry held by an LRU list element.
+func entryOf(el *list.Element) *derivativeEntry {
+	entry, _ := el.Value.(*derivativeEntry)
+	return entry
+}
+
+// derivativePath returns the on-disk location of a derivative.
+func (c *DerivativeCache) derivativePath(id derivativeID, format string) string {
+	return filepath.Join(c.fs.imagePath(id.accountID, id.imageID), derivativePrefix+id.key+"."+format)
+}
+
+// splitDerivativePath splits the path of a file in an image directory,
+// relative to the base path, into its account, image and file name. Both
+// the fanned-out layout, <accountID>/<ab>/<cd>/<imageID>/<name>, and the
+// legacy one, <accountID>/<imageID>/<name>, are accepted.
+func splitDerivativePath(rel string) (accountID, imageID, name string, ok bool) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	switch len(parts) {
+	case 3:
+		return parts[0], parts[1], parts[2], true
+	case 5:
+		if s1, s2 := shardOf(parts[3]); s1 != parts[1] || s2 != parts[2] {
+			return "", "", "", false
+		}
+		return parts[0], parts[3], parts[4], true
+	}
+	return "", "", "", false
+}
+
+// parseDerivativeName splits a derivative filename into key and format.
+func parseDerivativeName(name string) (key, format string, ok bool) {
+	if !strings.HasPrefix(name, derivativePrefix) {
+		return "", "", false
+	}
+	rest := strings.TrimPrefix(name, derivativePrefix)
+	dot := strings.LastIndexByte(rest, '.')
+	if dot <= 0 || dot == len(rest)-1 {
+		return "", "", false
+	}
+	return rest[:dot], rest[dot+1:], true
+}
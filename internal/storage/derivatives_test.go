@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDerivativeTestStore returns a FileSystem holding originals for the given images.
+func newDerivativeTestStore(t *testing.T, imageIDs ...string) *FileSystem {
+	t.Helper()
+	fs := NewFileSystem(t.TempDir())
+	for _, id := range imageIDs {
+		_, err := fs.Store(t.Context(), "acct-1", id, bytes.NewReader([]byte("original")))
+		require.NoError(t, err)
+	}
+	return fs
+}
+
+func TestDerivativeCache_PutGet(t *testing.T) {
+	fs := newDerivativeTestStore(t, "img-1")
+	c := NewDerivativeCache(fs, 1<<20)
+
+	_, _, ok := c.Get("acct-1", "img-1", "abc")
+	assert.False(t, ok)
+
+	require.NoError(t, c.Put("acct-1", "img-1", "abc", "png", []byte("derived")))
+
+	data, format, ok := c.Get("acct-1", "img-1", "abc")
+	require.True(t, ok)
+	assert.Equal(t, []byte("derived"), data)
+	assert.Equal(t, "png", format)
+
+	// Stored next to the original.
+	_, err := os.Stat(filepath.Join(fs.shardPath("acct-1", "img-1"), "variant-abc.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("derived")), c.Size())
+}
+
+func TestDerivativeCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	fs := newDerivativeTestStore(t, "img-1")
+	c := NewDerivativeCache(fs, 10)
+
+	require.NoError(t, c.Put("acct-1", "img-1", "a", "png", []byte("aaaa")))
+	require.NoError(t, c.Put("acct-1", "img-1", "b", "png", []byte("bbbb")))
+
+	// Touch "a" so that "b" becomes the least recently used.
+	_, _, ok := c.Get("acct-1", "img-1", "a")
+	require.True(t, ok)
+
+	require.NoError(t, c.Put("acct-1", "img-1", "c", "png", []byte("cccc")))
+
+	_, _, ok = c.Get("acct-1", "img-1", "b")
+	assert.False(t, ok, "expected b to be evicted")
+	_, _, ok = c.Get("acct-1", "img-1", "a")
+	assert.True(t, ok)
+	_, _, ok = c.Get("acct-1", "img-1", "c")
+	assert.True(t, ok)
+	assert.LessOrEqual(t, c.Size(), int64(10))
+
+	_, err := os.Stat(filepath.Join(fs.shardPath("acct-1", "img-1"), "variant-b.png"))
+	assert.True(t, os.IsNotExist(err), "expected evicted file to be removed")
+}
+
+func TestDerivativeCache_SkipsOversizedOutputs(t *testing.T) {
+	fs := newDerivativeTestStore(t, "img-1")
+	c := NewDerivativeCache(fs, 4)
+
+	require.NoError(t, c.Put("acct-1", "img-1", "big", "png", []byte("too large")))
+
+	_, _, ok := c.Get("acct-1", "img-1", "big")
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), c.Size())
+}
+
+func TestDerivativeCache_InvalidateImage(t *testing.T) {
+	fs := newDerivativeTestStore(t, "img-1", "img-2")
+	c := NewDerivativeCache(fs, 1<<20)
+
+	require.NoError(t, c.Put("acct-1", "img-1", "a", "png", []byte("1a")))
+	require.NoError(t, c.Put("acct-1", "img-2", "a", "png", []byte("2a")))
+
+	c.InvalidateImage("acct-1", "img-1")
+
+	_, _, ok := c.Get("acct-1", "img-1", "a")
+	assert.False(t, ok)
+	_, _, ok = c.Get("acct-1", "img-2", "a")
+	assert.True(t, ok)
+
+	// The original is untouched.
+	exists, err := fs.Exists(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestDerivativeCache_InvalidateKey(t *testing.T) {
+	fs := newDerivativeTestStore(t, "img-1", "img-2")
+	c := NewDerivativeCache(fs, 1<<20)
+
+	require.NoError(t, c.Put("acct-1", "img-1", "a", "png", []byte("1a")))
+	require.NoError(t, c.Put("acct-1", "img-2", "a", "png", []byte("2a")))
+	require.NoError(t, c.Put("acct-1", "img-1", "b", "png", []byte("1b")))
+
+	c.InvalidateKey("acct-1", "a")
+
+	_, _, ok := c.Get("acct-1", "img-1", "a")
+	assert.False(t, ok)
+	_, _, ok = c.Get("acct-1", "img-2", "a")
+	assert.False(t, ok)
+	_, _, ok = c.Get("acct-1", "img-1", "b")
+	assert.True(t, ok)
+}
+
+func TestDerivativeCache_PutAfterImageDeleted(t *testing.T) {
+	fs := newDerivativeTestStore(t, "img-1")
+	c := NewDerivativeCache(fs, 1<<20)
+
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", "img-1"))
+	require.NoError(t, c.Put("acct-1", "img-1", "a", "png", []byte("data")))
+
+	// No directory is resurrected for the deleted image.
+	_, err := os.Stat(fs.shardPath("acct-1", "img-1"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDerivativeCache_GetAfterStoreDelete(t *testing.T) {
+	fs := newDerivativeTestStore(t, "img-1")
+	c := NewDerivativeCache(fs, 1<<20)
+
+	require.NoError(t, c.Put("acct-1", "img-1", "a", "png", []byte("data")))
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", "img-1"))
+
+	_, _, ok := c.Get("acct-1", "img-1", "a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), c.Size())
+}
+
+func TestDerivativeCache_ReloadsFromDisk(t *testing.T) {
+	fs := newDerivativeTestStore(t, "img-1")
+	c := NewDerivativeCache(fs, 1<<20)
+
+	require.NoError(t, c.Put("acct-1", "img-1", "old", "png", []byte("oldest")))
+	require.NoError(t, c.Put("acct-1", "img-1", "new", "jpeg", []byte("newest")))
+
+	// Make the modification times unambiguous.
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(fs.shardPath("acct-1", "img-1"), "variant-old.png"), past, past))
+
+	// A fresh cache with room for one entry keeps only the most recent.
+	reloaded := NewDerivativeCache(fs, 6)
+
+	data, format, ok := reloaded.Get("acct-1", "img-1", "new")
+	require.True(t, ok)
+	assert.Equal(t, []byte("newest"), data)
+	assert.Equal(t, "jpeg", format)
+
+	_, _, ok = reloaded.Get("acct-1", "img-1", "old")
+	assert.False(t, ok)
+
+	// The original is never indexed as a derivative.
+	rc, err := fs.Retrieve(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	rc.Close()
+}
+
+func TestDerivativeCache_InvalidateAndPurge(t *testing.T) {
+	fs := newDerivativeTestStore(t, "img-1", "img-2")
+	c := NewDerivativeCache(fs, 1<<20)
+
+	require.NoError(t, c.Put("acct-1", "img-1", "a", "png", []byte("1a")))
+	require.NoError(t, c.Put("acct-1", "img-1", "b", "png", []byte("1b")))
+	require.NoError(t, c.Put("acct-1", "img-2", "a", "png", []byte("2a")))
+
+	c.Invalidate("acct-1", "img-1", "a")
+	_, _, ok := c.Get("acct-1", "img-1", "a")
+	assert.False(t, ok)
+	_, _, ok = c.Get("acct-1", "img-1", "b")
+	assert.True(t, ok)
+
+	c.InvalidateAccount("acct-2")
+	assert.Equal(t, int64(4), c.Size())
+
+	c.Purge()
+	assert.Equal(t, int64(0), c.Size())
+}
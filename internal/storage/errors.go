@@ -0,0 +1,14 @@
+package storage
+
+import "errors"
+
+// Errors returned by Storage implementations, wrapped with a description of
+// the blob concerned. Test for them with errors.Is.
+var (
+	// ErrNotFound means no blob is stored for the image.
+	ErrNotFound = errors.New("not found")
+
+	// ErrLimitExceeded means storing the blob would exceed the capacity of
+	// the store.
+	ErrLimitExceeded = errors.New("storage limit exceeded")
+)
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// shardPath returns the fanned-out directory of an image:
+// <basePath>/<accountID>/<ab>/<cd>/<imageID>.
+func (fs *FileSystem) shardPath(accountID, imageID string) string {
+	s1, s2 := shardOf(imageID)
+	return filepath.Join(fs.basePath, accountID, s1, s2, imageID)
+}
+
+// legacyPath returns the directory of an image in a store written before
+// fan-out: <basePath>/<accountID>/<imageID>.
+func (fs *FileSystem) legacyPath(accountID, imageID string) string {
+	return filepath.Join(fs.basePath, accountID, imageID)
+}
+
+// shardOf returns the names of the two shard directories of an image.
+func shardOf(imageID string) (string, string) {
+	sum := sha256.Sum256([]byte(imageID))
+	h := hex.EncodeToString(sum[:2])
+	return h[:2], h[2:]
+}
+
+// detectLegacy sets fs.legacy if any image is stored in the legacy layout.
+// A store that cannot be scanned is assumed to hold some.
+func (fs *FileSystem) detectLegacy() {
+	ctx := context.Background()
+	for accountID, err := range fs.Accounts(ctx) {
+		if err != nil {
+			fs.legacy.Store(true)
+			return
+		}
+		root := filepath.Join(fs.basePath, accountID)
+		names, err := readDirs(root)
+		if err != nil {
+			fs.legacy.Store(true)
+			return
+		}
+		for _, name := range names {
+			if fileExists(filepath.Join(root, name, "original")) {
+				fs.legacy.Store(true)
+				return
+			}
+		}
+	}
+}
+
+// isLegacy reports whether the image is stored only in the legacy layout.
+func (fs *FileSystem) isLegacy(accountID, imageID string) bool {
+	if !fs.legacy.Load() {
+		return false
+	}
+	if fileExists(filepath.Join(fs.shardPath(accountID, imageID), "original")) {
+		return false
+	}
+	return fileExists(filepath.Join(fs.legacyPath(accountID, imageID), "original"))
+}
+
+// fileExists reports whether path names an existing non-directory.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// removeImageDir removes an image directory. A legacy directory may double
+// as a shard directory, when the image ID is two hex digits, so only its
+// files are removed, and the directory itself only once empty.
+func (fs *FileSystem) removeImageDir(accountID, imageID string) error {
+	if !fs.isLegacy(accountID, imageID) {
+		dir := fs.shardPath(accountID, imageID)
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("removing directory %s: %w", dir, err)
+		}
+		return nil
+	}
+	dir := fs.legacyPath(accountID, imageID)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("listing %s: %w", dir, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing %s: %w", e.Name(), err)
+		}
+	}
+	_ = os.Remove(dir)
+	return nil
+}
+
+// imageDirs yields the directories of an account's images, in either
+// layout.
+func (fs *FileSystem) imageDirs(ctx context.Context, accountID string) iter.Seq2[imageDir, error] {
+	return func(yield func(imageDir, error) bool) {
+		root := filepath.Join(fs.basePath, accountID)
+		entries, err := readDirs(root)
+		if err != nil {
+			yield(imageDir{}, err)
+			return
+		}
+		for _, e := range entries {
+			if err := ctx.Err(); err != nil {
+				yield(imageDir{}, err)
+				return
+			}
+			if fs.legacy.Load() && fileExists(filepath.Join(root, e, "original")) {
+				d := imageDir{id: e, legacy: true}
+				d.shadowed = fileExists(filepath.Join(fs.shardPath(accountID, e), "original"))
+				if !yield(d, nil) {
+					return
+				}
+			}
+			if !isShard(e) {
+				continue
+			}
+			subs, err := readDirs(filepath.Join(root, e))
+			if err != nil {
+				yield(imageDir{}, err)
+				return
+			}
+			for _, s := range subs {
+				if !isShard(s) {
+					continue
+				}
+				ids, err := readDirs(filepath.Join(root, e, s))
+				if err != nil {
+					yield(imageDir{}, err)
+					return
+				}
+				for _, id := range ids {
+					if s1, s2 := shardOf(id); s1 != e || s2 != s {
+						continue
+					}
+					if !fileExists(filepath.Join(root, e, s, id, "original")) {
+						continue
+					}
+					if !yield(imageDir{id: id}, nil) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// imageDir is an image directory found by imageDirs.
+type imageDir struct {
+	id     string
+	legacy bool
+	// shadowed is set for a legacy directory of an image that is also
+	// stored in the new layout, which takes precedence.
+	shadowed bool
+}
+
+// isShard reports whether name has the form of a shard directory: two
+// lower-case hex digits.
+func isShard(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// hasSubdirs reports whether dir contains a directory.
+func hasSubdirs(dir string) (bool, error) {
+	names, err := readDirs(dir)
+	return len(names) > 0, err
+}
+
+// readDirs returns the names of the subdirectories of dir, none if dir does
+// not exist.
+func readDirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("listing %s: %w", dir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// MigrateLayout moves every image directory still in the legacy layout to
+// its fanned-out location, with its original, digest and derivatives. It
+// can be interrupted and run again, and should run while no server uses
+// the store: derivatives moved under a running server are not found by its
+// cache until it restarts. It returns the number of images moved, and of
+// legacy directories left in place because the image is also stored in the
+// new layout. Once none is left, fs stops looking for legacy directories.
+func (fs *FileSystem) MigrateLayout(ctx context.Context) (moved, skipped int, err error) {
+	for accountID, err := range fs.Accounts(ctx) {
+		if err != nil {
+			return moved, skipped, err
+		}
+		// Collect first: moving directories while reading the account
+		// directory would disturb the listing.
+		var legacy []string
+		for d, err := range fs.imageDirs(ctx, accountID) {
+			if err != nil {
+				return moved, skipped, err
+			}
+			if d.legacy {
+				legacy = append(legacy, d.id)
+			}
+		}
+		for _, imageID := range legacy {
+			if err := ctx.Err(); err != nil {
+				return moved, skipped, err
+			}
+			ok, err := fs.migrateImage(accountID, imageID)
+			if err != nil {
+				return moved, skipped, err
+			}
+			if ok {
+				moved++
+			} else {
+				skipped++
+			}
+		}
+	}
+	if skipped == 0 {
+		fs.legacy.Store(false)
+	}
+	return moved, skipped, nil
+}
+
+// migrateImage moves one legacy image directory to its fanned-out location.
+// It returns false, moving nothing, if the image is already stored there.
+func (fs *FileSystem) migrateImage(accountID, imageID string) (bool, error) {
+	src, dst := fs.legacyPath(accountID, imageID), fs.shardPath(accountID, imageID)
+	if fileExists(filepath.Join(dst, "original")) {
+		return false, nil
+	}
+	// Usually the whole directory moves at once. A legacy directory that
+	// doubles as a shard directory, or that contains its own new location,
+	// cannot.
+	whole := !strings.HasPrefix(dst, src+string(filepath.Separator))
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		whole = false
+	}
+	if whole {
+		subdirs, err := hasSubdirs(src)
+		if err != nil {
+			return false, err
+		}
+		whole = !subdirs
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, fmt.Errorf("creating directory %s: %w", filepath.Dir(dst), err)
+	}
+	if whole {
+		if err := os.Rename(src, dst); err != nil {
+			return false, fmt.Errorf("moving %s: %w", src, err)
+		}
+		return true, nil
+	}
+
+	// Otherwise the files move one by one, the original last, so that the
+	// image is read from src until it is complete in dst.
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return false, fmt.Errorf("creating directory %s: %w", dst, err)
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return false, fmt.Errorf("listing %s: %w", src, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == "original" {
+			continue
+		}
+		if err := os.Rename(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return false, fmt.Errorf("moving %s: %w", e.Name(), err)
+		}
+	}
+	if err := os.Rename(filepath.Join(src, "original"), filepath.Join(dst, "original")); err != nil {
+		return false, fmt.Errorf("moving %s: %w", filepath.Join(src, "original"), err)
+	}
+	_ = os.Remove(src)
+	return true, nil
+}
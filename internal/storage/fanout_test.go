@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLegacy stores an original in the layout written before fan-out, and
+// has fs look for it as if it had been there when fs was created.
+func writeLegacy(t *testing.T, fs *FileSystem, accountID, imageID, data string) {
+	t.Helper()
+	dir := fs.legacyPath(accountID, imageID)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "original"), []byte(data), 0644))
+	fs.legacy.Store(true)
+}
+
+func TestFileSystem_DetectsLegacyLayout(t *testing.T) {
+	base := t.TempDir()
+	fs := NewFileSystem(base)
+	_, err := fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("fanned out"))
+	require.NoError(t, err)
+	assert.False(t, NewFileSystem(base).legacy.Load())
+
+	writeLegacy(t, fs, "acct-2", "img-2", "legacy")
+	fs = NewFileSystem(base)
+	assert.True(t, fs.legacy.Load())
+	assert.Equal(t, []byte("legacy"), retrieve(t, fs, "acct-2", "img-2"))
+
+	// Once migrated, the legacy layout is no longer looked for.
+	_, _, err = fs.MigrateLayout(t.Context())
+	require.NoError(t, err)
+	assert.False(t, fs.legacy.Load())
+	assert.Equal(t, []byte("legacy"), retrieve(t, fs, "acct-2", "img-2"))
+	assert.False(t, NewFileSystem(base).legacy.Load())
+}
+
+func TestFileSystem_ReadsLegacyLayout(t *testing.T) {
+	fs := NewFileSystem(t.TempDir())
+	writeLegacy(t, fs, "acct-1", "img-1", "legacy")
+	_, err := fs.Store(t.Context(), "acct-1", "img-2", strings.NewReader("fanned out"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("legacy"), retrieve(t, fs, "acct-1", "img-1"))
+	info, err := fs.Stat(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	assert.Equal(t, digest("legacy"), info.SHA256)
+	assert.Equal(t, []string{"img-1", "img-2"}, listIDs(t, fs, "acct-1"))
+
+	// Overwrites stay in place, with their derivatives.
+	_, err = fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("updated"))
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(fs.legacyPath("acct-1", "img-1"), "original"))
+	require.NoError(t, err)
+	assert.Equal(t, "updated", string(data))
+	c := NewDerivativeCache(fs, 1<<20)
+	require.NoError(t, c.Put("acct-1", "img-1", "abc", "png", []byte("derived")))
+	assert.FileExists(t, filepath.Join(fs.legacyPath("acct-1", "img-1"), "variant-abc.png"))
+
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", "img-1"))
+	assert.NoDirExists(t, fs.legacyPath("acct-1", "img-1"))
+	assert.Equal(t, []string{"img-2"}, listIDs(t, fs, "acct-1"))
+}
+
+func TestFileSystem_MigrateLayout(t *testing.T) {
+	fs := NewFileSystem(t.TempDir())
+	writeLegacy(t, fs, "acct-1", "img-1", "one")
+	writeLegacy(t, fs, "acct-2", "img-2", "two")
+	c := NewDerivativeCache(fs, 1<<20)
+	require.NoError(t, c.Put("acct-1", "img-1", "abc", "png", []byte("derived")))
+
+	moved, skipped, err := fs.MigrateLayout(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 2, moved)
+	assert.Equal(t, 0, skipped)
+
+	assert.NoDirExists(t, fs.legacyPath("acct-1", "img-1"))
+	assert.FileExists(t, filepath.Join(fs.shardPath("acct-1", "img-1"), "original"))
+	assert.Equal(t, []byte("two"), retrieve(t, fs, "acct-2", "img-2"))
+	assert.Equal(t, []string{"img-1"}, listIDs(t, fs, "acct-1"))
+
+	// A restarted cache finds the derivatives in their new place.
+	data, _, ok := NewDerivativeCache(fs, 1<<20).Get("acct-1", "img-1", "abc")
+	require.True(t, ok)
+	assert.Equal(t, "derived", string(data))
+
+	moved, _, err = fs.MigrateLayout(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestFileSystem_MigrateLayoutSkipsShadowed(t *testing.T) {
+	fs := NewFileSystem(t.TempDir())
+	_, err := fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("new"))
+	require.NoError(t, err)
+	writeLegacy(t, fs, "acct-1", "img-1", "stale")
+
+	// The new layout takes precedence.
+	assert.Equal(t, []byte("new"), retrieve(t, fs, "acct-1", "img-1"))
+	assert.Equal(t, []string{"img-1"}, listIDs(t, fs, "acct-1"))
+
+	moved, skipped, err := fs.MigrateLayout(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 0, moved)
+	assert.Equal(t, 1, skipped)
+	assert.Equal(t, []byte("new"), retrieve(t, fs, "acct-1", "img-1"))
+}
+
+func TestFileSystem_LegacyImageNamedLikeShard(t *testing.T) {
+	fs := NewFileSystem(t.TempDir())
+	_, err := fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("fanned out"))
+	require.NoError(t, err)
+	// A legacy image whose directory is also img-1's first shard.
+	shard, _ := shardOf("img-1")
+	writeLegacy(t, fs, "acct-1", shard, "legacy")
+
+	ids := listIDs(t, fs, "acct-1")
+	assert.Equal(t, []string{shard, "img-1"}, ids, "listed %v", ids)
+	assert.True(t, slices.IsSorted(ids))
+
+	moved, _, err := fs.MigrateLayout(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 1, moved)
+	assert.Equal(t, []byte("legacy"), retrieve(t, fs, "acct-1", shard))
+	assert.Equal(t, []byte("fanned out"), retrieve(t, fs, "acct-1", "img-1"))
+
+	// Deleting either leaves the other.
+	writeLegacy(t, fs, "acct-1", shard+"x", "other")
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", shard))
+	assert.Equal(t, []byte("fanned out"), retrieve(t, fs, "acct-1", "img-1"))
+}
+
+func TestContentAddressed_LegacyLayout(t *testing.T) {
+	fs := NewContentAddressedFileSystem(t.TempDir())
+	_, err := fs.Store(t.Context(), "acct-1", "img-1", strings.NewReader("shared"))
+	require.NoError(t, err)
+	// Move img-1 back to where an older version would have put it.
+	require.NoError(t, os.Rename(fs.shardPath("acct-1", "img-1"), fs.legacyPath("acct-1", "img-1")))
+	_, err = fs.Store(t.Context(), "acct-1", "img-2", strings.NewReader("shared"))
+	require.NoError(t, err)
+
+	fs = NewContentAddressedFileSystem(fs.basePath)
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", "img-1"))
+	assert.Equal(t, 1, blobCount(t, fs))
+	require.NoError(t, fs.Delete(t.Context(), "acct-1", "img-2"))
+	assert.Equal(t, 0, blobCount(t, fs))
+}
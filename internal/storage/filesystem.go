@@ -1,29 +1,58 @@
 package storage
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"iter"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 )
 
 // Compile-time check that FileSystem implements Storage.
 var _ Storage = (*FileSystem)(nil)
 
+// hashSuffix names the file beside an original that records its SHA-256
+// digest.
+const hashSuffix = ".sha256"
+
 // FileSystem implements Storage using the local filesystem.
-// Files are stored at <basePath>/<accountID>/<imageID>/original.
+// Files are stored at <basePath>/<accountID>/<ab>/<cd>/<imageID>/original,
+// where abcd are the first four hex digits of the SHA-256 of the image ID, so
+// that no directory holds more than a few of an account's images. Stores
+// written before this fan-out keep each image at
+// <basePath>/<accountID>/<imageID>; such images are read, overwritten and
+// deleted in place until MigrateLayout moves them.
 type FileSystem struct {
 	basePath string
+
+	// legacy is set while the store may hold images in the layout written
+	// before fan-out. Only then are their directories looked for.
+	legacy atomic.Bool
+
+	// blobs is set for a content-addressed store; see
+	// NewContentAddressedFileSystem.
+	blobs *blobIndex
 }
 
 // NewFileSystem creates a new FileSystem storage rooted at basePath.
 func NewFileSystem(basePath string) *FileSystem {
-	return &FileSystem{basePath: basePath}
+	fs := &FileSystem{basePath: basePath}
+	fs.detectLegacy()
+	return fs
 }
 
-// imagePath returns the directory path for a given account and image.
+// imagePath returns the directory of an image: the legacy one if the image
+// is stored only there, otherwise the fanned-out one.
 func (fs *FileSystem) imagePath(accountID, imageID string) string {
-	return filepath.Join(fs.basePath, accountID, imageID)
+	if fs.isLegacy(accountID, imageID) {
+		return fs.legacyPath(accountID, imageID)
+	}
+	return fs.shardPath(accountID, imageID)
 }
 
 // originalPath returns the full path to the original file for a given account and image.
@@ -31,9 +60,16 @@ func (fs *FileSystem) originalPath(accountID, imageID string) string {
 	return filepath.Join(fs.imagePath(accountID, imageID), "original")
 }
 
-// Store writes data from the reader to disk using atomic write (temp file + rename).
-// It returns the number of bytes written.
-func (fs *FileSystem) Store(accountID, imageID string, data io.Reader) (int64, error) {
+// Store writes data from the reader to disk using atomic write (temp file + rename),
+// recording its digest beside it. It returns the number of bytes written. The
+// copy stops, leaving nothing behind, when ctx is cancelled.
+func (fs *FileSystem) Store(ctx context.Context, accountID, imageID string, data io.Reader) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if fs.blobs != nil {
+		return fs.storeBlob(ctx, accountID, imageID, data)
+	}
 	dir := fs.imagePath(accountID, imageID)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return 0, fmt.Errorf("creating directory %s: %w", dir, err)
@@ -53,7 +89,8 @@ func (fs *FileSystem) Store(accountID, imageID string, data io.Reader) (int64, e
 		}
 	}()
 
-	n, err := io.Copy(tmp, data)
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), contextReader{ctx: ctx, r: data})
 	if err != nil {
 		tmp.Close()
 		return 0, fmt.Errorf("writing data: %w", err)
@@ -63,7 +100,12 @@ func (fs *FileSystem) Store(accountID, imageID string, data io.Reader) (int64, e
 		return 0, fmt.Errorf("closing temp file: %w", err)
 	}
 
+	// Drop the previous digest first, so that it never describes the new
+	// data; Stat recomputes a missing one.
 	dst := fs.originalPath(accountID, imageID)
+	if err := os.Remove(dst + hashSuffix); err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("removing digest: %w", err)
+	}
 	if err := os.Rename(tmpPath, dst); err != nil {
 		return 0, fmt.Errorf("renaming temp file to %s: %w", dst, err)
 	}
@@ -71,35 +113,45 @@ func (fs *FileSystem) Store(accountID, imageID string, data io.Reader) (int64, e
 	// Rename succeeded; prevent deferred cleanup from removing the final file.
 	tmpPath = ""
 
+	if err := writeFileAtomic(dst+hashSuffix, []byte(hex.EncodeToString(h.Sum(nil)))); err != nil {
+		return 0, err
+	}
 	return n, nil
 }
 
 // Retrieve opens the stored original file and returns an io.ReadCloser.
-func (fs *FileSystem) Retrieve(accountID, imageID string) (io.ReadCloser, error) {
+func (fs *FileSystem) Retrieve(ctx context.Context, accountID, imageID string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	path := fs.originalPath(accountID, imageID)
 	f, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("image not found: %s/%s", accountID, imageID)
+			return nil, fmt.Errorf("image %s/%s %w", accountID, imageID, ErrNotFound)
 		}
 		return nil, fmt.Errorf("opening file %s: %w", path, err)
 	}
 	return f, nil
 }
 
-// Delete removes the entire <accountID>/<imageID>/ directory.
+// Delete removes the image directory, derivatives included.
 // It is idempotent: deleting a non-existent image returns no error.
-func (fs *FileSystem) Delete(accountID, imageID string) error {
-	dir := fs.imagePath(accountID, imageID)
-	err := os.RemoveAll(dir)
-	if err != nil {
-		return fmt.Errorf("removing directory %s: %w", dir, err)
+func (fs *FileSystem) Delete(ctx context.Context, accountID, imageID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	return nil
+	if fs.blobs != nil {
+		return fs.deleteBlob(accountID, imageID)
+	}
+	return fs.removeImageDir(accountID, imageID)
 }
 
 // Exists checks whether the original file exists on disk.
-func (fs *FileSystem) Exists(accountID, imageID string) (bool, error) {
+func (fs *FileSystem) Exists(ctx context.Context, accountID, imageID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 	path := fs.originalPath(accountID, imageID)
 	_, err := os.Stat(path)
 	if err == nil {
@@ -110,3 +162,236 @@ func (fs *FileSystem) Exists(accountID, imageID string) (bool, error) {
 	}
 	return false, fmt.Errorf("checking file %s: %w", path, err)
 }
+
+// Stat describes the stored original. A digest missing from disk, as for
+// originals stored by earlier versions, is computed from the data and
+// recorded, so that it is computed only once.
+func (fs *FileSystem) Stat(ctx context.Context, accountID, imageID string) (*BlobInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path := fs.originalPath(accountID, imageID)
+	info, err := fs.statOriginal(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("image %s/%s %w", accountID, imageID, ErrNotFound)
+		}
+		return nil, fmt.Errorf("checking file %s: %w", path, err)
+	}
+	sum, err := fs.readHash(accountID, imageID)
+	if err != nil {
+		return nil, err
+	}
+	if sum == "" {
+		var hashed os.FileInfo
+		if sum, hashed, err = hashFile(ctx, path); err != nil {
+			return nil, err
+		}
+		fs.recordHash(path, hashed, sum)
+	}
+	info.SHA256 = sum
+	return info, nil
+}
+
+// statOriginal describes the original at path, but for its digest. In a
+// content-addressed store an original shares its modification time with
+// its blob, which may have been stored long before, so the time is taken
+// from the digest file written with the original; holding the lock keeps
+// the two consistent with a concurrent Store.
+func (fs *FileSystem) statOriginal(path string) (*BlobInfo, error) {
+	if fs.blobs != nil {
+		fs.blobs.mu.Lock()
+		defer fs.blobs.mu.Unlock()
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	bi := &BlobInfo{Size: info.Size(), ModTime: info.ModTime()}
+	if fs.blobs != nil {
+		if hinfo, err := os.Stat(path + hashSuffix); err == nil {
+			bi.ModTime = hinfo.ModTime()
+		}
+	}
+	return bi, nil
+}
+
+// List yields the IDs of the account's image directories holding an
+// original, in either layout.
+func (fs *FileSystem) List(ctx context.Context, accountID string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		if err := ctx.Err(); err != nil {
+			yield("", err)
+			return
+		}
+		for d, err := range fs.imageDirs(ctx, accountID) {
+			if err != nil {
+				yield("", err)
+				return
+			}
+			if d.shadowed {
+				continue
+			}
+			if !yield(d.id, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Accounts yields the account directories under the base path. Directories
+// whose names start with "." hold the store's own data, not accounts.
+func (fs *FileSystem) Accounts(ctx context.Context) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		if err := ctx.Err(); err != nil {
+			yield("", err)
+			return
+		}
+		entries, err := os.ReadDir(fs.basePath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				yield("", fmt.Errorf("listing %s: %w", fs.basePath, err))
+			}
+			return
+		}
+		for _, e := range entries {
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			if !yield(e.Name(), nil) {
+				return
+			}
+		}
+	}
+}
+
+// RetrieveRange opens the stored original file at offset.
+func (fs *FileSystem) RetrieveRange(ctx context.Context, accountID, imageID string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkRange(offset, length); err != nil {
+		return nil, err
+	}
+	rc, err := fs.Retrieve(ctx, accountID, imageID)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := rc.(*os.File)
+	if !ok {
+		rc.Close()
+		return nil, fmt.Errorf("unexpected reader %T", rc)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("seeking %s: %w", f.Name(), err)
+	}
+	return readCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+// readHash returns the recorded digest of an image's original, or "" if none
+// was recorded.
+func (fs *FileSystem) readHash(accountID, imageID string) (string, error) {
+	path := fs.originalPath(accountID, imageID) + hashSuffix
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", path, err)
+	}
+	sum := strings.TrimSpace(string(b))
+	if !isHexDigest(sum) {
+		return "", fmt.Errorf("malformed blob digest in %s", path)
+	}
+	return sum, nil
+}
+
+// hashFile returns the hex SHA-256 digest of the file at path, and the
+// description of the file hashed.
+func hashFile(ctx context.Context, path string) (string, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("opening file %s: %w", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, fmt.Errorf("checking file %s: %w", path, err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx: ctx, r: f}); err != nil {
+		return "", nil, fmt.Errorf("hashing %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), info, nil
+}
+
+// recordHash records the digest of the original at path, computed from the
+// file described by hashed. Nothing is recorded if the original has been
+// replaced since, or a digest recorded meanwhile: the digest file is linked
+// into place, never renamed over one a concurrent Store wrote. Failing only
+// costs hashing the original again, so errors are ignored.
+func (fs *FileSystem) recordHash(path string, hashed os.FileInfo, sum string) {
+	if fs.blobs != nil {
+		// The digest files of a content-addressed store are its reference
+		// counts.
+		fs.blobs.mu.Lock()
+		defer fs.blobs.mu.Unlock()
+		if fs.loadRefsLocked() != nil {
+			return
+		}
+	}
+	if cur, err := os.Stat(path); err != nil || !os.SameFile(cur, hashed) {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "upload-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(sum)
+	if cerr := tmp.Close(); err != nil || cerr != nil {
+		return
+	}
+	// The digest file dates the original in a content-addressed store.
+	if os.Chtimes(tmp.Name(), hashed.ModTime(), hashed.ModTime()) != nil {
+		return
+	}
+	if os.Link(tmp.Name(), path+hashSuffix) != nil {
+		return
+	}
+	if fs.blobs != nil {
+		fs.blobs.refs[sum]++
+	}
+}
+
+// isHexDigest reports whether s is a lower-case hex SHA-256 digest.
+func isHexDigest(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic replaces the file at path with data via a temp file in the
+// same directory.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "upload-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("renaming temp file to %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"iter"
+	"sync"
+	"time"
+)
+
+// Compile-time check that Memory implements Storage.
+var _ Storage = (*Memory)(nil)
+
+// memoryScheme prefixes the storage paths that Open serves from memory.
+const memoryScheme = "memory://"
+
+// Memory implements Storage in process memory. Blobs are lost when the
+// process exits.
+type Memory struct {
+	maxBytes int64 // 0 means unlimited
+
+	mu    sync.RWMutex
+	blobs map[blobID]*memBlob
+	used  int64
+}
+
+// blobID identifies the blob of an image.
+type blobID struct {
+	accountID, imageID string
+}
+
+// memBlob is a stored blob. It is never modified once stored.
+type memBlob struct {
+	data []byte
+	info BlobInfo
+}
+
+// NewMemory creates an empty in-memory store holding at most maxBytes of
+// blob data in total, or any amount if maxBytes is 0.
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{maxBytes: maxBytes, blobs: make(map[blobID]*memBlob)}
+}
+
+// sizeLocked returns the size of the blob stored under id, or 0. The caller
+// holds mu.
+func (m *Memory) sizeLocked(id blobID) int64 {
+	if b, ok := m.blobs[id]; ok {
+		return int64(len(b.data))
+	}
+	return 0
+}
+
+// Store reads data into memory and returns the number of bytes stored. A
+// blob that would take the store over its cap is rejected with
+// ErrLimitExceeded as soon as it is known to be too large; an existing blob
+// for the image counts as freed. Nothing is stored if the copy fails or ctx
+// is cancelled.
+func (m *Memory) Store(ctx context.Context, accountID, imageID string, data io.Reader) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	id := blobID{accountID, imageID}
+
+	src := io.Reader(contextReader{ctx: ctx, r: data})
+	if m.maxBytes > 0 {
+		src = io.LimitReader(src, m.room(id)+1)
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(src); err != nil {
+		return 0, fmt.Errorf("writing data: %w", err)
+	}
+	content := buf.Bytes()
+	sum := sha256.Sum256(content)
+	blob := &memBlob{data: content, info: BlobInfo{
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+		SHA256:  hex.EncodeToString(sum[:]),
+	}}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Other blobs may have been stored while this one was read.
+	if m.maxBytes > 0 && blob.info.Size > m.roomLocked(id) {
+		return 0, fmt.Errorf("image %s/%s: %w", accountID, imageID, ErrLimitExceeded)
+	}
+	m.used += blob.info.Size - m.sizeLocked(id)
+	m.blobs[id] = blob
+	return blob.info.Size, nil
+}
+
+// room returns the number of bytes the blob stored under id may hold.
+func (m *Memory) room(id blobID) int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.roomLocked(id)
+}
+
+func (m *Memory) roomLocked(id blobID) int64 {
+	return m.maxBytes - m.used + m.sizeLocked(id)
+}
+
+// blob returns the blob stored for the image.
+func (m *Memory) blob(ctx context.Context, accountID, imageID string) (*memBlob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	b, ok := m.blobs[blobID{accountID, imageID}]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("image %s/%s %w", accountID, imageID, ErrNotFound)
+	}
+	return b, nil
+}
+
+// Retrieve returns a reader over the stored blob.
+func (m *Memory) Retrieve(ctx context.Context, accountID, imageID string) (io.ReadCloser, error) {
+	b, err := m.blob(ctx, accountID, imageID)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+// Delete removes the stored blob. It is idempotent: deleting a non-existent
+// image returns no error.
+func (m *Memory) Delete(ctx context.Context, accountID, imageID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	id := blobID{accountID, imageID}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used -= m.sizeLocked(id)
+	delete(m.blobs, id)
+	return nil
+}
+
+// Exists checks whether a blob is stored for the image.
+func (m *Memory) Exists(ctx context.Context, accountID, imageID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.blobs[blobID{accountID, imageID}]
+	return ok, nil
+}
+
+// Stat describes the stored blob.
+func (m *Memory) Stat(ctx context.Context, accountID, imageID string) (*BlobInfo, error) {
+	b, err := m.blob(ctx, accountID, imageID)
+	if err != nil {
+		return nil, err
+	}
+	info := b.info
+	return &info, nil
+}
+
+// List yields the IDs of the account's stored images, as of the start of
+// the iteration.
+func (m *Memory) List(ctx context.Context, accountID string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		if err := ctx.Err(); err != nil {
+			yield("", err)
+			return
+		}
+		var ids []string
+		m.mu.RLock()
+		for id := range m.blobs {
+			if id.accountID == accountID {
+				ids = append(ids, id.imageID)
+			}
+		}
+		m.mu.RUnlock()
+		for _, id := range ids {
+			if !yield(id, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Accounts yields the IDs of the accounts with blobs stored, as of the start
+// of the iteration.
+func (m *Memory) Accounts(ctx context.Context) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		if err := ctx.Err(); err != nil {
+			yield("", err)
+			return
+		}
+		seen := make(map[string]bool)
+		var accounts []string
+		m.mu.RLock()
+		for id := range m.blobs {
+			if !seen[id.accountID] {
+				seen[id.accountID] = true
+				accounts = append(accounts, id.accountID)
+			}
+		}
+		m.mu.RUnlock()
+		for _, a := range accounts {
+			if !yield(a, nil) {
+				return
+			}
+		}
+	}
+}
+
+// RetrieveRange returns a reader over part of the stored blob.
+func (m *Memory) RetrieveRange(ctx context.Context, accountID, imageID string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkRange(offset, length); err != nil {
+		return nil, err
+	}
+	b, err := m.blob(ctx, accountID, imageID)
+	if err != nil {
+		return nil, err
+	}
+	data := b.data[min(offset, int64(len(b.data))):]
+	return io.NopCloser(bytes.NewReader(data[:min(length, int64(len(data)))])), nil
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory_EnforcesCap(t *testing.T) {
+	m := NewMemory(10)
+
+	_, err := m.Store(t.Context(), "acct-1", "img-1", strings.NewReader("123456"))
+	require.NoError(t, err)
+
+	// Too large for the remaining room: rejected, and nothing is stored.
+	_, err = m.Store(t.Context(), "acct-1", "img-2", strings.NewReader("12345"))
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	exists, err := m.Exists(t.Context(), "acct-1", "img-2")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Replacing a blob frees the old one's bytes.
+	_, err = m.Store(t.Context(), "acct-1", "img-1", strings.NewReader("1234567890"))
+	require.NoError(t, err)
+
+	// As does deleting it.
+	require.NoError(t, m.Delete(t.Context(), "acct-1", "img-1"))
+	_, err = m.Store(t.Context(), "acct-1", "img-2", strings.NewReader("1234567890"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), m.used)
+}
+
+func TestMemory_StopsReadingOverCap(t *testing.T) {
+	m := NewMemory(10)
+
+	src := bytes.NewReader(make([]byte, 1<<20))
+	_, err := m.Store(t.Context(), "acct-1", "img-1", src)
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	// Only one byte past the cap was read.
+	assert.Equal(t, int64(1<<20-11), int64(src.Len()))
+}
@@ -0,0 +1,645 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Compile-time check that S3 implements Storage.
+var _ Storage = (*S3)(nil)
+
+// s3Path is the storage path that Open serves from an S3 bucket.
+const s3Path = "s3://"
+
+// S3Config configures an S3 store.
+type S3Config struct {
+	// Endpoint is the base URL of the S3 API, e.g. "http://minio:9000".
+	// Empty means AWS S3 in Region.
+	Endpoint string
+	// Region is the region requests are signed for; "us-east-1" if empty.
+	Region string
+	Bucket string
+	// PathStyle addresses the bucket as the first segment of the URL path
+	// rather than as a subdomain of the endpoint, as MinIO expects.
+	PathStyle bool
+
+	// AccessKeyID and SecretAccessKey sign requests. Requests are sent
+	// unsigned if AccessKeyID is empty.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Client sends requests; http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// S3 implements Storage in an S3-compatible bucket, with the FileSystem
+// layout: each original is the object <accountID>/<imageID>/original. Its
+// SHA-256 digest is kept in the object's metadata.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+
+	// backfills holds the keys of the objects whose digests are being
+	// recorded in the background.
+	backfills sync.Map
+}
+
+// bucketCheckTimeout bounds the request NewS3 makes to check the bucket.
+const bucketCheckTimeout = 10 * time.Second
+
+// backfillTimeout bounds the download and copy that record the digest of
+// an object stored without one.
+const backfillTimeout = 5 * time.Minute
+
+// NewS3 creates an S3 store for the bucket described by cfg, checking that
+// the bucket exists and the credentials can reach it.
+func NewS3(cfg S3Config) (*S3, error) {
+	s, err := newS3(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bucketCheckTimeout)
+	defer cancel()
+	if err := s.checkBucket(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newS3 is NewS3 without the check of the bucket.
+func newS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3: bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", cfg.Endpoint)
+	}
+	return &S3{cfg: cfg, endpoint: endpoint}, nil
+}
+
+// checkBucket sends a HeadBucket request for the bucket.
+func (s *S3) checkBucket(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL("").String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		// A HEAD answer has no body; its 404 is reported as a missing key.
+		if errors.Is(err, errNoSuchKey) {
+			return fmt.Errorf("s3: bucket %q does not exist", s.cfg.Bucket)
+		}
+		return fmt.Errorf("s3: checking bucket %q: %w", s.cfg.Bucket, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// headObject sends a HeadObject request for the object with the given key.
+// S3 answers a HEAD for a missing key and one in a missing bucket alike, so
+// errNoSuchKey is only returned once the bucket is known to exist.
+func (s *S3) headObject(ctx context.Context, key string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if errors.Is(err, errNoSuchKey) {
+		if err := s.checkBucket(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return resp, err
+}
+
+// objectKey returns the key of the original for a given account and image.
+func objectKey(accountID, imageID string) string {
+	return accountID + "/" + imageID + "/original"
+}
+
+// sha256Header is the metadata header holding the digest of an object.
+const sha256Header = "X-Amz-Meta-Sha256"
+
+// objectURL returns the URL of the object with the given key.
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/") + "/"
+	if s.cfg.PathStyle {
+		path += s.cfg.Bucket + "/"
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = path + key
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+// Store spools data to a temporary file, hashing it for the request
+// signature, then uploads it. It returns the number of bytes written.
+// Nothing is uploaded if the copy fails or ctx is cancelled.
+func (s *S3) Store(ctx context.Context, accountID, imageID string, data io.Reader) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp("", "dt-s3-upload-*")
+	if err != nil {
+		return 0, fmt.Errorf("creating temp file: %w", err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), contextReader{ctx: ctx, r: data})
+	if err != nil {
+		return 0, fmt.Errorf("writing data: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("rewinding temp file: %w", err)
+	}
+
+	// The transport closes request bodies; the deferred cleanup owns tmp.
+	// An empty body must be NoBody, or it would be sent chunked.
+	var body io.Reader = http.NoBody
+	if n > 0 {
+		body = io.NopCloser(tmp)
+	}
+	key := objectKey(accountID, imageID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), body)
+	if err != nil {
+		return 0, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(sha256Header, sum)
+	resp, err := s.do(req, sum)
+	if err != nil {
+		return 0, fmt.Errorf("uploading %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return n, nil
+}
+
+// Retrieve returns the body of the stored original.
+func (s *S3) Retrieve(ctx context.Context, accountID, imageID string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key := objectKey(accountID, imageID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		if errors.Is(err, errNoSuchKey) {
+			return nil, fmt.Errorf("image %s/%s %w", accountID, imageID, ErrNotFound)
+		}
+		return nil, fmt.Errorf("downloading %s: %w", key, err)
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the stored original. It is idempotent: deleting a
+// non-existent image returns no error.
+func (s *S3) Delete(ctx context.Context, accountID, imageID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key := objectKey(accountID, imageID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil && !errors.Is(err, errNoSuchKey) {
+		return fmt.Errorf("deleting %s: %w", key, err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Exists checks whether the original is stored in the bucket.
+func (s *S3) Exists(ctx context.Context, accountID, imageID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	key := objectKey(accountID, imageID)
+	resp, err := s.headObject(ctx, key)
+	if err != nil {
+		if errors.Is(err, errNoSuchKey) {
+			return false, nil
+		}
+		return false, fmt.Errorf("checking %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// Stat describes the stored original. The digest of an object uploaded
+// without one in its metadata is computed by downloading it, then recorded
+// by copying the object onto itself, which resets its modification time.
+func (s *S3) Stat(ctx context.Context, accountID, imageID string) (*BlobInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key := objectKey(accountID, imageID)
+	resp, err := s.headObject(ctx, key)
+	if err != nil {
+		if errors.Is(err, errNoSuchKey) {
+			return nil, fmt.Errorf("image %s/%s %w", accountID, imageID, ErrNotFound)
+		}
+		return nil, fmt.Errorf("checking %s: %w", key, err)
+	}
+	resp.Body.Close()
+
+	info := &BlobInfo{Size: resp.ContentLength, SHA256: resp.Header.Get(sha256Header)}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	if !isHexDigest(info.SHA256) {
+		info.SHA256 = ""
+		s.backfillDigest(accountID, imageID)
+	}
+	return info, nil
+}
+
+// backfillDigest records the digest of an object stored without one, such
+// as one uploaded by other means, in the background, so that Stat need not
+// download it. At most one backfill runs per object.
+func (s *S3) backfillDigest(accountID, imageID string) {
+	key := objectKey(accountID, imageID)
+	if _, running := s.backfills.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	go func() {
+		defer s.backfills.Delete(key)
+		ctx, cancel := context.WithTimeout(context.Background(), backfillTimeout)
+		defer cancel()
+		sum, etag, err := s.hashObject(ctx, accountID, imageID)
+		if err != nil {
+			// The next Stat tries again.
+			return
+		}
+		s.recordDigest(ctx, key, etag, sum)
+	}()
+}
+
+// hashObject downloads the stored original and returns its hex SHA-256
+// digest and the ETag of the version hashed.
+func (s *S3) hashObject(ctx context.Context, accountID, imageID string) (string, string, error) {
+	key := objectKey(accountID, imageID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		if errors.Is(err, errNoSuchKey) {
+			return "", "", fmt.Errorf("image %s/%s %w", accountID, imageID, ErrNotFound)
+		}
+		return "", "", fmt.Errorf("downloading %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx: ctx, r: resp.Body}); err != nil {
+		return "", "", fmt.Errorf("hashing %s: %w", key, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), resp.Header.Get("ETag"), nil
+}
+
+// recordDigest copies the object with the given key onto itself with sum in
+// its metadata. The copy is made only if the object is still the version
+// with the given ETag, so that a digest never describes data uploaded
+// meanwhile. Failing only costs downloading the object again, so errors are
+// ignored.
+func (s *S3) recordDigest(ctx context.Context, key, etag, sum string) {
+	if etag == "" {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), http.NoBody)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Amz-Copy-Source", s3EscapePath("/"+s.cfg.Bucket+"/"+key))
+	req.Header.Set("X-Amz-Copy-Source-If-Match", etag)
+	req.Header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(sha256Header, sum)
+	if resp, err := s.do(req, emptyPayloadHash); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// s3ListResult is the body of a ListObjectsV2 response.
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List yields the IDs of the account's stored images, a page of keys at a
+// time.
+func (s *S3) List(ctx context.Context, accountID string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		prefix := accountID + "/"
+		token := ""
+		for {
+			page, err := s.listPage(ctx, prefix, "", token)
+			if err != nil {
+				yield("", err)
+				return
+			}
+			for _, c := range page.Contents {
+				imageID, ok := strings.CutSuffix(strings.TrimPrefix(c.Key, prefix), "/original")
+				if !ok || imageID == "" || strings.Contains(imageID, "/") {
+					continue
+				}
+				if !yield(imageID, nil) {
+					return
+				}
+			}
+			if !page.IsTruncated || page.NextContinuationToken == "" {
+				return
+			}
+			token = page.NextContinuationToken
+		}
+	}
+}
+
+// Accounts yields the first segments of the keys in the bucket, which S3
+// lists as common prefixes.
+func (s *S3) Accounts(ctx context.Context) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		token := ""
+		for {
+			page, err := s.listPage(ctx, "", "/", token)
+			if err != nil {
+				yield("", err)
+				return
+			}
+			for _, p := range page.CommonPrefixes {
+				if accountID := strings.TrimSuffix(p.Prefix, "/"); accountID != "" {
+					if !yield(accountID, nil) {
+						return
+					}
+				}
+			}
+			if !page.IsTruncated || page.NextContinuationToken == "" {
+				return
+			}
+			token = page.NextContinuationToken
+		}
+	}
+}
+
+// listPage lists a page of the keys with the given prefix, grouping them by
+// delimiter unless it is empty, and continuing from token unless it is
+// empty.
+func (s *S3) listPage(ctx context.Context, prefix, delimiter, token string) (*s3ListResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u := s.objectURL("")
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		q.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	u.RawQuery = strings.ReplaceAll(q.Encode(), "+", "%20")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", prefix, err)
+	}
+	defer resp.Body.Close()
+	var page s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("listing %s: decoding response: %w", prefix, err)
+	}
+	return &page, nil
+}
+
+// RetrieveRange returns part of the stored original, fetched with a Range
+// request.
+func (s *S3) RetrieveRange(ctx context.Context, accountID, imageID string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkRange(offset, length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		// An empty range cannot be requested; only check for the image.
+		exists, err := s.Exists(ctx, accountID, imageID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("image %s/%s %w", accountID, imageID, ErrNotFound)
+		}
+		return http.NoBody, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key := objectKey(accountID, imageID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+length-1, 10))
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		switch {
+		case errors.Is(err, errNoSuchKey):
+			return nil, fmt.Errorf("image %s/%s %w", accountID, imageID, ErrNotFound)
+		case errors.Is(err, errInvalidRange):
+			// The range starts past the end of the object.
+			return http.NoBody, nil
+		}
+		return nil, fmt.Errorf("downloading %s: %w", key, err)
+	}
+	return resp.Body, nil
+}
+
+var (
+	// errNoSuchKey is returned by do for requests answered with a 404
+	// NoSuchKey, or with a 404 to a HEAD, which carries no error code. Any
+	// other 404, such as NoSuchBucket, is an error like any other.
+	errNoSuchKey = errors.New("no such key")
+	// errInvalidRange is returned by do for requests answered with 416.
+	errInvalidRange = errors.New("invalid range")
+)
+
+// s3Error is the body of an S3 error response.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do signs and sends req, whose body has the given SHA-256 hex digest. A
+// response other than 2xx is closed and returned as an error.
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, time.Now())
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return nil, errInvalidRange
+	}
+	var e s3Error
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(body, &e) != nil {
+		e = s3Error{}
+	}
+	if resp.StatusCode == http.StatusNotFound && (e.Code == "NoSuchKey" || (e.Code == "" && req.Method == http.MethodHead)) {
+		return nil, errNoSuchKey
+	}
+	if e.Code != "" {
+		return nil, fmt.Errorf("%s: %s: %s", resp.Status, e.Code, e.Message)
+	}
+	return nil, errors.New(resp.Status)
+}
+
+// ---------------------------------------------------------------------------
+// AWS Signature Version 4
+// ---------------------------------------------------------------------------
+
+// emptyPayloadHash is the SHA-256 hex digest of an empty body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds AWS Signature Version 4 headers to req, signing the host and
+// every header already set. It leaves req unsigned, but for the payload
+// hash, if no credentials are configured.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.cfg.AccessKeyID == "" {
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), amzDate[:8])
+	for _, part := range []string{s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery encodes a query string in the canonical form signed by
+// Signature Version 4: sorted, with every reserved character escaped.
+func canonicalQuery(q url.Values) string {
+	var parts []string
+	for k, vs := range q {
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+// s3EscapePath escapes an object path as Signature Version 4 requires.
+func s3EscapePath(path string) string {
+	return s3Escape(path, false)
+}
+
+// s3Escape percent-encodes every byte of s but the unreserved characters,
+// and "/" unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -1,18 +1,120 @@
 package storage
 
-import "io"
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
 
-// Storage defines the interface for image blob storage.
+// Storage defines the interface for image blob storage. Every method takes
+// the context of the request it serves; a cancelled context aborts the
+// operation.
 type Storage interface {
 	// Store writes image data and returns the number of bytes written.
-	Store(accountID, imageID string, data io.Reader) (int64, error)
+	Store(ctx context.Context, accountID, imageID string, data io.Reader) (int64, error)
 
 	// Retrieve returns a ReadCloser for the stored image data.
-	Retrieve(accountID, imageID string) (io.ReadCloser, error)
+	Retrieve(ctx context.Context, accountID, imageID string) (io.ReadCloser, error)
 
 	// Delete removes the stored image data.
-	Delete(accountID, imageID string) error
+	Delete(ctx context.Context, accountID, imageID string) error
 
 	// Exists checks whether image data exists in storage.
-	Exists(accountID, imageID string) (bool, error)
+	Exists(ctx context.Context, accountID, imageID string) (bool, error)
+
+	// Stat describes the stored image data. Backends record the digest
+	// as the data is stored, so Stat need not read it.
+	Stat(ctx context.Context, accountID, imageID string) (*BlobInfo, error)
+
+	// List yields the IDs of the images of an account that have data
+	// stored, in no particular order. An error ends the iteration.
+	List(ctx context.Context, accountID string) iter.Seq2[string, error]
+
+	// Accounts yields the IDs of the accounts with image data stored, in
+	// no particular order. An error ends the iteration.
+	Accounts(ctx context.Context) iter.Seq2[string, error]
+
+	// RetrieveRange returns a ReadCloser for up to length bytes of the
+	// stored image data, starting at offset. It reads fewer bytes if the
+	// data ends first, and none if offset is at or past the end.
+	RetrieveRange(ctx context.Context, accountID, imageID string, offset, length int64) (io.ReadCloser, error)
+}
+
+// BlobInfo describes stored image data.
+type BlobInfo struct {
+	Size int64
+	// ModTime is when the image's data was stored.
+	ModTime time.Time
+	// SHA256 is the hex digest of the data, empty if the store has not
+	// recorded it yet.
+	SHA256 string
+}
+
+// Options configures the store opened by Open.
+type Options struct {
+	// S3 describes the bucket of an "s3://" store.
+	S3 S3Config
+	// ContentAddressed selects NewContentAddressedFileSystem for a
+	// filesystem store.
+	ContentAddressed bool
+}
+
+// Open opens the store named by path: "s3://" for the S3 bucket described
+// by opts; "memory://", optionally followed by a "?max_bytes=N" cap, for a
+// Memory store; otherwise a FileSystem rooted at path.
+func Open(path string, opts Options) (Storage, error) {
+	if path == s3Path {
+		return NewS3(opts.S3)
+	}
+	if !strings.HasPrefix(path, memoryScheme) {
+		if opts.ContentAddressed {
+			return NewContentAddressedFileSystem(path), nil
+		}
+		return NewFileSystem(path), nil
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("parsing storage path %q: %w", path, err)
+	}
+	var maxBytes int64
+	if v := u.Query().Get("max_bytes"); v != "" {
+		maxBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxBytes < 0 {
+			return nil, fmt.Errorf("invalid max_bytes in storage path %q", path)
+		}
+	}
+	return NewMemory(maxBytes), nil
+}
+
+// contextReader fails reads once its context is done, so that copies from
+// it stop when the request that started them goes away.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// checkRange validates the arguments of RetrieveRange.
+func checkRange(offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid range: offset %d, length %d", offset, length)
+	}
+	return nil
+}
+
+// readCloser joins a Reader to the Closer of what it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// contract lists the tests every Storage implementation must pass. Each runs
+// against a fresh, empty store.
+var contract = []struct {
+	name string
+	test func(t *testing.T, s Storage)
+}{
+	{"Store", testStore},
+	{"Retrieve", testRetrieve},
+	{"Overwrite", testOverwrite},
+	{"Delete", testDelete},
+	{"Exists", testExists},
+	{"RetrieveNotFound", testRetrieveNotFound},
+	{"DeleteNotFound", testDeleteNotFound},
+	{"StoreCancelled", testStoreCancelled},
+	{"Stat", testStat},
+	{"StatNotFound", testStatNotFound},
+	{"List", testList},
+	{"RetrieveRange", testRetrieveRange},
+	{"Accounts", testAccounts},
+}
+
+// runContract runs the contract tests against stores from open.
+func runContract(t *testing.T, open func(t *testing.T) Storage) {
+	for _, c := range contract {
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, open(t))
+		})
+	}
+}
+
+func TestFileSystem_Contract(t *testing.T) {
+	runContract(t, func(t *testing.T) Storage { return NewFileSystem(t.TempDir()) })
+}
+
+func TestMemory_Contract(t *testing.T) {
+	runContract(t, func(t *testing.T) Storage { return NewMemory(0) })
+}
+
+func TestMemory_Contract_Capped(t *testing.T) {
+	runContract(t, func(t *testing.T) Storage { return NewMemory(1 << 20) })
+}
+
+// retrieve returns the blob stored for the image.
+func retrieve(t *testing.T, s Storage, accountID, imageID string) []byte {
+	t.Helper()
+	rc, err := s.Retrieve(t.Context(), accountID, imageID)
+	require.NoError(t, err)
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return got
+}
+
+func testStore(t *testing.T, s Storage) {
+	data := []byte("hello, image data")
+
+	n, err := s.Store(t.Context(), "acct-1", "img-1", bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, retrieve(t, s, "acct-1", "img-1"))
+
+	// Blobs are kept per account.
+	exists, err := s.Exists(t.Context(), "acct-2", "img-1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func testRetrieve(t *testing.T, s Storage) {
+	data := []byte("retrieve me")
+
+	_, err := s.Store(t.Context(), "acct-1", "img-2", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	assert.Equal(t, data, retrieve(t, s, "acct-1", "img-2"))
+	// Reading does not consume the blob.
+	assert.Equal(t, data, retrieve(t, s, "acct-1", "img-2"))
+}
+
+func testOverwrite(t *testing.T, s Storage) {
+	_, err := s.Store(t.Context(), "acct-1", "img-1", bytes.NewReader([]byte("first version")))
+	require.NoError(t, err)
+	_, err = s.Store(t.Context(), "acct-1", "img-1", bytes.NewReader([]byte("second")))
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("second"), retrieve(t, s, "acct-1", "img-1"))
+}
+
+func testDelete(t *testing.T, s Storage) {
+	data := []byte("delete me")
+
+	_, err := s.Store(t.Context(), "acct-1", "img-3", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	err = s.Delete(t.Context(), "acct-1", "img-3")
+	require.NoError(t, err)
+
+	exists, err := s.Exists(t.Context(), "acct-1", "img-3")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	_, err = s.Retrieve(t.Context(), "acct-1", "img-3")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testExists(t *testing.T, s Storage) {
+	// Should not exist yet.
+	exists, err := s.Exists(t.Context(), "acct-1", "img-4")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Store data.
+	_, err = s.Store(t.Context(), "acct-1", "img-4", bytes.NewReader([]byte("exists")))
+	require.NoError(t, err)
+
+	// Should exist now.
+	exists, err = s.Exists(t.Context(), "acct-1", "img-4")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func testRetrieveNotFound(t *testing.T, s Storage) {
+	rc, err := s.Retrieve(t.Context(), "no-account", "no-image")
+	assert.Error(t, err)
+	assert.Nil(t, rc)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testDeleteNotFound(t *testing.T, s Storage) {
+	// Deleting a non-existent image should be idempotent (no error).
+	err := s.Delete(t.Context(), "no-account", "no-image")
+	assert.NoError(t, err)
+}
+
+// cancellingReader cancels its context after the first read.
+type cancellingReader struct {
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return copy(p, "partial"), nil
+}
+
+func testStoreCancelled(t *testing.T, s Storage) {
+	ctx, cancel := context.WithCancel(t.Context())
+	_, err := s.Store(ctx, "acct-1", "img-1", &cancellingReader{cancel: cancel})
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Nothing is left behind.
+	exists, err := s.Exists(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = s.Retrieve(ctx, "acct-1", "img-1")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = s.Exists(ctx, "acct-1", "img-1")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, s.Delete(ctx, "acct-1", "img-1"), context.Canceled)
+}
+
+func testStat(t *testing.T, s Storage) {
+	before := time.Now().Add(-time.Minute)
+	_, err := s.Store(t.Context(), "acct-1", "img-1", bytes.NewReader([]byte("first version")))
+	require.NoError(t, err)
+	_, err = s.Store(t.Context(), "acct-1", "img-1", bytes.NewReader([]byte("stat me")))
+	require.NoError(t, err)
+
+	info, err := s.Stat(t.Context(), "acct-1", "img-1")
+	require.NoError(t, err)
+	sum := sha256.Sum256([]byte("stat me"))
+	assert.Equal(t, int64(len("stat me")), info.Size)
+	assert.Equal(t, hex.EncodeToString(sum[:]), info.SHA256)
+	assert.True(t, info.ModTime.After(before), "modtime %v", info.ModTime)
+}
+
+func testStatNotFound(t *testing.T, s Storage) {
+	_, err := s.Stat(t.Context(), "no-account", "no-image")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err = s.Stat(ctx, "no-account", "no-image")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// listIDs collects the image IDs s lists for the account, sorted.
+func listIDs(t *testing.T, s Storage, accountID string) []string {
+	t.Helper()
+	var ids []string
+	for id, err := range s.List(t.Context(), accountID) {
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func testList(t *testing.T, s Storage) {
+	assert.Empty(t, listIDs(t, s, "acct-1"))
+
+	for _, id := range []string{"img-1", "img-2", "img-3", "img-4", "img-5"} {
+		_, err := s.Store(t.Context(), "acct-1", id, bytes.NewReader([]byte(id)))
+		require.NoError(t, err)
+	}
+	_, err := s.Store(t.Context(), "acct-2", "img-6", bytes.NewReader([]byte("other")))
+	require.NoError(t, err)
+	require.NoError(t, s.Delete(t.Context(), "acct-1", "img-3"))
+
+	assert.Equal(t, []string{"img-1", "img-2", "img-4", "img-5"}, listIDs(t, s, "acct-1"))
+	assert.Equal(t, []string{"img-6"}, listIDs(t, s, "acct-2"))
+
+	// Stopping early is allowed.
+	for range s.List(t.Context(), "acct-1") {
+		break
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	for _, err := range s.List(ctx, "acct-1") {
+		require.ErrorIs(t, err, context.Canceled)
+		break
+	}
+}
+
+func testAccounts(t *testing.T, s Storage) {
+	accounts := func() []string {
+		var ids []string
+		for id, err := range s.Accounts(t.Context()) {
+			require.NoError(t, err)
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+	assert.Empty(t, accounts())
+
+	for _, acct := range []string{"acct-1", "acct-2", "acct-3"} {
+		for _, id := range []string{"img-1", "img-2"} {
+			_, err := s.Store(t.Context(), acct, id, bytes.NewReader([]byte(id)))
+			require.NoError(t, err)
+		}
+	}
+	assert.Equal(t, []string{"acct-1", "acct-2", "acct-3"}, accounts())
+}
+
+func testRetrieveRange(t *testing.T, s Storage) {
+	_, err := s.Store(t.Context(), "acct-1", "img-1", bytes.NewReader([]byte("0123456789")))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 10, "0123456789"},
+		{2, 3, "234"},
+		{8, 5, "89"},
+		{3, 0, ""},
+		{10, 1, ""},
+		{20, 5, ""},
+	} {
+		rc, err := s.RetrieveRange(t.Context(), "acct-1", "img-1", tc.offset, tc.length)
+		require.NoError(t, err, "offset %d, length %d", tc.offset, tc.length)
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, string(got), "offset %d, length %d", tc.offset, tc.length)
+	}
+
+	_, err = s.RetrieveRange(t.Context(), "acct-1", "img-1", -1, 5)
+	assert.Error(t, err)
+	_, err = s.RetrieveRange(t.Context(), "acct-1", "no-image", 0, 5)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestOpen(t *testing.T) {
+	s, err := Open("memory://", Options{})
+	require.NoError(t, err)
+	m, ok := s.(*Memory)
+	require.True(t, ok)
+	assert.Equal(t, int64(0), m.maxBytes)
+
+	s, err = Open("memory://?max_bytes=1024", Options{})
+	require.NoError(t, err)
+	m, ok = s.(*Memory)
+	require.True(t, ok)
+	assert.Equal(t, int64(1024), m.maxBytes)
+
+	_, err = Open("memory://?max_bytes=lots", Options{})
+	assert.Error(t, err)
+
+	s, err = Open(t.TempDir(), Options{})
+	require.NoError(t, err)
+	fs, ok := s.(*FileSystem)
+	require.True(t, ok)
+	assert.Nil(t, fs.blobs)
+
+	s, err = Open(t.TempDir(), Options{ContentAddressed: true})
+	require.NoError(t, err)
+	fs, ok = s.(*FileSystem)
+	require.True(t, ok)
+	assert.NotNil(t, fs.blobs)
+}
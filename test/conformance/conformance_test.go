@@ -11,6 +11,7 @@ var (
 	baseURL   string
 	authToken string
 	accountID string
+	zoneID    string
 	isRealAPI bool
 )
 
@@ -27,6 +28,10 @@ func TestMain(m *testing.M) {
 	if accountID == "" {
 		accountID = "test-account"
 	}
+	zoneID = os.Getenv("DT_ZONE_ID")
+	if zoneID == "" {
+		zoneID = "test-zone"
+	}
 	isRealAPI = os.Getenv("DT_REAL_API") == "true"
 	os.Exit(m.Run())
 }
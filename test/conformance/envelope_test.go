@@ -8,7 +8,7 @@ import (
 )
 
 func TestEnvelope_SuccessShape(t *testing.T) {
-	status, raw := doMultipartUpload(t, apiURL("/v1"), []byte("test-image-data"), "test.png")
+	status, raw := doMultipartUpload(t, apiURL("/v1"), testPNG(t, 0), "test.png")
 	if status != http.StatusOK {
 		t.Fatalf("upload failed with status %d: %v", status, raw)
 	}
@@ -0,0 +1,326 @@
+//go:build conformance
+
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// doRaw performs a request with the given content type and returns the
+// decoded JSON, without the assumptions of doJSON.
+func doRaw(t *testing.T, method, url, contentType string, body io.Reader, auth bool) (int, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("create request: %v", err)
+	}
+	if auth {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp := doRequest(t, req)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("unmarshal JSON: %v\nbody: %s", err, string(data))
+	}
+	return resp.StatusCode, raw
+}
+
+// formBody builds a multipart body from plain fields.
+func formBody(t *testing.T, fields map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatalf("write field: %v", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+	return &buf, mw.FormDataContentType()
+}
+
+func TestErrorCodes_Authentication(t *testing.T) {
+	status, raw := doRaw(t, "GET", apiURL("/v1"), "", nil, false)
+	if status != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", status)
+	}
+	assertAPIError(t, raw, 10000, "Authentication error", "")
+}
+
+func TestErrorCodes_Images(t *testing.T) {
+	t.Run("get missing image", func(t *testing.T) {
+		status, raw := doJSON(t, "GET", apiURL("/v1/nonexistent-id"), nil)
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", status)
+		}
+		assertAPIError(t, raw, 5404, "Image not found", "")
+	})
+
+	t.Run("delete missing image", func(t *testing.T) {
+		status, raw := doJSON(t, "DELETE", apiURL("/v1/nonexistent-id"), nil)
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", status)
+		}
+		assertAPIError(t, raw, 5404, "Image not found", "")
+	})
+
+	t.Run("blob of missing image", func(t *testing.T) {
+		status, raw := doJSON(t, "GET", apiURL("/v1/nonexistent-id/blob"), nil)
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", status)
+		}
+		assertAPIError(t, raw, 5404, "Image not found", "")
+	})
+
+	t.Run("upload without file or url", func(t *testing.T) {
+		body, ct := formBody(t, map[string]string{"requireSignedURLs": "false"})
+		status, raw := doRaw(t, "POST", apiURL("/v1"), ct, body, true)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5415, "Images must be uploaded as a file or url", "/file")
+	})
+
+	t.Run("upload with invalid metadata", func(t *testing.T) {
+		body, ct := formBody(t, map[string]string{"metadata": "{not json"})
+		status, raw := doRaw(t, "POST", apiURL("/v1"), ct, body, true)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5400, "Bad request: metadata must be a JSON object", "/metadata")
+	})
+
+	t.Run("upload with long creator", func(t *testing.T) {
+		body, ct := formBody(t, map[string]string{"creator": strings.Repeat("c", 1025), "url": "https://example.com/a.png"})
+		status, raw := doRaw(t, "POST", apiURL("/v1"), ct, body, true)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5400, "Bad request: creator must be at most 1024 characters", "/creator")
+	})
+
+	t.Run("update missing image", func(t *testing.T) {
+		status, raw := doJSON(t, "PATCH", apiURL("/v1/nonexistent-id"), strings.NewReader(`{}`))
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", status)
+		}
+		assertAPIError(t, raw, 5404, "Image not found", "")
+	})
+
+	t.Run("update with invalid JSON", func(t *testing.T) {
+		id := uploadAndCleanup(t)["id"].(string)
+		status, raw := doJSON(t, "PATCH", apiURL("/v1/"+id), strings.NewReader(`{not json`))
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5400, "Bad request: invalid JSON body", "")
+	})
+}
+
+func TestErrorCodes_ListV2(t *testing.T) {
+	t.Run("invalid continuation token", func(t *testing.T) {
+		status, raw := doJSON(t, "GET", apiURL("/v2?continuation_token=bogus"), nil)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5400, "Bad request: invalid continuation_token", "")
+	})
+
+	t.Run("too many metadata filters", func(t *testing.T) {
+		q := "?metadata[a][eq]=1&metadata[b][eq]=1&metadata[c][eq]=1&metadata[d][eq]=1&metadata[e][eq]=1&metadata[f][eq]=1"
+		status, raw := doJSON(t, "GET", apiURL("/v2"+q), nil)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5400, "Bad request: too many metadata filters (max 5)", "")
+	})
+}
+
+func TestErrorCodes_Variants(t *testing.T) {
+	t.Run("get missing variant", func(t *testing.T) {
+		status, raw := doJSON(t, "GET", apiURL("/v1/variants/nonexistent"), nil)
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", status)
+		}
+		assertAPIError(t, raw, 5404, "Variant not found", "")
+	})
+
+	t.Run("delete missing variant", func(t *testing.T) {
+		status, raw := doJSON(t, "DELETE", apiURL("/v1/variants/nonexistent"), nil)
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", status)
+		}
+		assertAPIError(t, raw, 5404, "Variant not found", "")
+	})
+
+	t.Run("duplicate variant", func(t *testing.T) {
+		createVariantAndCleanup(t, "error-codes-dup")
+		body := `{"id":"error-codes-dup","options":{"fit":"scale-down","width":100,"height":100,"metadata":"none"}}`
+		status, raw := doJSON(t, "POST", apiURL("/v1/variants"), strings.NewReader(body))
+		if status != http.StatusConflict {
+			t.Errorf("expected status 409, got %d", status)
+		}
+		assertAPIError(t, raw, 5409, "Variant already exists", "/id")
+	})
+
+	t.Run("missing id", func(t *testing.T) {
+		body := `{"options":{"fit":"scale-down","width":100,"height":100,"metadata":"none"}}`
+		status, raw := doJSON(t, "POST", apiURL("/v1/variants"), strings.NewReader(body))
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5400, "Bad request: variant id is required", "/id")
+	})
+
+	t.Run("invalid fit", func(t *testing.T) {
+		body := `{"id":"error-codes-fit","options":{"fit":"stretch","width":100,"height":100,"metadata":"none"}}`
+		status, raw := doJSON(t, "POST", apiURL("/v1/variants"), strings.NewReader(body))
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5400, "Bad request: invalid fit mode: must be one of scale-down, contain, cover, crop, pad", "/options/fit")
+	})
+}
+
+func TestErrorCodes_SigningKeys(t *testing.T) {
+	status, raw := doJSON(t, "DELETE", apiURL("/v1/keys/nonexistent-key"), nil)
+	if status != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", status)
+	}
+	assertAPIError(t, raw, 5404, "Signing key not found", "")
+}
+
+func TestErrorCodes_DirectUpload(t *testing.T) {
+	t.Run("invalid expiry", func(t *testing.T) {
+		status, raw := doJSON(t, "POST", apiURL("/v2/direct_upload"), strings.NewReader(`{"expiry":"tomorrow"}`))
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5400, "Bad request: expiry must be an RFC3339 timestamp", "/expiry")
+	})
+
+	t.Run("unknown upload", func(t *testing.T) {
+		skipOnRealAPI(t)
+		body, ct := formBody(t, nil)
+		status, raw := doRaw(t, "POST", strings.TrimRight(baseURL, "/")+"/upload/nonexistent-upload", ct, body, false)
+		if status != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", status)
+		}
+		assertAPIError(t, raw, 5404, "Upload not found", "")
+	})
+
+	t.Run("upload without file", func(t *testing.T) {
+		_, created := doJSON(t, "POST", apiURL("/v2/direct_upload"), strings.NewReader(`{}`))
+		uploadURL := created["result"].(map[string]any)["uploadURL"].(string)
+
+		body, ct := formBody(t, map[string]string{"metadata": "{}"})
+		status, raw := doRaw(t, "POST", uploadURL, ct, body, false)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 5415, "Images must be uploaded as a file", "/file")
+	})
+
+	t.Run("upload already completed", func(t *testing.T) {
+		_, created := doJSON(t, "POST", apiURL("/v2/direct_upload"), strings.NewReader(`{}`))
+		result := created["result"].(map[string]any)
+		uploadID := result["id"].(string)
+		uploadURL := result["uploadURL"].(string)
+		t.Cleanup(func() { doJSON(t, "DELETE", apiURL("/v1/"+uploadID), nil) })
+
+		for i, want := range []int{http.StatusOK, http.StatusConflict} {
+			body, ct := multipartBody(t, "file", "direct.png", testPNG(t, 1))
+			status, raw := doRaw(t, "POST", uploadURL, ct, body, false)
+			if status != want {
+				t.Fatalf("upload %d: expected status %d, got %d", i, want, status)
+			}
+			if want == http.StatusConflict {
+				assertAPIError(t, raw, 5409, "Upload already completed", "")
+			}
+		}
+	})
+}
+
+func TestErrorCodes_PurgeCache(t *testing.T) {
+	t.Run("no purge target", func(t *testing.T) {
+		status, raw := doJSON(t, "POST", zoneURL("/purge_cache"), strings.NewReader(`{}`))
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 1012, `Request must contain one of "purge_everything", "files", "tags", "hosts" or "prefixes"`, "")
+	})
+
+	t.Run("malformed JSON", func(t *testing.T) {
+		status, raw := doJSON(t, "POST", zoneURL("/purge_cache"), strings.NewReader(`{not json`))
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 6007, "Malformed JSON in request body", "")
+	})
+
+	t.Run("too many files", func(t *testing.T) {
+		skipOnRealAPI(t)
+		files := make([]string, 31)
+		for i := range files {
+			files[i] = fmt.Sprintf(`"https://example.com/%d.png"`, i)
+		}
+		body := `{"files":[` + strings.Join(files, ",") + `]}`
+		status, raw := doJSON(t, "POST", zoneURL("/purge_cache"), strings.NewReader(body))
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 1012, "Too many items to purge (max 30)", "")
+	})
+
+	t.Run("malformed file entry", func(t *testing.T) {
+		skipOnRealAPI(t)
+		status, raw := doJSON(t, "POST", zoneURL("/purge_cache"), strings.NewReader(`{"files":[42]}`))
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 1012, "Files entries must be a URL or an object with a url", "/files/0")
+	})
+
+	t.Run("empty prefix", func(t *testing.T) {
+		skipOnRealAPI(t)
+		status, raw := doJSON(t, "POST", zoneURL("/purge_cache"), strings.NewReader(`{"prefixes":["example.com/a",""]}`))
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", status)
+		}
+		assertAPIError(t, raw, 1012, "Prefixes must not be empty", "/prefixes/1")
+	})
+}
+
+func TestErrorCodes_Internal(t *testing.T) {
+	skipOnRealAPI(t)
+	// An account ID too long to be a directory name makes filesystem
+	// storage fail, which is the server's fault rather than the client's.
+	url := strings.TrimRight(baseURL, "/") + "/accounts/" + strings.Repeat("a", 300) + "/images/v1"
+	status, raw := doMultipartUpload(t, url, testPNG(t, 5), "internal.png")
+	if status == http.StatusOK {
+		result := raw["result"].(map[string]any)
+		doJSON(t, "DELETE", url+"/"+result["id"].(string), nil)
+		t.Skip("storage accepted the long account ID")
+	}
+	if status != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", status)
+	}
+	assertAPIError(t, raw, 5500, "Internal error", "")
+}
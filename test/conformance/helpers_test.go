@@ -6,6 +6,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -19,6 +22,12 @@ func apiURL(path string) string {
 	return strings.TrimRight(baseURL, "/") + "/accounts/" + accountID + "/images" + path
 }
 
+// zoneURL builds a full URL for the given zone API path suffix, e.g.
+// "/purge_cache".
+func zoneURL(path string) string {
+	return strings.TrimRight(baseURL, "/") + "/zones/" + zoneID + path
+}
+
 // doRequest performs an HTTP request and returns the response.
 func doRequest(t *testing.T, req *http.Request) *http.Response {
 	t.Helper()
@@ -76,6 +85,19 @@ func doMultipartUpload(t *testing.T, url string, fileContent []byte, fileName st
 	return resp.StatusCode, raw
 }
 
+// testPNG encodes a 1x1 PNG of the given grey level, so that tests can tell
+// their uploads apart.
+func testPNG(t *testing.T, grey uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 1, 1))
+	img.SetGray(0, 0, color.Gray{Y: grey})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
 // multipartBody builds a multipart form body with a single file field.
 func multipartBody(t *testing.T, fieldName, fileName string, content []byte) (*bytes.Buffer, string) {
 	t.Helper()
@@ -182,7 +204,7 @@ func assertFieldAbsent(t *testing.T, obj map[string]any, field string) {
 // Returns the raw result object from the upload response.
 func uploadAndCleanup(t *testing.T) map[string]any {
 	t.Helper()
-	status, raw := doMultipartUpload(t, apiURL("/v1"), []byte("test-image-data"), "test.png")
+	status, raw := doMultipartUpload(t, apiURL("/v1"), testPNG(t, 0), "test.png")
 	if status != http.StatusOK {
 		t.Fatalf("upload failed with status %d: %v", status, raw)
 	}
@@ -275,3 +297,39 @@ func skipOnDigitalTwin(t *testing.T) {
 		t.Skip("skipping on digital twin")
 	}
 }
+
+// assertAPIError validates that an error envelope carries exactly one error
+// with the given code and message, and a source.pointer equal to pointer
+// (absent when pointer is "").
+func assertAPIError(t *testing.T, raw map[string]any, code int, message, pointer string) {
+	t.Helper()
+	assertEnvelopeShape(t, raw)
+	if raw["success"] != false {
+		t.Errorf("success should be false, got %v", raw["success"])
+	}
+
+	errs, ok := raw["errors"].([]any)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected exactly one error, got %v", raw["errors"])
+	}
+	errObj, ok := errs[0].(map[string]any)
+	if !ok {
+		t.Fatalf("errors[0] is not an object: %T", errs[0])
+	}
+
+	if got := assertField[float64](t, errObj, "code"); int(got) != code {
+		t.Errorf("code: got %v, want %d", got, code)
+	}
+	if got := assertField[string](t, errObj, "message"); got != message {
+		t.Errorf("message: got %q, want %q", got, message)
+	}
+
+	if pointer == "" {
+		assertFieldAbsent(t, errObj, "source")
+		return
+	}
+	source := assertField[map[string]any](t, errObj, "source")
+	if got := assertField[string](t, source, "pointer"); got != pointer {
+		t.Errorf("source.pointer: got %q, want %q", got, pointer)
+	}
+}
@@ -71,7 +71,7 @@ func TestV1_UpdateImage_MetadataAndSignedURLs(t *testing.T) {
 
 func TestV1_DeleteImage_ThenGet404(t *testing.T) {
 	// Upload without using uploadAndCleanup since we're testing delete
-	status, raw := doMultipartUpload(t, apiURL("/v1"), []byte("delete-test"), "delete-me.png")
+	status, raw := doMultipartUpload(t, apiURL("/v1"), testPNG(t, 2), "delete-me.png")
 	if status != http.StatusOK {
 		t.Fatalf("upload returned %d", status)
 	}
@@ -92,7 +92,7 @@ func TestV1_DeleteImage_ThenGet404(t *testing.T) {
 }
 
 func TestV1_GetBlob_MatchesOriginal(t *testing.T) {
-	originalContent := []byte("unique-blob-content-12345")
+	originalContent := testPNG(t, 3)
 	status, raw := doMultipartUpload(t, apiURL("/v1"), originalContent, "blob-test.bin")
 	if status != http.StatusOK {
 		t.Fatalf("upload returned %d", status)
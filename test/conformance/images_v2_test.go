@@ -132,7 +132,7 @@ func TestV2_DirectUpload_FullFlow(t *testing.T) {
 	if err != nil {
 		t.Fatalf("create form file: %v", err)
 	}
-	fw.Write([]byte("direct-upload-content"))
+	fw.Write(testPNG(t, 4))
 	mw.Close()
 
 	req, _ := http.NewRequest("POST", uploadURL, &buf)
@@ -12,6 +12,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
 
 	"github.com/leca/dt-cloudflare-images/internal/config"
@@ -27,12 +28,12 @@ const (
 	testAccountID = "test-account"
 )
 
-// setupTestServer creates a test HTTP server backed by in-memory SQLite
-// and a temporary filesystem storage directory.
+// setupTestServer creates a test HTTP server backed by an SQLite database
+// and a filesystem storage directory, both temporary and private to t.
 func setupTestServer(t *testing.T) *httptest.Server {
 	t.Helper()
 
-	db, err := database.NewSQLiteDB("file::memory:?cache=shared")
+	db, err := database.NewSQLiteDB(filepath.Join(t.TempDir(), "images.db"))
 	require.NoError(t, err)
 	t.Cleanup(func() { db.Close() })
 
@@ -41,6 +42,7 @@ func setupTestServer(t *testing.T) *httptest.Server {
 		AuthToken:      testToken,
 		BaseURL:        "", // will be set after server starts
 		ImageAllowance: 100000,
+		CacheMaxBytes:  64 << 20,
 	}
 	srv := router.New(db, store, cfg)
 	ts := httptest.NewServer(srv.Router)
@@ -753,3 +755,53 @@ func TestImageLifecycle_VariantURLsInResponse(t *testing.T) {
 	}
 	assert.True(t, found, "should have a variant URL containing %s, got %v", expected, img.Variants)
 }
+
+func TestCachePurgeFlow(t *testing.T) {
+	ts := setupTestServer(t)
+
+	// 1. Create a variant and upload an image.
+	resp := authPost(t, apiBase(ts)+"/v1/variants", map[string]interface{}{
+		"id":      "thumb",
+		"options": map[string]interface{}{"fit": "scale-down", "width": 5, "height": 5, "metadata": "none"},
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	img := uploadImage(t, ts)
+	deliveryURL := ts.URL + "/cdn/" + testAccountID + "/" + img.ID + "/thumb"
+
+	deliver := func() string {
+		t.Helper()
+		resp, err := http.Get(deliveryURL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.Header.Get("cf-cache-status")
+	}
+
+	// 2. First delivery populates the cache, the second is served from it.
+	assert.Equal(t, "MISS", deliver())
+	assert.Equal(t, "HIT", deliver())
+
+	// 3. Purge the delivery URL.
+	resp = authPost(t, ts.URL+"/zones/test-zone/purge_cache", map[string]interface{}{
+		"files": []string{deliveryURL},
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	env := decodeEnvelope(t, resp)
+	require.True(t, env.Success)
+
+	// 4. The next delivery is a miss again.
+	assert.Equal(t, "MISS", deliver())
+	assert.Equal(t, "HIT", deliver())
+
+	// 5. purge_everything also clears it.
+	resp = authPost(t, ts.URL+"/zones/test-zone/purge_cache", map[string]interface{}{
+		"purge_everything": true,
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+	assert.Equal(t, "MISS", deliver())
+}